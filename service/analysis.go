@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errInvalidQueuePolicy = errors.New("Analysis queue policy must be 'block', 'shed' or 'spill'")
+	errInvalidPoolSize    = errors.New("Analysis pool must have at least one worker and a queue")
+)
+
+// Policies for queueing analysis jobs when the queue is full.
+const (
+	// Wait until there's room in the queue (which slows down uploads).
+	queuePolicyBlock = "block"
+	// Reject new uploads (with 503) until there's room in the queue.
+	queuePolicyShed = "shed"
+	// Leave the jobs in the data store, so that they're queued once there's room.
+	queuePolicySpill = "spill"
+)
+
+// AnalysisConfig for the pool of analysis workers.
+type AnalysisConfig struct {
+	// Number of workers analyzing images concurrently.
+	Workers int
+	// Maximum number of jobs waiting for a worker.
+	QueueSize int
+	// Policy for when the queue is full (see `queuePolicyBlock`, etc.).
+	Policy string
+}
+
+// validate this config.
+func (c AnalysisConfig) validate() error {
+	if c.Workers < 1 || c.QueueSize < 1 {
+		return errInvalidPoolSize
+	}
+
+	if c.Policy != queuePolicyBlock && c.Policy != queuePolicyShed && c.Policy != queuePolicySpill {
+		return errInvalidQueuePolicy
+	}
+
+	return nil
+}
+
+// analysisPool runs analysis jobs using a fixed number of workers, which take jobs
+// from a bounded queue. Jobs are always persisted before they're queued, so the queue
+// is just a (bounded) buffer - whatever doesn't fit is picked up from the data store
+// later. Jobs are queued only once at a time.
+type analysisPool struct {
+	policy  string
+	queue   chan AnalysisJob
+	workers []*workerStats
+	// Signals the dispatcher that some job is waiting in the data store.
+	wake chan struct{}
+
+	lock sync.Mutex
+	// Image IDs of jobs which have been queued (and haven't finished yet).
+	queued map[string]struct{}
+	// Whether some job couldn't be queued because the queue was full.
+	spilled bool
+}
+
+// workerStats for a single worker. These are updated atomically, so that they can
+// be read while the worker is running.
+type workerStats struct {
+	jobs   uint64
+	failed uint64
+	// Time spent running jobs (in nanoseconds).
+	busy uint64
+}
+
+// newAnalysisPool using the given (valid) config.
+func newAnalysisPool(config AnalysisConfig) *analysisPool {
+	pool := &analysisPool{
+		policy: config.Policy,
+		queue:  make(chan AnalysisJob, config.QueueSize),
+		wake:   make(chan struct{}, 1),
+		queued: make(map[string]struct{}),
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		pool.workers = append(pool.workers, &workerStats{})
+	}
+
+	return pool
+}
+
+// enqueue the given job (unless it's already been queued). If the queue is full,
+// then this waits for room (if the policy says so), or it returns false.
+func (p *analysisPool) enqueue(job AnalysisJob) bool {
+	p.lock.Lock()
+	if _, exists := p.queued[job.ImageID]; exists {
+		p.lock.Unlock()
+		return true
+	}
+
+	p.queued[job.ImageID] = struct{}{}
+	p.lock.Unlock()
+
+	if p.policy == queuePolicyBlock {
+		p.queue <- job
+		return true
+	}
+
+	select {
+	case p.queue <- job:
+		return true
+	default:
+	}
+
+	p.lock.Lock()
+	delete(p.queued, job.ImageID)
+	p.lock.Unlock()
+
+	p.spill()
+	return false
+}
+
+// spill marks that some jobs are waiting in the data store, so that the dispatcher
+// is notified once a worker finishes its job.
+func (p *analysisPool) spill() {
+	p.lock.Lock()
+	p.spilled = true
+	p.lock.Unlock()
+}
+
+// overloaded checks whether new uploads should be rejected, because the queue is full.
+func (p *analysisPool) overloaded() bool {
+	return p.policy == queuePolicyShed && len(p.queue) == cap(p.queue)
+}
+
+// notify the dispatcher that some job is waiting in the data store.
+func (p *analysisPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work on the queued jobs using the given function (which returns whether the job
+// has succeeded), and record the stats.
+//
+// **NOTE:** This is blocking and hence, it must be spawn into a separate goroutine.
+func (p *analysisPool) work(stats *workerStats, run func(job AnalysisJob) bool) {
+	for job := range p.queue {
+		start := time.Now()
+		if !run(job) {
+			atomic.AddUint64(&stats.failed, 1)
+		}
+
+		atomic.AddUint64(&stats.busy, uint64(time.Since(start)))
+		atomic.AddUint64(&stats.jobs, 1)
+
+		p.lock.Lock()
+		delete(p.queued, job.ImageID)
+		spilled := p.spilled
+		p.spilled = false
+		p.lock.Unlock()
+
+		// There's room in the queue now.
+		if spilled {
+			p.notify()
+		}
+	}
+}
+
+// status of the queue and the workers.
+func (p *analysisPool) status() AnalysisQueueStatus {
+	status := AnalysisQueueStatus{
+		Policy:   p.policy,
+		Depth:    len(p.queue),
+		Capacity: cap(p.queue),
+		Workers:  []AnalysisWorkerStatus{},
+	}
+
+	for _, stats := range p.workers {
+		worker := AnalysisWorkerStatus{
+			Jobs:        atomic.LoadUint64(&stats.jobs),
+			Failed:      atomic.LoadUint64(&stats.failed),
+			BusySeconds: time.Duration(atomic.LoadUint64(&stats.busy)).Seconds(),
+		}
+
+		if worker.BusySeconds > 0 {
+			worker.JobsPerSecond = float64(worker.Jobs) / worker.BusySeconds
+		}
+
+		status.Workers = append(status.Workers, worker)
+	}
+
+	return status
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalysisConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(AnalysisConfig{Workers: 1, QueueSize: 1, Policy: queuePolicyBlock}.validate())
+	assert.EqualValues(errInvalidQueuePolicy, AnalysisConfig{Workers: 1, QueueSize: 1, Policy: "drop"}.validate())
+	assert.EqualValues(errInvalidPoolSize, AnalysisConfig{Workers: 0, QueueSize: 1, Policy: queuePolicyShed}.validate())
+	assert.EqualValues(errInvalidPoolSize, AnalysisConfig{Workers: 1, QueueSize: 0, Policy: queuePolicyShed}.validate())
+
+	_, err := NewObjectsRepository(nil, 0, 1, 1, AnalysisConfig{Workers: 1, QueueSize: 1, Policy: "drop"})
+	assert.EqualValues(errInvalidQueuePolicy, err)
+}
+
+func TestAnalysisPool(t *testing.T) {
+	assert := assert.New(t)
+	pool := newAnalysisPool(AnalysisConfig{Workers: 2, QueueSize: 2, Policy: queuePolicySpill})
+
+	// Jobs are queued only once, and whatever doesn't fit is left for later.
+	assert.True(pool.enqueue(AnalysisJob{ImageID: "foo"}))
+	assert.True(pool.enqueue(AnalysisJob{ImageID: "foo"}))
+	assert.True(pool.enqueue(AnalysisJob{ImageID: "bar"}))
+	assert.False(pool.enqueue(AnalysisJob{ImageID: "baz"}))
+	assert.False(pool.overloaded())
+
+	status := pool.status()
+	assert.EqualValues(queuePolicySpill, status.Policy)
+	assert.EqualValues(2, status.Depth)
+	assert.EqualValues(2, status.Capacity)
+	assert.Len(status.Workers, 2)
+
+	// Dispatcher is notified once there's room for the spilled job.
+	done := make(chan string, 2)
+	go pool.work(pool.workers[0], func(job AnalysisJob) bool {
+		done <- job.ImageID
+		return job.ImageID == "foo"
+	})
+
+	assert.EqualValues("foo", <-done)
+	assert.EqualValues("bar", <-done)
+	<-pool.wake
+	assert.True(pool.enqueue(AnalysisJob{ImageID: "baz"}))
+	assert.EqualValues("baz", <-done)
+
+	// Stats are recorded after each job.
+	for pool.status().Workers[0].Jobs < 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	status = pool.status()
+	assert.EqualValues(0, status.Depth)
+	assert.EqualValues(3, status.Workers[0].Jobs)
+	assert.EqualValues(2, status.Workers[0].Failed)
+	assert.EqualValues(0, status.Workers[1].Jobs)
+	assert.EqualValues(0, status.Workers[1].JobsPerSecond)
+}
+
+func TestAnalysisOverload(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	service.objects.analysis = newAnalysisPool(AnalysisConfig{Workers: 1, QueueSize: 1, Policy: queuePolicyShed})
+	go service.objects.processChunks()
+
+	assert.EqualValues(http.StatusServiceUnavailable, tusErrorStatus(errServiceOverloaded))
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	upload := func() StreamStatus {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("image", "image")
+		part.Write([]byte(pngMagic + "foo"))
+		writer.Close()
+
+		_, code := service.StreamImagesToBackend(linkID, multipart.NewReader(body, writer.Boundary()))
+		return code
+	}
+
+	// Nothing is running the queued jobs, so the queue fills up with the first image.
+	assert.EqualValues(streamSuccess, upload())
+	assert.True(service.objects.analysisOverloaded())
+	assert.EqualValues(streamOverloaded, upload())
+
+	_, err := service.CreateTusUpload(linkID, 10, map[string]string{tusMetaFiletype: "image/png"})
+	assert.EqualValues(errServiceOverloaded, err)
+}
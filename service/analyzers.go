@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+var (
+	errInvalidAnalyzerName       = errors.New("Analyzer must have a name")
+	errDuplicateAnalyzer         = errors.New("Analyzer has already been registered")
+	errUnknownAnalyzerDependency = errors.New("Analyzer depends on an unknown analyzer")
+	errAnalyzerCycle             = errors.New("Analyzers have circular dependencies")
+)
+
+// Analyzer extracts additional metadata from stored images. Analyzers are run one
+// by one (after their dependencies) for each image, and the results of each analyzer
+// are stored in the image metadata under its name. Analyzers are shared by all the
+// analysis workers, so they must be safe for concurrent use.
+type Analyzer interface {
+	// Name of this analyzer, which is also the namespace of its results.
+	Name() string
+	// Dependencies (names of other analyzers) which must run before this analyzer.
+	Dependencies() []string
+	// Analyze the image with the given metadata (which has the results of earlier
+	// analyzers) and content. Returns the results, which are encoded as JSON (nil if
+	// there aren't any). Analyzers may also update the metadata itself. Errors fail
+	// this analyzer (and the ones depending on it), so that it's retried later.
+	Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error)
+}
+
+// AnalysisResults of the analyzers, keyed by their names. This is stored as JSON in
+// the database.
+type AnalysisResults map[string]json.RawMessage
+
+// Value for storing these results in the database.
+func (r AnalysisResults) Value() (driver.Value, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(r)
+}
+
+// Scan the results from the given database value.
+func (r *AnalysisResults) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*r = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, r)
+	case string:
+		return json.Unmarshal([]byte(data), r)
+	}
+
+	return fmt.Errorf("Cannot scan analysis results from %T", value)
+}
+
+// AnalyzerFailures are the errors of the analyzers which have failed, keyed by their
+// names. This is stored as JSON in the database.
+type AnalyzerFailures map[string]string
+
+// Value for storing these failures in the database.
+func (f AnalyzerFailures) Value() (driver.Value, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+
+	return json.Marshal(f)
+}
+
+// Scan the failures from the given database value.
+func (f *AnalyzerFailures) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*f = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, f)
+	case string:
+		return json.Unmarshal([]byte(data), f)
+	}
+
+	return fmt.Errorf("Cannot scan analyzer failures from %T", value)
+}
+
+// err for these failures (ordered by the names of the analyzers), or nil if there
+// aren't any.
+func (f AnalyzerFailures) err() error {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	sort.Strings(names)
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = fmt.Sprintf("Analyzer %s failed: %s", name, f[name])
+	}
+
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// builtinAnalyzers which are registered for all the images.
+func builtinAnalyzers() []Analyzer {
+	return []Analyzer{exifAnalyzer{}, dimensionsAnalyzer{}}
+}
+
+// orderAnalyzers so that each analyzer comes after its dependencies. Analyzers are
+// otherwise kept in the given order.
+func orderAnalyzers(analyzers []Analyzer) ([]Analyzer, error) {
+	remaining := make(map[string]Analyzer)
+	for _, analyzer := range analyzers {
+		name := analyzer.Name()
+		if name == "" {
+			return nil, errInvalidAnalyzerName
+		} else if _, exists := remaining[name]; exists {
+			return nil, errDuplicateAnalyzer
+		}
+
+		remaining[name] = analyzer
+	}
+
+	for _, analyzer := range analyzers {
+		for _, dep := range analyzer.Dependencies() {
+			if _, exists := remaining[dep]; !exists {
+				return nil, errUnknownAnalyzerDependency
+			}
+		}
+	}
+
+	ordered := make([]Analyzer, 0, len(analyzers))
+	for len(remaining) > 0 {
+		progress := false
+		for _, analyzer := range analyzers {
+			if _, exists := remaining[analyzer.Name()]; !exists {
+				continue
+			}
+
+			ready := true
+			for _, dep := range analyzer.Dependencies() {
+				if _, exists := remaining[dep]; exists {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				ordered = append(ordered, analyzer)
+				delete(remaining, analyzer.Name())
+				progress = true
+			}
+		}
+
+		if !progress {
+			return nil, errAnalyzerCycle
+		}
+	}
+
+	return ordered, nil
+}
+
+// registerAnalyzers for analyzing stored images (along with the ones which have already
+// been registered). Analyzers must be registered before processing the images.
+func (r *ObjectsRepository) registerAnalyzers(analyzers ...Analyzer) error {
+	ordered, err := orderAnalyzers(append(append([]Analyzer{}, r.analyzers...), analyzers...))
+	if err != nil {
+		return err
+	}
+
+	r.analyzers = ordered
+	return nil
+}
+
+// readImage with the given hash into memory, so that it can be shared by all the analyzers.
+func (r *ObjectsRepository) readImage(hash string) (*bytes.Reader, error) {
+	reader, err := r.objectStore.getImageReader(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := r.objectStore.cleanupImageReader(hash, reader)
+		if err != nil {
+			log.Printf("Error cleaning up reader (hash: %s): %s\n", hash, err.Error())
+		}
+	}()
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
+
+// runAnalyzers on the image in the given metadata (and content), and store their results.
+// If some analyzers have failed earlier, then only those (and the ones depending on them)
+// are run. Analyzers which fail don't stop the others (except the ones depending on them),
+// and their earlier results are kept. Returns the failures of this run.
+func (r *ObjectsRepository) runAnalyzers(meta *ImageMeta, content io.ReadSeeker, failed AnalyzerFailures) (AnalyzerFailures, error) {
+	results := AnalysisResults{}
+	for name, result := range meta.Analysis {
+		results[name] = result
+	}
+
+	meta.Analysis = results
+	failures, ran := AnalyzerFailures{}, make(map[string]bool)
+	for _, analyzer := range r.analyzers {
+		name := analyzer.Name()
+		_, run := failed[name]
+		run = run || len(failed) == 0
+		for _, dep := range analyzer.Dependencies() {
+			if _, exists := failures[dep]; exists {
+				failures[name] = fmt.Sprintf("Depends on failed analyzer %s", dep)
+			}
+
+			run = run || ran[dep]
+		}
+
+		if _, exists := failures[name]; exists || !run {
+			continue
+		}
+
+		_, err := content.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+
+		ran[name] = true
+		var data []byte
+		result, err := analyzer.Analyze(meta, content)
+		if err == nil && result != nil {
+			data, err = json.Marshal(result)
+		}
+
+		if err != nil {
+			failures[name] = err.Error()
+			continue
+		}
+
+		delete(results, name)
+		if data != nil {
+			results[name] = data
+		}
+	}
+
+	return failures, nil
+}
+
+// MARK: Built-in analyzers.
+
+// exifAnalyzer extracts the camera, time and location from the EXIF data of images.
+// Camera model and location are also set in the metadata itself (for stats), and the
+// camera model is unknown unless it's in the EXIF data. Other analyzers leave them as
+// they are, so retrying those doesn't lose them.
+type exifAnalyzer struct{}
+
+// exifResult of analyzing an image.
+type exifResult struct {
+	CameraMake  string  `json:"cameraMake,omitempty"`
+	CameraModel string  `json:"cameraModel,omitempty"`
+	Taken       string  `json:"takenOn,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+}
+
+func (a exifAnalyzer) Name() string {
+	return "exif"
+}
+
+func (a exifAnalyzer) Dependencies() []string {
+	return nil
+}
+
+func (a exifAnalyzer) Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error) {
+	meta.CameraModel = unknownCameraModel
+	x, err := exif.Decode(content)
+	if err != nil {
+		// Images without EXIF data are fine.
+		log.Printf("Cannot decode exif data from image (ID: %s): %s\n", meta.ID, err.Error())
+		return nil, nil
+	}
+
+	var result exifResult
+	if value, err := x.Get(exif.Make); err == nil {
+		result.CameraMake, _ = value.StringVal()
+	}
+
+	if value, err := x.Get(exif.Model); err == nil {
+		meta.CameraModel = value.String()
+		result.CameraModel, _ = value.StringVal()
+	}
+
+	if taken, err := x.DateTime(); err == nil {
+		result.Taken = taken.Format("2006-01-02T15:04:05")
+	}
+
+	if lat, long, err := x.LatLong(); err == nil {
+		meta.Latitude, meta.Longitude = lat, long
+		result.Latitude, result.Longitude = lat, long
+	}
+
+	return result, nil
+}
+
+// dimensionsAnalyzer finds the format and dimensions of images (without decoding them).
+type dimensionsAnalyzer struct{}
+
+// dimensionsResult of analyzing an image.
+type dimensionsResult struct {
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+func (a dimensionsAnalyzer) Name() string {
+	return "dimensions"
+}
+
+func (a dimensionsAnalyzer) Dependencies() []string {
+	return nil
+}
+
+func (a dimensionsAnalyzer) Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error) {
+	config, format, err := image.DecodeConfig(content)
+	if err != nil {
+		// We can't decode some formats (say, HEIC), but they're still images.
+		return nil, nil
+	}
+
+	return dimensionsResult{
+		Format: format,
+		Width:  config.Width,
+		Height: config.Height,
+	}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAnalyzer reports the size of the content, along with its dependencies.
+type fakeAnalyzer struct {
+	name string
+	deps []string
+	err  error
+}
+
+func (a fakeAnalyzer) Name() string {
+	return a.name
+}
+
+func (a fakeAnalyzer) Dependencies() []string {
+	return a.deps
+}
+
+func (a fakeAnalyzer) Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	data, err := ioutil.ReadAll(content)
+	result := map[string]interface{}{"size": len(data)}
+	for _, dep := range a.deps {
+		result[dep] = meta.Analysis[dep] != nil
+	}
+
+	return result, err
+}
+
+// countingStore is a file store which counts the readers for images.
+type countingStore struct {
+	*FileStore
+	lock    sync.Mutex
+	readers int
+	// Number of readers which are open right now, and the maximum so far.
+	active, maxActive int
+}
+
+func (store *countingStore) getImageReader(hash string) (io.Reader, error) {
+	store.lock.Lock()
+	store.readers++
+	if store.active++; store.active > store.maxActive {
+		store.maxActive = store.active
+	}
+	store.lock.Unlock()
+	return store.FileStore.getImageReader(hash)
+}
+
+func (store *countingStore) cleanupImageReader(hash string, reader io.Reader) error {
+	store.lock.Lock()
+	store.active--
+	store.lock.Unlock()
+	return store.FileStore.cleanupImageReader(hash, reader)
+}
+
+func TestAnalyzerOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	ordered, err := orderAnalyzers([]Analyzer{
+		fakeAnalyzer{name: "c", deps: []string{"b", "a"}},
+		fakeAnalyzer{name: "a"},
+		fakeAnalyzer{name: "b", deps: []string{"a"}},
+		fakeAnalyzer{name: "d"},
+	})
+	assert.Nil(err)
+	names := []string{}
+	for _, analyzer := range ordered {
+		names = append(names, analyzer.Name())
+	}
+	assert.EqualValues([]string{"a", "b", "d", "c"}, names)
+
+	_, err = orderAnalyzers([]Analyzer{fakeAnalyzer{name: "a", deps: []string{"b"}}, fakeAnalyzer{name: "b", deps: []string{"a"}}})
+	assert.EqualValues(errAnalyzerCycle, err)
+	_, err = orderAnalyzers([]Analyzer{fakeAnalyzer{name: "a", deps: []string{"booya"}}})
+	assert.EqualValues(errUnknownAnalyzerDependency, err)
+	_, err = orderAnalyzers([]Analyzer{fakeAnalyzer{name: "a"}, fakeAnalyzer{name: "a"}})
+	assert.EqualValues(errDuplicateAnalyzer, err)
+	_, err = orderAnalyzers([]Analyzer{fakeAnalyzer{}})
+	assert.EqualValues(errInvalidAnalyzerName, err)
+
+	// Failed registrations don't change the analyzers.
+	repo := &ObjectsRepository{}
+	assert.Nil(repo.registerAnalyzers(builtinAnalyzers()...))
+	assert.EqualValues(errDuplicateAnalyzer, repo.registerAnalyzers(exifAnalyzer{}))
+	assert.Nil(repo.registerAnalyzers(fakeAnalyzer{name: "foo", deps: []string{"bar"}}, fakeAnalyzer{name: "bar", deps: []string{"exif"}}))
+	assert.Len(repo.analyzers, 4)
+	assert.EqualValues("bar", repo.analyzers[2].Name())
+}
+
+func TestAnalyzers(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	assert.Nil(service.objects.registerAnalyzers(fakeAnalyzer{name: "size", deps: []string{"dimensions"}}))
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2)))
+	hash := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+	writeObject(service, hash, buf.Bytes())
+	store := &countingStore{FileStore: service.objects.objectStore.(*FileStore)}
+	service.objects.objectStore = store
+	service.data.addImageData(ImageMeta{ID: "foo", Hash: hash, MediaType: "image/png", Analysis: AnalysisResults{"old": []byte("{}")}})
+
+	// Image is read only once for all the analyzers.
+	failures, err := service.objects.analyzeImage("foo", nil)
+	assert.Nil(err)
+	assert.Empty(failures)
+	assert.EqualValues(1, store.readers)
+	meta, err := service.data.fetchImageMeta("foo")
+	assert.Nil(err)
+	assert.EqualValues("unknown", meta.CameraModel)
+	assert.JSONEq(`{"format": "png", "width": 3, "height": 2}`, string(meta.Analysis["dimensions"]))
+	assert.JSONEq(fmt.Sprintf(`{"size": %d, "dimensions": true}`, buf.Len()), string(meta.Analysis["size"]))
+	assert.Nil(meta.Analysis["exif"])
+	assert.NotNil(meta.Analysis["old"])
+
+	// Results are nested in the metadata.
+	data, _ := json.Marshal(meta)
+	var decoded map[string]interface{}
+	json.Unmarshal(data, &decoded)
+	assert.EqualValues(3, decoded["analysis"].(map[string]interface{})["dimensions"].(map[string]interface{})["width"])
+
+	// Failing analyzers don't fail the others (except the ones depending on them).
+	service.objects.analyzers = append(service.objects.analyzers,
+		fakeAnalyzer{name: "broken", err: errors.New("booya")}, fakeAnalyzer{name: "after", deps: []string{"broken"}})
+	service.data.updateImageData(ImageMeta{ID: "foo", Hash: hash, MediaType: "image/png"})
+	failures, err = service.objects.analyzeImage("foo", nil)
+	assert.Nil(err)
+	assert.EqualValues(AnalyzerFailures{"broken": "booya", "after": "Depends on failed analyzer broken"}, failures)
+	assert.EqualValues("Analyzer after failed: Depends on failed analyzer broken; Analyzer broken failed: booya", failures.err().Error())
+	meta, _ = service.data.fetchImageMeta("foo")
+	assert.NotNil(meta.Analysis["dimensions"])
+	assert.NotNil(meta.Analysis["size"])
+	assert.Nil(meta.Analysis["after"])
+
+	// Only the failed analyzers (and the ones depending on them) are run again, and
+	// the metadata from the others (say, the camera model from EXIF) is kept.
+	service.objects.analyzers[len(service.objects.analyzers)-2] = fakeAnalyzer{name: "broken"}
+	service.data.updateImageData(ImageMeta{ID: "foo", Hash: hash, MediaType: "image/png", CameraModel: "booya",
+		Analysis: AnalysisResults{"size": []byte("{}")}})
+	failures, err = service.objects.analyzeImage("foo", failures)
+	assert.Nil(err)
+	assert.Empty(failures)
+	meta, _ = service.data.fetchImageMeta("foo")
+	assert.EqualValues("booya", meta.CameraModel)
+	assert.JSONEq("{}", string(meta.Analysis["size"]))
+	assert.Nil(meta.Analysis["dimensions"])
+	assert.JSONEq(fmt.Sprintf(`{"size": %d, "broken": true}`, buf.Len()), string(meta.Analysis["after"]))
+
+	_, err = service.objects.analyzeImage("bar", nil)
+	assert.EqualValues(errMissingImage, err)
+
+	// Jobs keep the failures, so that only those analyzers are retried.
+	service.objects.analyzers[len(service.objects.analyzers)-2] = fakeAnalyzer{name: "broken", err: errors.New("booya")}
+	service.data.updateImageData(ImageMeta{ID: "foo", Hash: hash, MediaType: "image/png"})
+	service.objects.queueImageForAnalysis(ImageMeta{ID: "foo"})
+	job, _ := service.GetAnalysisJob("foo")
+	assert.False(service.objects.runAnalysisJob(*job))
+	job, _ = service.GetAnalysisJob("foo")
+	assert.EqualValues(jobPending, job.State)
+	assert.EqualValues(AnalyzerFailures{"broken": "booya", "after": "Depends on failed analyzer broken"}, job.Failures)
+	assert.EqualValues("Analyzer after failed: Depends on failed analyzer broken; Analyzer broken failed: booya", job.LastError)
+	meta, _ = service.data.fetchImageMeta("foo")
+	assert.NotNil(meta.Analysis["dimensions"])
+}
+
+func TestAnalysisResults(t *testing.T) {
+	assert := assert.New(t)
+
+	value, err := AnalysisResults{}.Value()
+	assert.Nil(err)
+	assert.Nil(value)
+	value, err = AnalysisResults{"foo": []byte(`{"bar":1}`)}.Value()
+	assert.Nil(err)
+	assert.EqualValues(`{"foo":{"bar":1}}`, string(value.([]byte)))
+
+	var results AnalysisResults
+	assert.Nil(results.Scan(`{"foo":{"bar":1}}`))
+	assert.EqualValues(`{"bar":1}`, string(results["foo"]))
+	assert.Nil(results.Scan(nil))
+	assert.Nil(results)
+	assert.NotNil(results.Scan(42))
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidBackfillTime = errors.New("Invalid upload time range for backfill")
+	errInvalidMissingField = errors.New("Missing field must be either 'cameraModel' or 'location'")
+	errInvalidBackfillRate = fmt.Errorf("Backfill rate must be between 0 and %d images per second", maxBackfillRate)
+	errInvalidBackfillArgs = errors.New("Usage: backfill [flags] (see 'backfill -h')")
+)
+
+// MARK: Service layer.
+
+// StartBackfill for reanalyzing the stored images which match the given request. The
+// backfill runs in the background, and its progress can be checked using `GetBackfill`.
+func (service *ImageService) StartBackfill(req BackfillRequest) (*Backfill, error) {
+	now := time.Now().UTC()
+	backfill := Backfill{
+		ID:        randomAlphanumeric(backfillIDLength),
+		MediaType: normalizeMediaType(req.MediaType),
+		Missing:   req.Missing,
+		Rate:      req.Rate,
+		DryRun:    req.DryRun,
+		State:     backfillRunning,
+		Created:   now,
+		Updated:   now,
+	}
+
+	var err error
+	if req.UploadedAfter != "" {
+		backfill.UploadedAfter, err = time.Parse(time.RFC3339, req.UploadedAfter)
+	}
+
+	if req.UploadedBefore != "" && err == nil {
+		backfill.UploadedBefore, err = time.Parse(time.RFC3339, req.UploadedBefore)
+	}
+
+	if err != nil || (!backfill.UploadedAfter.IsZero() && !backfill.UploadedBefore.IsZero() &&
+		!backfill.UploadedAfter.Before(backfill.UploadedBefore)) {
+		return nil, errInvalidBackfillTime
+	}
+
+	if req.Missing != "" && req.Missing != fieldCameraModel && req.Missing != fieldLocation {
+		return nil, errInvalidMissingField
+	}
+
+	if !isValidBackfillRate(req.Rate) {
+		return nil, errInvalidBackfillRate
+	} else if req.Rate == 0 {
+		backfill.Rate = defaultBackfillRate
+	}
+
+	err = service.data.saveBackfill(backfill)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	go service.objects.runBackfill(backfill)
+	return &backfill, nil
+}
+
+// isValidBackfillRate checks that the given rate is a finite number within the limits
+// (zero is for the default rate).
+func isValidBackfillRate(rate float64) bool {
+	return rate >= 0 && rate <= maxBackfillRate
+}
+
+// GetBackfill with the given ID (nil if it doesn't exist).
+func (service *ImageService) GetBackfill(id string) (*Backfill, error) {
+	backfill, err := service.data.fetchBackfill(id)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	return backfill, nil
+}
+
+// ListBackfills ordered by their creation time.
+func (service *ImageService) ListBackfills() ([]Backfill, error) {
+	backfills, err := service.data.listBackfills()
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	return backfills, nil
+}
+
+// MARK: Processing layer.
+
+// resumeBackfills which were running when the service went down. If the store is
+// down, then we keep trying until it's back.
+func (r *ObjectsRepository) resumeBackfills() {
+	backfills, err := r.data.listBackfills()
+	for err != nil {
+		time.Sleep(analysisPollInterval)
+		backfills, err = r.data.listBackfills()
+	}
+
+	for _, backfill := range backfills {
+		if backfill.State == backfillRunning {
+			log.Printf("Resuming backfill (ID: %s) after image ID: %s\n", backfill.ID, backfill.LastImageID)
+			go r.runBackfill(backfill)
+		}
+	}
+}
+
+// runBackfill from where it left off. Images are scanned in batches, and the progress
+// is persisted after each batch. Matching images are queued for analysis (unless this
+// is a dry run), but no faster than the rate of the backfill.
+//
+// **NOTE:** This is blocking and hence, it must be spawn into a separate goroutine.
+func (r *ObjectsRepository) runBackfill(backfill Backfill) {
+	// Backfills from earlier versions may have any rate, so it's checked again.
+	rate := backfill.Rate
+	if rate > maxBackfillRate {
+		rate = maxBackfillRate
+	} else if !(rate > 0) {
+		rate = defaultBackfillRate
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for backfill.State == backfillRunning {
+		metas, err := r.data.listImages(backfill.LastImageID, backfillBatchSize)
+		if err != nil {
+			// Store has failed, so we try again later.
+			time.Sleep(analysisPollInterval)
+			continue
+		}
+
+		for _, meta := range metas {
+			backfill.Scanned++
+			backfill.LastImageID = meta.ID
+			if !backfill.matches(meta) {
+				continue
+			}
+
+			backfill.Matched++
+			if backfill.DryRun || r.analysisPending(meta.ID) {
+				continue
+			}
+
+			<-ticker.C
+			err = r.queueImageForAnalysis(meta)
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			// Store has failed, so we rescan this batch later (images which have
+			// already been queued are skipped).
+			time.Sleep(analysisPollInterval)
+			continue
+		}
+
+		if len(metas) < backfillBatchSize {
+			backfill.State = backfillDone
+		}
+
+		backfill.Updated = time.Now().UTC()
+		err = r.data.saveBackfill(backfill)
+		if err != nil {
+			// It'll be rescanned from the last saved image on restart.
+			log.Printf("Error saving progress of backfill (ID: %s): %s\n", backfill.ID, err.Error())
+		}
+	}
+
+	log.Printf("Finished backfill (ID: %s, scanned: %d, matched: %d)\n", backfill.ID, backfill.Scanned, backfill.Matched)
+}
+
+// analysisPending checks whether the image with the given ID is already waiting for
+// (or going through) analysis, so that it doesn't need to be queued again.
+func (r *ObjectsRepository) analysisPending(imageID string) bool {
+	job, _ := r.data.fetchAnalysisJob(imageID)
+	return job != nil && (job.State == jobPending || job.State == jobRunning)
+}
+
+// MARK: Command-line interface.
+
+// runBackfillCommand starts a backfill in the running service (at the given URL, by
+// default) with the filter in the given arguments, and reports its progress until
+// it's done. The backfill keeps running in the service even if this is interrupted.
+func runBackfillCommand(args []string, serviceURL, token string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	urlPtr := flags.String("url", serviceURL, "URL of the running service")
+	afterPtr := flags.String("uploaded-after", "", "Only images uploaded after this timestamp (RFC 3339)")
+	beforePtr := flags.String("uploaded-before", "", "Only images uploaded before this timestamp (RFC 3339)")
+	mediaTypePtr := flags.String("media-type", "", "Only images of this media type (say, image/jpeg)")
+	missingPtr := flags.String("missing", "", "Only images missing this field (cameraModel or location)")
+	ratePtr := flags.Float64("rate", defaultBackfillRate, "Maximum number of images queued for analysis per second")
+	dryRunPtr := flags.Bool("dry-run", false, "Only count the matching images, without reanalyzing them")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	} else if flags.NArg() > 0 {
+		return errInvalidBackfillArgs
+	} else if !isValidBackfillRate(*ratePtr) {
+		return errInvalidBackfillRate
+	}
+
+	var backfill Backfill
+	endpoint := strings.TrimSuffix(*urlPtr, "/") + "/admin/backfills"
+	err = requestAdminJSON(http.MethodPost, endpoint, token, BackfillRequest{
+		UploadedAfter:  *afterPtr,
+		UploadedBefore: *beforePtr,
+		MediaType:      *mediaTypePtr,
+		Missing:        *missingPtr,
+		Rate:           *ratePtr,
+		DryRun:         *dryRunPtr,
+	}, &backfill)
+
+	for err == nil {
+		log.Printf("Backfill %s is %s (scanned: %d, matched: %d)\n", backfill.ID, backfill.State, backfill.Scanned, backfill.Matched)
+		if backfill.State != backfillRunning {
+			break
+		}
+
+		time.Sleep(backfillPollInterval)
+		err = requestAdminJSON(http.MethodGet, endpoint+"/"+backfill.ID, token, nil, &backfill)
+	}
+
+	return err
+}
+
+// requestAdminJSON sends the given value (if any) to some admin endpoint of the service
+// using the given access token, and decodes the response into the given value.
+func requestAdminJSON(method, url, token string, body, value interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set(headerAccessToken, token)
+	req.Header.Set(headerContentType, "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var errResp ErrorResponse
+		if json.Unmarshal(data, &errResp) != nil || errResp.Error == "" {
+			return fmt.Errorf("Request failed with status %d", resp.StatusCode)
+		}
+
+		return errors.New(errResp.Error)
+	}
+
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillFilter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now().UTC()
+
+	backfill := Backfill{UploadedAfter: now.Add(-time.Hour), UploadedBefore: now, MediaType: "image/png"}
+	assert.True(backfill.matches(ImageMeta{MediaType: "image/png", Uploaded: now.Add(-time.Minute)}))
+	assert.False(backfill.matches(ImageMeta{MediaType: "image/jpeg", Uploaded: now.Add(-time.Minute)}))
+	assert.False(backfill.matches(ImageMeta{MediaType: "image/png", Uploaded: now.Add(-2 * time.Hour)}))
+	assert.False(backfill.matches(ImageMeta{MediaType: "image/png", Uploaded: now}))
+
+	backfill = Backfill{Missing: fieldCameraModel}
+	assert.True(backfill.matches(ImageMeta{}))
+	assert.True(backfill.matches(ImageMeta{CameraModel: "unknown"}))
+	assert.False(backfill.matches(ImageMeta{CameraModel: "booya"}))
+
+	backfill = Backfill{Missing: fieldLocation}
+	assert.True(backfill.matches(ImageMeta{CameraModel: "booya"}))
+	assert.False(backfill.matches(ImageMeta{Latitude: 12.5}))
+}
+
+func TestBackfill(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	now := time.Now().UTC()
+
+	_, err := service.StartBackfill(BackfillRequest{UploadedAfter: "yesterday"})
+	assert.EqualValues(errInvalidBackfillTime, err)
+	_, err = service.StartBackfill(BackfillRequest{
+		UploadedAfter:  now.Format(time.RFC3339),
+		UploadedBefore: now.Add(-time.Hour).Format(time.RFC3339),
+	})
+	assert.EqualValues(errInvalidBackfillTime, err)
+	_, err = service.StartBackfill(BackfillRequest{Missing: "hash"})
+	assert.EqualValues(errInvalidMissingField, err)
+	for _, rate := range []float64{-1, math.NaN(), math.Inf(1), 1e300, maxBackfillRate + 1} {
+		_, err = service.StartBackfill(BackfillRequest{Rate: rate})
+		assert.EqualValues(errInvalidBackfillRate, err)
+	}
+
+	for i, id := range []string{"a", "b", "c", "d"} {
+		meta := ImageMeta{ID: id, Hash: id, MediaType: "image/png", Uploaded: now.Add(-time.Duration(i) * time.Hour)}
+		if i%2 == 1 {
+			meta.CameraModel = "booya"
+		}
+
+		service.data.addImageData(meta)
+	}
+
+	service.data.addImageData(ImageMeta{ID: "e", Hash: "e", MediaType: "image/jpeg", Uploaded: now})
+	service.objects.queueImageForAnalysis(ImageMeta{ID: "c"})
+
+	// Dry runs only count the matching images.
+	backfill, err := service.StartBackfill(BackfillRequest{MediaType: "Image/PNG", Missing: fieldCameraModel, DryRun: true})
+	assert.Nil(err)
+	assert.EqualValues("image/png", backfill.MediaType)
+	assert.EqualValues(defaultBackfillRate, backfill.Rate)
+	backfill = waitForBackfill(service, backfill.ID)
+	assert.EqualValues(backfillDone, backfill.State)
+	assert.EqualValues(5, backfill.Scanned)
+	assert.EqualValues(2, backfill.Matched)
+	assert.EqualValues("e", backfill.LastImageID)
+	job, err := service.GetAnalysisJob("a")
+	assert.Nil(err)
+	assert.Nil(job)
+
+	// Images which are already waiting for analysis aren't queued again.
+	backfill, err = service.StartBackfill(BackfillRequest{
+		UploadedAfter: now.Add(-150 * time.Minute).Format(time.RFC3339),
+		Missing:       fieldLocation,
+		Rate:          1000,
+	})
+	assert.Nil(err)
+	backfill = waitForBackfill(service, backfill.ID)
+	assert.EqualValues(4, backfill.Matched)
+	for _, id := range []string{"a", "b", "e"} {
+		job, _ = service.GetAnalysisJob(id)
+		assert.EqualValues(jobPending, job.State)
+	}
+	job, _ = service.GetAnalysisJob("d")
+	assert.Nil(job)
+	status, err := service.GetAnalysisStatus()
+	assert.Nil(err)
+	assert.EqualValues(4, status.Pending)
+
+	// Backfills which were running are resumed after the last scanned image.
+	service.data.saveBackfill(Backfill{ID: "foo", State: backfillRunning, Rate: 1000, LastImageID: "c", Scanned: 3})
+	service.objects.resumeBackfills()
+	backfill = waitForBackfill(service, "foo")
+	assert.EqualValues(5, backfill.Scanned)
+	assert.EqualValues(2, backfill.Matched)
+	backfills, err := service.ListBackfills()
+	assert.Nil(err)
+	assert.Len(backfills, 3)
+	backfill, err = service.GetBackfill("booya")
+	assert.Nil(err)
+	assert.Nil(backfill)
+}
+
+func TestBackfillCommand(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	service.data.addImageData(ImageMeta{ID: "foo", Hash: "foo", MediaType: "image/png"})
+
+	r := mux.NewRouter()
+	amw := AuthMiddleware{accessToken: service.accessToken}
+	r.Use(amw.Middleware)
+	r.HandleFunc("/admin/backfills", service.handleBackfillCreation).Methods("POST")
+	r.HandleFunc("/admin/backfills/{id}", service.fetchBackfill).Methods("GET")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	assert.Nil(runBackfillCommand([]string{"-dry-run", "-missing", "cameraModel"}, server.URL, service.accessToken))
+	backfills, err := service.ListBackfills()
+	assert.Nil(err)
+	assert.Len(backfills, 1)
+	assert.True(backfills[0].DryRun)
+	assert.EqualValues(1, backfills[0].Matched)
+
+	err = runBackfillCommand([]string{"-missing", "hash"}, server.URL, service.accessToken)
+	assert.EqualValues(errInvalidMissingField.Error(), err.Error())
+	err = runBackfillCommand(nil, server.URL, "booya")
+	assert.EqualValues("You're not allowed to perform that action.", err.Error())
+	assert.EqualValues(errInvalidBackfillArgs, runBackfillCommand([]string{"foo"}, server.URL, service.accessToken))
+	for _, rate := range []string{"NaN", "+Inf", "1e300"} {
+		assert.EqualValues(errInvalidBackfillRate, runBackfillCommand([]string{"-rate", rate}, server.URL, service.accessToken))
+	}
+
+	// Huge rates are rejected by the service too.
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/admin/backfills", strings.NewReader(`{"rate": 1e300}`))
+	req.Header.Set(headerAccessToken, service.accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.EqualValues(http.StatusBadRequest, resp.StatusCode)
+
+	// Backfills which were saved with such rates (by earlier versions) still run.
+	backfill := Backfill{ID: "huge", Rate: 1e300, DryRun: true, State: backfillRunning}
+	service.data.saveBackfill(backfill)
+	service.objects.runBackfill(backfill)
+	assert.EqualValues(backfillDone, waitForBackfill(service, "huge").State)
+}
+
+// waitForBackfill with the given ID to finish.
+func waitForBackfill(service *ImageService, id string) *Backfill {
+	backfill, _ := service.GetBackfill(id)
+	for i := 0; i < 500 && (backfill == nil || backfill.State == backfillRunning); i++ {
+		time.Sleep(10 * time.Millisecond)
+		backfill, _ = service.GetBackfill(id)
+	}
+
+	return backfill
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltLinksBucket     = []byte("links")
+	boltUploadsBucket   = []byte("uploads")
+	boltImagesBucket    = []byte("images")
+	boltHashesBucket    = []byte("hashes")
+	boltJobsBucket      = []byte("jobs")
+	boltJobQueueBucket  = []byte("job_queue")
+	boltBackfillsBucket = []byte("backfills")
+	boltVariantsBucket  = []byte("variants")
+)
+
+// BoltStore keeps everything in an embedded single-file database (using bbolt),
+// for deployments which can't run a database server. The file can only be opened
+// by one process at a time.
+//
+// Links, image metadata, backfills and variants are keyed by their ID, hashes map to
+// image IDs, analysis jobs are keyed by their image ID (and indexed by their state and
+// next attempt, see `jobQueueKey`), and the uploads for each link are kept in their own
+// (nested) bucket, keyed by the upload ID. Values are encoded using `gob`.
+type BoltStore struct {
+	path string
+	db   *bolt.DB
+}
+
+// NewBoltStore for the database file in the given path. The file is created
+// (if needed) when the store is initialized.
+func NewBoltStore(path string) *BoltStore {
+	return &BoltStore{
+		path: path,
+	}
+}
+
+// MARK: `DataStore` interface methods.
+
+func (s *BoltStore) initialize() error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		// Files from earlier versions don't have the job index yet.
+		indexJobs := tx.Bucket(boltJobQueueBucket) == nil
+		for _, name := range [][]byte{boltLinksBucket, boltUploadsBucket, boltImagesBucket, boltHashesBucket, boltJobsBucket, boltJobQueueBucket, boltBackfillsBucket, boltVariantsBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !indexJobs {
+			return nil
+		}
+
+		queue := tx.Bucket(boltJobQueueBucket)
+		return tx.Bucket(boltJobsBucket).ForEach(func(_, value []byte) error {
+			var job AnalysisJob
+			err := boltDecode(value, &job)
+			if err == nil {
+				err = queue.Put(jobQueueKey(job), nil)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	return nil
+}
+
+func (s *BoltStore) addUploadID(id string, expiry time.Time, policy LinkPolicy) error {
+	return s.updateUploadLink(UploadLink{
+		ID:     id,
+		Expiry: expiry,
+		Policy: policy,
+	})
+}
+
+func (s *BoltStore) getUploadLink(id string) (*UploadLink, error) {
+	var link UploadLink
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltLinksBucket), id, &link)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+func (s *BoltStore) updateUploadLink(link UploadLink) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltLinksBucket), link.ID, link)
+	})
+}
+
+func (s *BoltStore) listUploadLinks(filter LinkFilter) (*LinkList, error) {
+	links := []UploadLink{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltLinksBucket).ForEach(func(_, value []byte) error {
+			var link UploadLink
+			err := boltDecode(value, &link)
+			if err == nil {
+				links = append(links, link)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return filterLinks(links, filter), nil
+}
+
+func (s *BoltStore) addLinkUpload(upload LinkUpload) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploads := tx.Bucket(boltUploadsBucket)
+		id, err := uploads.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		linkUploads, err := uploads.CreateBucketIfNotExists([]byte(upload.LinkID))
+		if err != nil {
+			return err
+		}
+
+		upload.ID = uint(id)
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, id)
+		return boltPut(linkUploads, string(key), upload)
+	})
+}
+
+func (s *BoltStore) fetchLinkUploads(linkID string) ([]LinkUpload, error) {
+	uploads := []LinkUpload{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		linkUploads := tx.Bucket(boltUploadsBucket).Bucket([]byte(linkID))
+		if linkUploads == nil {
+			return nil
+		}
+
+		return linkUploads.ForEach(func(_, value []byte) error {
+			var upload LinkUpload
+			err := boltDecode(value, &upload)
+			if err == nil {
+				uploads = append(uploads, upload)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return uploads[i].Uploaded.Before(uploads[j].Uploaded)
+	})
+
+	return uploads, nil
+}
+
+func (s *BoltStore) addImageMeta(meta ImageMeta) (string, error) {
+	id := meta.ID
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		images, hashes := tx.Bucket(boltImagesBucket), tx.Bucket(boltHashesBucket)
+		if existing := hashes.Get([]byte(meta.Hash)); existing != nil {
+			// Bytes are only valid within the transaction.
+			id = string(existing)
+			return nil
+		}
+
+		err := boltPut(images, meta.ID, meta)
+		if err != nil {
+			return err
+		}
+
+		return hashes.Put([]byte(meta.Hash), []byte(meta.ID))
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (s *BoltStore) fetchImageMeta(id string) (*ImageMeta, error) {
+	var meta ImageMeta
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltImagesBucket), id, &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+func (s *BoltStore) fetchMetaForHash(hash string) (*ImageMeta, error) {
+	var meta ImageMeta
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltHashesBucket).Get([]byte(hash))
+		if id == nil {
+			return errNotFound
+		}
+
+		return boltGet(tx.Bucket(boltImagesBucket), string(id), &meta)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+func (s *BoltStore) updateImageMeta(meta ImageMeta) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images, hashes := tx.Bucket(boltImagesBucket), tx.Bucket(boltHashesBucket)
+
+		var old ImageMeta
+		err := boltGet(images, meta.ID, &old)
+		if err == nil && old.Hash != meta.Hash {
+			err = hashes.Delete([]byte(old.Hash))
+		}
+
+		if err != nil && err != errNotFound {
+			return err
+		}
+
+		err = boltPut(images, meta.ID, meta)
+		if err != nil {
+			return err
+		}
+
+		return hashes.Put([]byte(meta.Hash), []byte(meta.ID))
+	})
+}
+
+func (s *BoltStore) listImageMeta(offset, limit int) ([]ImageMeta, error) {
+	metas := []ImageMeta{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Keys are sorted, so this is ordered by image ID.
+		cursor := tx.Bucket(boltImagesBucket).Cursor()
+		key, value := cursor.First()
+		for i := 0; key != nil && i < offset; i++ {
+			key, value = cursor.Next()
+		}
+
+		for ; key != nil && (limit < 0 || len(metas) < limit); key, value = cursor.Next() {
+			var meta ImageMeta
+			err := boltDecode(value, &meta)
+			if err != nil {
+				return err
+			}
+
+			metas = append(metas, meta)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+func (s *BoltStore) listImagesAfter(id string, limit int) ([]ImageMeta, error) {
+	metas := []ImageMeta{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltImagesBucket).Cursor()
+		key, value := cursor.Seek([]byte(id))
+		if key != nil && string(key) == id {
+			key, value = cursor.Next()
+		}
+
+		for ; key != nil && (limit < 0 || len(metas) < limit); key, value = cursor.Next() {
+			var meta ImageMeta
+			err := boltDecode(value, &meta)
+			if err != nil {
+				return err
+			}
+
+			metas = append(metas, meta)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+func (s *BoltStore) removeImageMeta(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(boltImagesBucket)
+
+		var meta ImageMeta
+		err := boltGet(images, id, &meta)
+		if err == errNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltHashesBucket).Delete([]byte(meta.Hash))
+		if err != nil {
+			return err
+		}
+
+		return images.Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) getServiceStats() (*ServiceStats, error) {
+	counter := newStatsCounter(time.Now())
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltImagesBucket).ForEach(func(_, value []byte) error {
+			var meta ImageMeta
+			err := boltDecode(value, &meta)
+			if err == nil {
+				counter.add(meta)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counter.stats(), nil
+}
+
+func (s *BoltStore) saveAnalysisJob(job AnalysisJob) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		jobs, queue := tx.Bucket(boltJobsBucket), tx.Bucket(boltJobQueueBucket)
+		var existing AnalysisJob
+		err := boltGet(jobs, job.ImageID, &existing)
+		if err == nil {
+			err = queue.Delete(jobQueueKey(existing))
+		}
+		if err != nil && err != errNotFound {
+			return err
+		}
+
+		err = boltPut(jobs, job.ImageID, job)
+		if err != nil {
+			return err
+		}
+
+		return queue.Put(jobQueueKey(job), nil)
+	})
+}
+
+func (s *BoltStore) fetchAnalysisJob(imageID string) (*AnalysisJob, error) {
+	var job AnalysisJob
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltJobsBucket), imageID, &job)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func (s *BoltStore) listAnalysisJobs(filter JobFilter) ([]AnalysisJob, error) {
+	states := filter.States
+	if len(states) == 0 {
+		states = []string{jobPending, jobRunning, jobDone, jobFailed}
+	}
+
+	jobs := []AnalysisJob{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// Jobs in each state are ordered by their next attempt in the index, so we only
+		// go through the ones which are due (up to the limit for each state).
+		bucket, cursor := tx.Bucket(boltJobsBucket), tx.Bucket(boltJobQueueBucket).Cursor()
+		for _, state := range states {
+			prefix, found := []byte(state+"\x00"), 0
+			for key, _ := cursor.Seek(prefix); bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+				nextAttempt, imageID := parseJobQueueKey(key[len(prefix):])
+				if (!filter.DueBy.IsZero() && nextAttempt.After(filter.DueBy)) || (filter.Limit >= 0 && found == filter.Limit) {
+					break
+				}
+
+				var job AnalysisJob
+				err := boltGet(bucket, imageID, &job)
+				if err != nil {
+					return err
+				}
+
+				jobs = append(jobs, job)
+				found++
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return filterJobs(jobs, filter), nil
+}
+
+func (s *BoltStore) countAnalysisJobs() (map[string]uint, error) {
+	counts := make(map[string]uint)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobQueueBucket).ForEach(func(key, _ []byte) error {
+			counts[string(key[:bytes.IndexByte(key, 0)])]++
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (s *BoltStore) saveBackfill(backfill Backfill) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltBackfillsBucket), backfill.ID, backfill)
+	})
+}
+
+func (s *BoltStore) fetchBackfill(id string) (*Backfill, error) {
+	var backfill Backfill
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltBackfillsBucket), id, &backfill)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &backfill, nil
+}
+
+func (s *BoltStore) listBackfills() ([]Backfill, error) {
+	backfills := []Backfill{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBackfillsBucket).ForEach(func(_, value []byte) error {
+			var backfill Backfill
+			err := boltDecode(value, &backfill)
+			if err == nil {
+				backfills = append(backfills, backfill)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortBackfills(backfills)
+	return backfills, nil
+}
+
+func (s *BoltStore) saveVariant(variant ImageVariant) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltVariantsBucket), variant.ID, variant)
+	})
+}
+
+func (s *BoltStore) removeVariant(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVariantsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) listVariants() ([]ImageVariant, error) {
+	variants := []ImageVariant{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltVariantsBucket).ForEach(func(_, value []byte) error {
+			var variant ImageVariant
+			err := boltDecode(value, &variant)
+			if err == nil {
+				variants = append(variants, variant)
+			}
+
+			return err
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sortVariants(variants)
+	return variants, nil
+}
+
+// jobQueueKey of the given job in the job index, which is its state (followed by a
+// null byte), its next attempt (seconds and nanoseconds in big endian, with the sign
+// bit of the seconds flipped, so that the keys are in chronological order) and its
+// image ID.
+func jobQueueKey(job AnalysisJob) []byte {
+	key := make([]byte, len(job.State)+13, len(job.State)+13+len(job.ImageID))
+	copy(key, job.State)
+	binary.BigEndian.PutUint64(key[len(job.State)+1:], uint64(job.NextAttempt.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[len(job.State)+9:], uint32(job.NextAttempt.Nanosecond()))
+	return append(key, job.ImageID...)
+}
+
+// parseJobQueueKey for the next attempt and the image ID (the given key must not
+// have the state).
+func parseJobQueueKey(key []byte) (time.Time, string) {
+	seconds := int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+	nanos := int64(binary.BigEndian.Uint32(key[8:]))
+	return time.Unix(seconds, nanos).UTC(), string(key[12:])
+}
+
+// boltGet the value for the given key in the given bucket and decode it.
+func boltGet(bucket *bolt.Bucket, key string, value interface{}) error {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return errNotFound
+	}
+
+	return boltDecode(data, value)
+}
+
+// boltPut the given value (after encoding it) for the given key in the given bucket.
+func boltPut(bucket *bolt.Bucket, key string, value interface{}) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put([]byte(key), buf.Bytes())
+}
+
+// boltDecode the given data into the given value. The data is only valid within
+// its transaction, but decoding copies everything into the value.
+func boltDecode(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
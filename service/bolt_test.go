@@ -0,0 +1,213 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestDataStoreURL(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := newDataStore("bolt:///var/lib/hasty/data.db", DBPoolConfig{})
+	assert.Nil(err)
+	assert.EqualValues("/var/lib/hasty/data.db", store.(*BoltStore).path)
+	store, _ = newDataStore("bolt://data.db", DBPoolConfig{})
+	assert.EqualValues("data.db", store.(*BoltStore).path)
+	store, _ = newDataStore("postgres://root@localhost:26257/hasty", DBPoolConfig{})
+	assert.EqualValues("postgres://root@localhost:26257/hasty", store.(*PostgreSQLStore).url)
+	store, _ = newDataStore("memory://", DBPoolConfig{})
+	assert.IsType(&MemoryStore{}, store)
+
+	_, err = newDataStore("bolt://", DBPoolConfig{})
+	assert.EqualValues(errInvalidDataStore, err)
+	_, err = newDataStore("mysql://localhost", DBPoolConfig{})
+	assert.EqualValues(errInvalidDataStore, err)
+}
+
+func TestBoltStore(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "data.db")
+	store := NewBoltStore(path)
+	assert.Nil(store.initialize())
+
+	now := time.Now().UTC()
+	assert.Nil(store.addUploadID("foo", now.Add(time.Hour), LinkPolicy{MaxImages: 5}))
+	assert.Nil(store.addUploadID("bar", now.Add(2*time.Hour), LinkPolicy{}))
+	assert.Nil(store.addUploadID("baz", now.Add(-time.Hour), LinkPolicy{}))
+	link, err := store.getUploadLink("foo")
+	assert.Nil(err)
+	assert.EqualValues(5, link.Policy.MaxImages)
+	_, err = store.getUploadLink("booya")
+	assert.EqualValues(errNotFound, err)
+
+	link.Used = true
+	assert.Nil(store.updateUploadLink(*link))
+	list, err := store.listUploadLinks(LinkFilter{Limit: 2, Now: now})
+	assert.Nil(err)
+	assert.EqualValues(3, list.Total)
+	assert.EqualValues("bar", list.Links[0].ID)
+	assert.EqualValues("foo", list.Links[1].ID)
+	list, _ = store.listUploadLinks(LinkFilter{Status: linkStatusExpired, Limit: 10, Now: now})
+	assert.EqualValues(2, list.Total)
+
+	for i, hash := range []string{"abc", "def", "abc"} {
+		assert.Nil(store.addLinkUpload(LinkUpload{
+			LinkID:    "foo",
+			ImageID:   hash,
+			Hash:      hash,
+			Duplicate: i == 2,
+			Uploaded:  now.Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	for _, meta := range []ImageMeta{
+		{ID: "abc", Hash: "abc", MediaType: "image/png", Uploaded: now},
+		{ID: "def", Hash: "def", MediaType: "image/jpeg", Uploaded: now},
+		{ID: "old", Hash: "123", MediaType: "image/png", Uploaded: now.Add(-40 * 24 * time.Hour)},
+	} {
+		id, err := store.addImageMeta(meta)
+		assert.Nil(err)
+		assert.EqualValues(meta.ID, id)
+	}
+
+	// Duplicates are left alone.
+	id, err := store.addImageMeta(ImageMeta{ID: "dup", Hash: "abc", MediaType: "image/png", Uploaded: now})
+	assert.Nil(err)
+	assert.EqualValues("abc", id)
+	_, err = store.fetchImageMeta("dup")
+	assert.EqualValues(errNotFound, err)
+
+	assert.Nil(store.updateImageMeta(ImageMeta{ID: "def", Hash: "def", MediaType: "image/jpeg", CameraModel: "booya", Uploaded: now,
+		Analysis: AnalysisResults{"exif": []byte(`{"cameraModel":"booya"}`)}}))
+
+	// Everything's still there after reopening the database.
+	assert.Nil(store.db.Close())
+	store = NewBoltStore(path)
+	assert.Nil(store.initialize())
+	defer store.db.Close()
+
+	uploads, err := store.fetchLinkUploads("foo")
+	assert.Nil(err)
+	assert.Len(uploads, 3)
+	assert.True(uploads[2].Duplicate)
+	assert.EqualValues(3, uploads[2].ID)
+	uploads, _ = store.fetchLinkUploads("bar")
+	assert.Empty(uploads)
+
+	meta, err := store.fetchMetaForHash("def")
+	assert.Nil(err)
+	assert.EqualValues("booya", meta.CameraModel)
+	assert.JSONEq(`{"cameraModel": "booya"}`, string(meta.Analysis["exif"]))
+	_, err = store.fetchMetaForHash("booya")
+	assert.EqualValues(errNotFound, err)
+
+	metas, err := store.listImageMeta(1, 5)
+	assert.Nil(err)
+	assert.Len(metas, 2)
+	assert.EqualValues("def", metas[0].ID)
+	assert.EqualValues("old", metas[1].ID)
+	metas, err = store.listImagesAfter("abc", 1)
+	assert.Nil(err)
+	assert.Len(metas, 1)
+	assert.EqualValues("def", metas[0].ID)
+	metas, _ = store.listImagesAfter("", -1)
+	assert.Len(metas, 3)
+	metas, _ = store.listImagesAfter("de", -1)
+	assert.Len(metas, 2)
+
+	stats, err := store.getServiceStats()
+	assert.Nil(err)
+	assert.EqualValues(PopularFormat{Format: "PNG", Uploads: 2}, stats.PopularFormat)
+	assert.EqualValues([]CameraModel{{Model: "", Uploads: 2}, {Model: "booya", Uploads: 1}}, stats.Top10CameraModels)
+	assert.EqualValues([]DayFrequency{{
+		Date:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+		Uploads: 2,
+	}}, stats.UploadFrequency30Days)
+
+	assert.Nil(store.removeImageMeta("abc"))
+	assert.Nil(store.removeImageMeta("abc"))
+	_, err = store.fetchImageMeta("abc")
+	assert.EqualValues(errNotFound, err)
+	_, err = store.fetchMetaForHash("abc")
+	assert.EqualValues(errNotFound, err)
+
+	for i, id := range []string{"abc", "def", "old"} {
+		assert.Nil(store.saveAnalysisJob(AnalysisJob{
+			ImageID:     id,
+			State:       jobPending,
+			NextAttempt: now.Add(time.Duration(2-i) * time.Minute),
+		}))
+	}
+
+	assert.Nil(store.saveAnalysisJob(AnalysisJob{ImageID: "old", State: jobDone, Attempts: 1}))
+	job, err := store.fetchAnalysisJob("old")
+	assert.Nil(err)
+	assert.EqualValues(jobDone, job.State)
+	_, err = store.fetchAnalysisJob("booya")
+	assert.EqualValues(errNotFound, err)
+
+	jobs, err := store.listAnalysisJobs(JobFilter{States: []string{jobPending}, Limit: -1})
+	assert.Nil(err)
+	assert.Len(jobs, 2)
+	assert.EqualValues("def", jobs[0].ImageID)
+	jobs, _ = store.listAnalysisJobs(JobFilter{States: []string{jobPending}, DueBy: now.Add(time.Minute), Limit: -1})
+	assert.Len(jobs, 1)
+
+	jobs, _ = store.listAnalysisJobs(JobFilter{Limit: 2})
+	assert.Len(jobs, 2)
+	assert.EqualValues("old", jobs[0].ImageID)
+	assert.EqualValues("def", jobs[1].ImageID)
+
+	counts, err := store.countAnalysisJobs()
+	assert.Nil(err)
+	assert.EqualValues(map[string]uint{jobPending: 2, jobDone: 1}, counts)
+
+	// Jobs are indexed when opening files from earlier versions.
+	assert.Nil(store.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(boltJobQueueBucket)
+	}))
+	assert.Nil(store.db.Close())
+	store = NewBoltStore(path)
+	assert.Nil(store.initialize())
+	defer store.db.Close()
+	jobs, _ = store.listAnalysisJobs(JobFilter{States: []string{jobPending}, Limit: 1})
+	assert.Len(jobs, 1)
+	assert.EqualValues("def", jobs[0].ImageID)
+	counts, _ = store.countAnalysisJobs()
+	assert.EqualValues(map[string]uint{jobPending: 2, jobDone: 1}, counts)
+
+	for i, id := range []string{"foo", "bar"} {
+		assert.Nil(store.saveBackfill(Backfill{ID: id, State: backfillRunning, Created: now.Add(time.Duration(i) * time.Second)}))
+	}
+
+	assert.Nil(store.saveBackfill(Backfill{ID: "foo", State: backfillDone, Scanned: 3, Created: now}))
+	backfill, err := store.fetchBackfill("foo")
+	assert.Nil(err)
+	assert.EqualValues(backfillDone, backfill.State)
+	assert.EqualValues(3, backfill.Scanned)
+	_, err = store.fetchBackfill("booya")
+	assert.EqualValues(errNotFound, err)
+
+	backfills, err := store.listBackfills()
+	assert.Nil(err)
+	assert.Len(backfills, 2)
+	assert.EqualValues("foo", backfills[0].ID)
+	assert.EqualValues("bar", backfills[1].ID)
+
+	for i, id := range []string{"variant-b", "variant-a"} {
+		assert.Nil(store.saveVariant(ImageVariant{ID: id, Size: 10, Created: now.Add(time.Duration(i) * time.Second)}))
+	}
+
+	assert.Nil(store.removeVariant("variant-b"))
+	assert.Nil(store.removeVariant("variant-b"))
+	variants, err := store.listVariants()
+	assert.Nil(err)
+	assert.Len(variants, 1)
+	assert.EqualValues("variant-a", variants[0].ID)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidBridgeURL    = errors.New("Bridge URL must be an absolute HTTP(S) URL")
+	errInvalidBridgeConfig = errors.New("Bridge must have a name, a positive timeout and concurrency, and non-negative retries")
+	errInvalidBridgeSchema = errors.New("Bridge schema must be comma-separated field:type (types: string, number, boolean, array, object)")
+	errInvalidBridgeFetch  = errors.New("Bridge needs a signing key and a positive TTL for image URLs")
+	errInvalidSignature    = errors.New("Image URL has expired or its signature is invalid")
+)
+
+// Types of the fields in responses from bridges (as in JSON schema).
+var bridgeFieldTypes = []string{"string", "number", "boolean", "array", "object"}
+
+// HTTPAnalyzerConfig for analyzing images using an external (out-of-process) processor
+// over HTTP, say, some Python tooling.
+type HTTPAnalyzerConfig struct {
+	// Name of the analyzer (and the namespace of its results).
+	Name string
+	// Endpoint which receives the images (using POST).
+	URL string
+	// Base URL of this service, for sending the URL of the image instead of its content
+	// (the processor fetches the image by itself). Empty for sending the content.
+	FetchBase string
+	// Amount of time for which the image URLs are valid.
+	FetchTTL time.Duration
+	// Key for signing the image URLs (see `signImageURL`).
+	SigningKey []byte
+	// Timeout for each request.
+	Timeout time.Duration
+	// Number of times a request is retried on network errors, `429` or `5xx`.
+	Retries int
+	// Maximum number of concurrent requests.
+	Concurrency int
+	// Fields which must be in the response, along with their types (say, `labels:array`).
+	Schema string
+}
+
+// httpAnalyzer sends images to some endpoint and uses the JSON object in the response
+// as its results. Images are either sent as the request body (with their media type),
+// or as a JSON object with their URL in this service (if `FetchBase` is set), which
+// can be fetched by the processor. Image URLs are signed and they expire, so that the
+// URLs which end up in the logs (or elsewhere) of the processor stop working.
+type httpAnalyzer struct {
+	config HTTPAnalyzerConfig
+	client *http.Client
+	// Types of the required fields in the response.
+	schema map[string]string
+	// Slots for concurrent requests.
+	slots chan struct{}
+}
+
+// bridgeFetchRequest is sent to the processor when it should fetch the image by itself.
+type bridgeFetchRequest struct {
+	ID        string `json:"id"`
+	Hash      string `json:"hash"`
+	MediaType string `json:"mediaType"`
+	URL       string `json:"url"`
+}
+
+// newHTTPAnalyzer using the given config.
+func newHTTPAnalyzer(config HTTPAnalyzerConfig) (*httpAnalyzer, error) {
+	if config.Name == "" || config.Timeout <= 0 || config.Concurrency < 1 || config.Retries < 0 {
+		return nil, errInvalidBridgeConfig
+	}
+
+	if !isHTTPURL(config.URL) || (config.FetchBase != "" && !isHTTPURL(config.FetchBase)) {
+		return nil, errInvalidBridgeURL
+	} else if config.FetchBase != "" && (len(config.SigningKey) == 0 || config.FetchTTL <= 0) {
+		return nil, errInvalidBridgeFetch
+	}
+
+	schema, err := parseBridgeSchema(config.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return &httpAnalyzer{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+		schema: schema,
+		slots:  make(chan struct{}, config.Concurrency),
+	}, nil
+}
+
+// isHTTPURL checks whether the given URL is an absolute HTTP(S) URL.
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// parseBridgeSchema from comma-separated `field:type` pairs.
+func parseBridgeSchema(spec string) (map[string]string, error) {
+	schema := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, errInvalidBridgeSchema
+		}
+
+		field, ty := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if field == "" || !containsString(bridgeFieldTypes, ty) {
+			return nil, errInvalidBridgeSchema
+		}
+
+		schema[field] = ty
+	}
+
+	return schema, nil
+}
+
+func (a *httpAnalyzer) Name() string {
+	return a.config.Name
+}
+
+func (a *httpAnalyzer) Dependencies() []string {
+	return nil
+}
+
+func (a *httpAnalyzer) Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error) {
+	var body []byte
+	var err error
+	mediaType := meta.MediaType
+	if a.config.FetchBase != "" {
+		mediaType = "application/json"
+		body, err = json.Marshal(bridgeFetchRequest{
+			ID:        meta.ID,
+			Hash:      meta.Hash,
+			MediaType: meta.MediaType,
+			URL:       signImageURL(a.config.FetchBase, meta.ID, a.config.SigningKey, time.Now().Add(a.config.FetchTTL)),
+		})
+	} else {
+		body, err = ioutil.ReadAll(content)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	a.slots <- struct{}{}
+	defer func() { <-a.slots }()
+
+	delay := bridgeRetryBaseDelay
+	for attempt := 0; ; attempt++ {
+		data, retry, err := a.send(meta, mediaType, body)
+		if err == nil {
+			return a.checkResponse(data)
+		} else if !retry || attempt >= a.config.Retries {
+			return nil, err
+		}
+
+		log.Printf("Retrying request to bridge %s for image (ID: %s) after error: %s\n", a.config.Name, meta.ID, err.Error())
+		time.Sleep(delay)
+		if delay *= 2; delay > bridgeMaxRetryDelay {
+			delay = bridgeMaxRetryDelay
+		}
+	}
+}
+
+// send the given body for the image in the given metadata. Returns the response body,
+// and whether the request can be retried (if it has failed).
+func (a *httpAnalyzer) send(meta *ImageMeta, mediaType string, body []byte) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, a.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+
+	req.Header.Set(headerContentType, mediaType)
+	req.Header.Set(headerImageID, meta.ID)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBridgeResponseBytes+1))
+	if err != nil {
+		return nil, true, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		return nil, true, fmt.Errorf("Bridge responded with status %d", resp.StatusCode)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("Bridge responded with status %d", resp.StatusCode)
+	} else if len(data) > maxBridgeResponseBytes {
+		return nil, false, errors.New("Bridge response is too large")
+	}
+
+	return data, false, nil
+}
+
+// checkResponse from the bridge, which must be a JSON object matching the schema. The
+// response is kept as it is (so that numbers don't lose their precision).
+func (a *httpAnalyzer) checkResponse(data []byte) (interface{}, error) {
+	var result map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&result)
+	if err != nil || result == nil || decoder.More() {
+		return nil, errors.New("Bridge response must be a JSON object")
+	}
+
+	for field, ty := range a.schema {
+		value, exists := result[field]
+		if !exists {
+			return nil, fmt.Errorf("Bridge response is missing field '%s'", field)
+		} else if jsonType(value) != ty {
+			return nil, fmt.Errorf("Field '%s' in bridge response must be of type %s", field, ty)
+		}
+	}
+
+	return json.RawMessage(data), nil
+}
+
+// MARK: Signed image URLs.
+
+// signImageURL for fetching the image with the given ID (from the service at the given
+// base URL) until the given time. The signature is the HMAC-SHA256 of the image ID and
+// the expiry (in Unix time), using the given key.
+func signImageURL(base, id string, key []byte, expiry time.Time) string {
+	expires := expiry.Unix()
+	query := url.Values{
+		paramExpires:   {strconv.FormatInt(expires, 10)},
+		paramSignature: {imageSignature(key, id, expires)},
+	}
+
+	return fmt.Sprintf("%s/bridge/images/%s?%s", strings.TrimSuffix(base, "/"), id, query.Encode())
+}
+
+// verifyImageSignature in the given query of some URL for the image with the given
+// ID. Returns false if the signature doesn't match, or if it has expired.
+func verifyImageSignature(id string, query url.Values, key []byte, now time.Time) bool {
+	expires, err := strconv.ParseInt(query.Get(paramExpires), 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+
+	expected := imageSignature(key, id, expires)
+	return hmac.Equal([]byte(expected), []byte(query.Get(paramSignature)))
+}
+
+// imageSignature for the image with the given ID and expiry (hex-encoded).
+func imageSignature(key []byte, id string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// jsonType of the given decoded JSON value (as in JSON schema, "null" for nil).
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return "null"
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProcessor responds to the bridge with the given status codes (in order, and
+// then `200 OK`), and tracks the requests.
+type fakeProcessor struct {
+	lock     sync.Mutex
+	statuses []int
+	response string
+	delay    time.Duration
+	requests []fakeRequest
+	// Number of requests being served right now, and the maximum so far.
+	active, maxActive int32
+}
+
+// fakeRequest received by the processor.
+type fakeRequest struct {
+	mediaType, imageID string
+	body               []byte
+}
+
+func (p *fakeProcessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	active := atomic.AddInt32(&p.active, 1)
+	defer atomic.AddInt32(&p.active, -1)
+	body, _ := ioutil.ReadAll(r.Body)
+
+	p.lock.Lock()
+	if active > atomic.LoadInt32(&p.maxActive) {
+		atomic.StoreInt32(&p.maxActive, active)
+	}
+
+	p.requests = append(p.requests, fakeRequest{r.Header.Get(headerContentType), r.Header.Get(headerImageID), body})
+	status := http.StatusOK
+	if len(p.statuses) > 0 {
+		status, p.statuses = p.statuses[0], p.statuses[1:]
+	}
+
+	response := p.response
+	p.lock.Unlock()
+
+	time.Sleep(p.delay)
+	w.WriteHeader(status)
+	w.Write([]byte(response))
+}
+
+// respond with the given status codes and response from now on.
+func (p *fakeProcessor) respond(statuses []int, response string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.statuses, p.response = statuses, response
+}
+
+// received requests so far.
+func (p *fakeProcessor) received() []fakeRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]fakeRequest{}, p.requests...)
+}
+
+func TestBridgeConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := HTTPAnalyzerConfig{Name: "ml", URL: "http://localhost:5000/analyze", Timeout: time.Second, Concurrency: 1}
+
+	_, err := newHTTPAnalyzer(config)
+	assert.Nil(err)
+
+	for _, modify := range []func(c *HTTPAnalyzerConfig){
+		func(c *HTTPAnalyzerConfig) { c.Name = "" },
+		func(c *HTTPAnalyzerConfig) { c.Timeout = 0 },
+		func(c *HTTPAnalyzerConfig) { c.Concurrency = 0 },
+		func(c *HTTPAnalyzerConfig) { c.Retries = -1 },
+	} {
+		c := config
+		modify(&c)
+		_, err = newHTTPAnalyzer(c)
+		assert.EqualValues(errInvalidBridgeConfig, err)
+	}
+
+	for _, endpoint := range []string{"", "localhost:5000", "/analyze", "ftp://localhost/analyze"} {
+		c := config
+		c.URL = endpoint
+		_, err = newHTTPAnalyzer(c)
+		assert.EqualValues(errInvalidBridgeURL, err)
+	}
+
+	c := config
+	c.FetchBase = "booya"
+	_, err = newHTTPAnalyzer(c)
+	assert.EqualValues(errInvalidBridgeURL, err)
+	c.FetchBase = "http://localhost:3000"
+	_, err = newHTTPAnalyzer(c)
+	assert.EqualValues(errInvalidBridgeFetch, err)
+	c.SigningKey, c.FetchTTL = []byte("foobar"), time.Minute
+	_, err = newHTTPAnalyzer(c)
+	assert.Nil(err)
+
+	schema, err := parseBridgeSchema("labels:array, score : number,")
+	assert.Nil(err)
+	assert.EqualValues(map[string]string{"labels": "array", "score": "number"}, schema)
+	for _, spec := range []string{"labels", "labels:list", ":array", "a:b:c"} {
+		_, err = parseBridgeSchema(spec)
+		assert.EqualValues(errInvalidBridgeSchema, err)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	assert := assert.New(t)
+	response := `{"labels": ["cat"], "score": 12345678901234567890}`
+	processor := &fakeProcessor{response: response}
+	server := httptest.NewServer(processor)
+	defer server.Close()
+
+	bridge, err := newHTTPAnalyzer(HTTPAnalyzerConfig{
+		Name:        "ml",
+		URL:         server.URL,
+		Timeout:     time.Second,
+		Retries:     2,
+		Concurrency: 2,
+		Schema:      "labels:array,score:number",
+	})
+	assert.Nil(err)
+
+	// Content is sent as it is, and the response is kept as it is.
+	meta := &ImageMeta{ID: "foo", Hash: "abc", MediaType: "image/png"}
+	result, err := bridge.Analyze(meta, bytes.NewReader([]byte(pngMagic+"foo")))
+	assert.Nil(err)
+	data, _ := json.Marshal(result)
+	assert.JSONEq(response, string(data))
+	assert.Contains(string(data), "12345678901234567890")
+	assert.EqualValues(fakeRequest{"image/png", "foo", []byte(pngMagic + "foo")}, processor.received()[0])
+
+	// Server errors are retried (until we run out of retries), but client errors aren't.
+	processor.respond([]int{http.StatusServiceUnavailable, http.StatusTooManyRequests}, response)
+	_, err = bridge.Analyze(meta, bytes.NewReader(nil))
+	assert.Nil(err)
+	assert.Len(processor.received(), 4)
+
+	processor.respond([]int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, response)
+	_, err = bridge.Analyze(meta, bytes.NewReader(nil))
+	assert.EqualValues("Bridge responded with status 502", err.Error())
+	assert.Len(processor.received(), 7)
+
+	processor.respond([]int{http.StatusBadRequest}, response)
+	_, err = bridge.Analyze(meta, bytes.NewReader(nil))
+	assert.EqualValues("Bridge responded with status 400", err.Error())
+	assert.Len(processor.received(), 8)
+
+	// Responses must match the schema.
+	for response, msg := range map[string]string{
+		`["cat"]`:                       "Bridge response must be a JSON object",
+		`{"labels": []} {}`:             "Bridge response must be a JSON object",
+		`{"labels": []}`:                "Bridge response is missing field 'score'",
+		`{"labels": "cat", "score": 1}`: "Field 'labels' in bridge response must be of type array",
+	} {
+		processor.respond(nil, response)
+		_, err = bridge.Analyze(meta, bytes.NewReader(nil))
+		assert.EqualValues(msg, err.Error())
+	}
+}
+
+func TestBridgeLimits(t *testing.T) {
+	assert := assert.New(t)
+	processor := &fakeProcessor{response: `{}`, delay: 50 * time.Millisecond}
+	server := httptest.NewServer(processor)
+	defer server.Close()
+
+	bridge, _ := newHTTPAnalyzer(HTTPAnalyzerConfig{
+		Name:        "ml",
+		URL:         server.URL,
+		FetchBase:   "http://images.example.com/",
+		FetchTTL:    time.Minute,
+		SigningKey:  []byte("foobar"),
+		Timeout:     time.Second,
+		Concurrency: 2,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := bridge.Analyze(&ImageMeta{ID: "foo", Hash: "abc", MediaType: "image/png"}, bytes.NewReader(nil))
+			assert.Nil(err)
+		}()
+	}
+
+	wg.Wait()
+	assert.Len(processor.received(), 6)
+	assert.EqualValues(2, atomic.LoadInt32(&processor.maxActive))
+
+	// Processor fetches the image by itself (using a signed URL).
+	var req bridgeFetchRequest
+	json.Unmarshal(processor.received()[0].body, &req)
+	assert.EqualValues(bridgeFetchRequest{ID: "foo", Hash: "abc", MediaType: "image/png"}, bridgeFetchRequest{
+		ID:        req.ID,
+		Hash:      req.Hash,
+		MediaType: req.MediaType,
+	})
+	assert.EqualValues("application/json", processor.received()[0].mediaType)
+	fetchURL, err := url.Parse(req.URL)
+	assert.Nil(err)
+	assert.EqualValues("http://images.example.com/bridge/images/foo", strings.Split(req.URL, "?")[0])
+	assert.True(verifyImageSignature("foo", fetchURL.Query(), []byte("foobar"), time.Now().Add(59*time.Second)))
+	assert.False(verifyImageSignature("foo", fetchURL.Query(), []byte("foobar"), time.Now().Add(61*time.Second)))
+
+	// Requests time out (and they're retried, if possible).
+	bridge, _ = newHTTPAnalyzer(HTTPAnalyzerConfig{Name: "ml", URL: server.URL, Timeout: 10 * time.Millisecond, Concurrency: 1})
+	_, err = bridge.Analyze(&ImageMeta{ID: "foo"}, bytes.NewReader(nil))
+	assert.NotNil(err)
+	server.Close()
+	assert.Len(processor.received(), 7)
+}
+
+func TestSignedImageURL(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+	content := []byte(pngMagic + "foo")
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	writeObject(service, hash, content)
+	service.data.addImageData(ImageMeta{ID: "foo", Hash: hash, MediaType: "image/png", Size: uint(len(content))})
+
+	service.signingKey = []byte("booya")
+	r := mux.NewRouter()
+	r.HandleFunc("/images/{id}", service.fetchImage).Methods("GET")
+	r.HandleFunc("/bridge/images/{id}", service.fetchSignedImage).Methods("GET")
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	key := service.signingKey
+	fetch := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		assert.Nil(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	signed := signImageURL(server.URL, "foo", key, time.Now().Add(time.Minute))
+	assert.True(strings.HasPrefix(signed, server.URL+"/bridge/images/foo?"))
+	assert.EqualValues(http.StatusOK, fetch(strings.TrimPrefix(signed, server.URL)))
+
+	// Signatures are always checked for the bridge (along with the expiry), and they
+	// aren't made with the access token.
+	for _, path := range []string{
+		strings.TrimPrefix(signImageURL(server.URL, "foo", key, time.Now().Add(-time.Second)), server.URL),
+		strings.TrimPrefix(signImageURL(server.URL, "foo", []byte(service.accessToken), time.Now().Add(time.Minute)), server.URL),
+		strings.Replace(strings.TrimPrefix(signed, server.URL), "expires=", "expires=1", 1),
+		"/bridge/images/foo?signature=booya",
+		"/bridge/images/foo",
+	} {
+		assert.EqualValues(http.StatusForbidden, fetch(path))
+	}
+
+	// Signature of some image doesn't work for the others.
+	bar := strings.Replace(strings.TrimPrefix(signed, server.URL), "/images/foo", "/images/bar", 1)
+	assert.EqualValues(http.StatusForbidden, fetch(bar))
+
+	// Public path doesn't care about signatures.
+	assert.EqualValues(http.StatusOK, fetch("/images/foo"))
+	assert.EqualValues(http.StatusOK, fetch("/images/foo?signature=booya"))
+}
@@ -1,141 +1,465 @@
 package main
 
 import (
+	"database/sql/driver"
+	"log"
+	"math/rand"
+	"net"
 	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"github.com/lib/pq"
 )
 
-// PostgreSQLStore for a PostgreSQL database.
+// DBPoolConfig limits the connections in the pool shared by all database queries.
+type DBPoolConfig struct {
+	// Maximum number of open connections (zero means no limit).
+	MaxOpen int
+	// Maximum number of idle connections kept in the pool.
+	MaxIdle int
+	// Maximum amount of time a connection may be reused (zero means forever).
+	MaxLifetime time.Duration
+}
+
+// PostgreSQLStore for a PostgreSQL database. All queries share a single connection
+// pool, and they're retried (with exponential backoff) on transient errors. The schema
+// is versioned (see `migrations`), and it's migrated to the latest version on start-up.
 type PostgreSQLStore struct {
-	url string
+	url  string
+	pool DBPoolConfig
+	db   *gorm.DB
+}
+
+// NewPostgreSQLStore for the database in the given URL. Connections are opened
+// when the store is initialized.
+func NewPostgreSQLStore(url string, pool DBPoolConfig) *PostgreSQLStore {
+	return &PostgreSQLStore{
+		url:  url,
+		pool: pool,
+	}
 }
 
 // MARK: `DataStore` interface methods.
 
 func (s *PostgreSQLStore) initialize() error {
-	db, err := s.getConnection()
+	_, err := s.migrate(-1)
+	return err
+}
+
+func (s *PostgreSQLStore) addUploadID(id string, expiry time.Time, policy LinkPolicy) error {
+	link := UploadLink{
+		ID:     id,
+		Expiry: expiry,
+		Policy: policy,
+	}
+
+	return withRetry(func() error {
+		return s.db.Create(&link).Error
+	})
+}
+
+func (s *PostgreSQLStore) getUploadLink(id string) (*UploadLink, error) {
+	var link UploadLink
+	err := withRetry(func() error {
+		return s.db.Where("id = ?", id).First(&link).Error
+	})
+
 	if err != nil {
-		return err
+		return nil, dbError(err)
 	}
-	defer db.Close()
 
-	db.AutoMigrate(&UploadLink{})
-	db.AutoMigrate(&ImageMeta{})
+	return &link, nil
+}
 
-	return nil
+func (s *PostgreSQLStore) updateUploadLink(link UploadLink) error {
+	return withRetry(func() error {
+		return s.db.Save(&link).Error
+	})
 }
 
-func (s *PostgreSQLStore) addUploadID(id string, expiry time.Time) error {
-	db, err := s.getConnection()
-	if err != nil {
-		return err
+func (s *PostgreSQLStore) listUploadLinks(filter LinkFilter) (*LinkList, error) {
+	query := s.db.Model(&UploadLink{})
+	switch filter.Status {
+	case linkStatusActive:
+		query = query.Where("expiry > ? AND used = ?", filter.Now, false)
+	case linkStatusExpired:
+		query = query.Where("expiry <= ? OR used = ?", filter.Now, true)
 	}
-	defer db.Close()
 
-	link := UploadLink{
-		ID:     id,
-		Expiry: expiry,
+	list := LinkList{
+		Links: []UploadLink{},
 	}
 
-	db.Create(&link)
-	return nil
-}
+	err := withRetry(func() error {
+		err := query.Count(&list.Total).Error
+		if err != nil {
+			return err
+		}
+
+		return query.Order("expiry DESC").Offset(filter.Offset).Limit(filter.Limit).Find(&list.Links).Error
+	})
 
-func (s *PostgreSQLStore) getUploadExpiry(id string) (*time.Time, error) {
-	db, err := s.getConnection()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
 
-	var link UploadLink
-	db.Where("id = ?", id).First(&link)
+	return &list, nil
+}
 
-	return &link.Expiry, nil
+func (s *PostgreSQLStore) addLinkUpload(upload LinkUpload) error {
+	return withRetry(func() error {
+		return s.db.Create(&upload).Error
+	})
 }
 
-func (s *PostgreSQLStore) addImageMeta(meta ImageMeta) error {
-	db, err := s.getConnection()
+func (s *PostgreSQLStore) fetchLinkUploads(linkID string) ([]LinkUpload, error) {
+	uploads := []LinkUpload{}
+	err := withRetry(func() error {
+		return s.db.Where("link_id = ?", linkID).Order("uploaded").Find(&uploads).Error
+	})
+
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer db.Close()
 
-	db.Create(&meta)
-	return nil
+	return uploads, nil
 }
 
-func (s *PostgreSQLStore) updateImageMeta(meta ImageMeta) error {
-	db, err := s.getConnection()
+func (s *PostgreSQLStore) addImageMeta(meta ImageMeta) (string, error) {
+	var row struct{ ID string }
+	err := withRetry(func() error {
+		// Hashes are unique, so only one of the concurrent uploads of some image gets in.
+		err := s.db.Raw("INSERT INTO image_meta (id, hash, media_type, size, uploaded, camera_model, "+
+			"latitude, longitude, link_id, filename, analysis) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+			"ON CONFLICT (hash) DO NOTHING RETURNING id",
+			meta.ID, meta.Hash, meta.MediaType, meta.Size, meta.Uploaded, meta.CameraModel,
+			meta.Latitude, meta.Longitude, meta.LinkID, meta.Filename, meta.Analysis).Scan(&row).Error
+		if dbError(err) != errNotFound {
+			return err
+		}
+
+		// Nothing's returned if the hash exists already.
+		return s.db.Raw("SELECT id FROM image_meta WHERE hash = ?", meta.Hash).Scan(&row).Error
+	})
+
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer db.Close()
 
-	db.Save(&meta)
-	return nil
+	return row.ID, nil
+}
+
+func (s *PostgreSQLStore) updateImageMeta(meta ImageMeta) error {
+	return withRetry(func() error {
+		return s.db.Save(&meta).Error
+	})
 }
 
 func (s *PostgreSQLStore) fetchImageMeta(id string) (*ImageMeta, error) {
-	db, err := s.getConnection()
+	var meta ImageMeta
+	err := withRetry(func() error {
+		return s.db.Where("id = ?", id).First(&meta).Error
+	})
+
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
-	defer db.Close()
-
-	var meta ImageMeta
-	db.Where("id = ?", id).First(&meta)
 
 	return &meta, nil
 }
 
 func (s *PostgreSQLStore) fetchMetaForHash(hash string) (*ImageMeta, error) {
-	db, err := s.getConnection()
+	var meta ImageMeta
+	err := withRetry(func() error {
+		return s.db.Where("hash = ?", hash).First(&meta).Error
+	})
+
 	if err != nil {
-		return nil, err
+		return nil, dbError(err)
 	}
-	defer db.Close()
-
-	var meta ImageMeta
-	db.Where("hash = ?", hash).First(&meta)
 
 	return &meta, nil
 }
 
-func (s *PostgreSQLStore) getServiceStats() (*ServiceStats, error) {
-	db, err := s.getConnection()
+func (s *PostgreSQLStore) listImageMeta(offset, limit int) ([]ImageMeta, error) {
+	metas := []ImageMeta{}
+	err := withRetry(func() error {
+		return s.db.Order("id").Offset(offset).Limit(limit).Find(&metas).Error
+	})
+
+	return metas, err
+}
+
+func (s *PostgreSQLStore) listImagesAfter(id string, limit int) ([]ImageMeta, error) {
+	metas := []ImageMeta{}
+	err := withRetry(func() error {
+		return s.db.Where("id > ?", id).Order("id").Limit(limit).Find(&metas).Error
+	})
+
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
 
+	return metas, nil
+}
+
+func (s *PostgreSQLStore) removeImageMeta(id string) error {
+	return withRetry(func() error {
+		return s.db.Where("id = ?", id).Delete(&ImageMeta{}).Error
+	})
+}
+
+func (s *PostgreSQLStore) getServiceStats() (*ServiceStats, error) {
 	stats := ServiceStats{
 		PopularFormat:         PopularFormat{},
 		Top10CameraModels:     []CameraModel{},
 		UploadFrequency30Days: []DayFrequency{},
 	}
 
-	db.Raw("SELECT media_type AS format, " +
-		"count(*) AS uploads FROM image_meta " +
-		"GROUP BY 1 ORDER BY 2 DESC LIMIT 1").Scan(&stats.PopularFormat)
-	stats.PopularFormat.Format = strings.ToUpper(strings.TrimPrefix(stats.PopularFormat.Format, imageMediaType))
+	err := withRetry(func() error {
+		err := s.db.Raw("SELECT media_type AS format, " +
+			"count(*) AS uploads FROM image_meta " +
+			"GROUP BY 1 ORDER BY 2 DESC LIMIT 1").Scan(&stats.PopularFormat).Error
+		// No images yet.
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
 
-	db.Raw("SELECT camera_model AS model, " +
-		"count(*) AS uploads FROM image_meta " +
-		"GROUP BY 1 ORDER BY 2 DESC LIMIT 10").Find(&stats.Top10CameraModels)
+		err = s.db.Raw("SELECT camera_model AS model, " +
+			"count(*) AS uploads FROM image_meta " +
+			"GROUP BY 1 ORDER BY 2 DESC LIMIT 10").Find(&stats.Top10CameraModels).Error
+		if err != nil {
+			return err
+		}
 
-	db.Raw("SELECT date_trunc('day', uploaded) AS date, " +
-		"count(*) AS uploads FROM image_meta " +
-		"WHERE uploaded > now() - interval '30 days' " +
-		"GROUP BY 1 ORDER BY 1").Scan(&stats.UploadFrequency30Days)
+		return s.db.Raw("SELECT date_trunc('day', uploaded) AS date, " +
+			"count(*) AS uploads FROM image_meta " +
+			"WHERE uploaded > now() - interval '30 days' " +
+			"GROUP BY 1 ORDER BY 1").Scan(&stats.UploadFrequency30Days).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
+	stats.PopularFormat.Format = strings.ToUpper(strings.TrimPrefix(stats.PopularFormat.Format, imageMediaType))
 	return &stats, nil
 }
 
-// getConnection for this database.
-func (s *PostgreSQLStore) getConnection() (*gorm.DB, error) {
-	return gorm.Open("postgres", s.url)
+func (s *PostgreSQLStore) saveAnalysisJob(job AnalysisJob) error {
+	return withRetry(func() error {
+		return s.db.Save(&job).Error
+	})
+}
+
+func (s *PostgreSQLStore) fetchAnalysisJob(imageID string) (*AnalysisJob, error) {
+	var job AnalysisJob
+	err := withRetry(func() error {
+		return s.db.Where("image_id = ?", imageID).First(&job).Error
+	})
+
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	return &job, nil
+}
+
+func (s *PostgreSQLStore) listAnalysisJobs(filter JobFilter) ([]AnalysisJob, error) {
+	query := s.db.Model(&AnalysisJob{})
+	if len(filter.States) > 0 {
+		query = query.Where("state IN (?)", filter.States)
+	}
+
+	if !filter.DueBy.IsZero() {
+		query = query.Where("next_attempt <= ?", filter.DueBy)
+	}
+
+	jobs := []AnalysisJob{}
+	err := withRetry(func() error {
+		return query.Order("next_attempt").Limit(filter.Limit).Find(&jobs).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+func (s *PostgreSQLStore) countAnalysisJobs() (map[string]uint, error) {
+	var rows []struct {
+		State string
+		Jobs  uint
+	}
+
+	err := withRetry(func() error {
+		return s.db.Raw("SELECT state, count(*) AS jobs FROM analysis_jobs GROUP BY 1").Scan(&rows).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]uint)
+	for _, row := range rows {
+		counts[row.State] = row.Jobs
+	}
+
+	return counts, nil
+}
+
+func (s *PostgreSQLStore) saveBackfill(backfill Backfill) error {
+	return withRetry(func() error {
+		return s.db.Save(&backfill).Error
+	})
+}
+
+func (s *PostgreSQLStore) fetchBackfill(id string) (*Backfill, error) {
+	var backfill Backfill
+	err := withRetry(func() error {
+		return s.db.Where("id = ?", id).First(&backfill).Error
+	})
+
+	if err != nil {
+		return nil, dbError(err)
+	}
+
+	return &backfill, nil
+}
+
+func (s *PostgreSQLStore) listBackfills() ([]Backfill, error) {
+	backfills := []Backfill{}
+	err := withRetry(func() error {
+		return s.db.Order("created, id").Find(&backfills).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return backfills, nil
+}
+
+func (s *PostgreSQLStore) saveVariant(variant ImageVariant) error {
+	return withRetry(func() error {
+		return s.db.Save(&variant).Error
+	})
+}
+
+func (s *PostgreSQLStore) removeVariant(id string) error {
+	return withRetry(func() error {
+		return s.db.Where("id = ?", id).Delete(ImageVariant{}).Error
+	})
+}
+
+func (s *PostgreSQLStore) listVariants() ([]ImageVariant, error) {
+	variants := []ImageVariant{}
+	err := withRetry(func() error {
+		return s.db.Order("created, id").Find(&variants).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return variants, nil
+}
+
+// MARK: `MigratableStore` interface methods.
+
+func (s *PostgreSQLStore) migrate(version int) (int, error) {
+	err := s.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	return migrateSchema(s.db, version)
+}
+
+// connect to the database (if we haven't already) and set up the connection pool.
+func (s *PostgreSQLStore) connect() error {
+	if s.db != nil {
+		return nil
+	}
+
+	var db *gorm.DB
+	err := withRetry(func() (err error) {
+		db, err = gorm.Open("postgres", s.url)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	db.DB().SetMaxOpenConns(s.pool.MaxOpen)
+	db.DB().SetMaxIdleConns(s.pool.MaxIdle)
+	db.DB().SetConnMaxLifetime(s.pool.MaxLifetime)
+	s.db = db
+	return nil
+}
+
+// MARK: Error handling.
+
+// dbError translates the given error from gorm into the errors of `DataStore`.
+func dbError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return errNotFound
+	}
+
+	return err
+}
+
+// isTransientError checks whether the given database error is temporary, so that
+// the query can be retried. CockroachDB asks the clients to retry transactions
+// which fail because of contention (serialization failures).
+func isTransientError(err error) bool {
+	if errs, ok := err.(gorm.Errors); ok {
+		for _, err := range errs {
+			if isTransientError(err) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	switch e := err.(type) {
+	case *pq.Error:
+		switch e.Code {
+		// serialization_failure, deadlock_detected, admin_shutdown, cannot_connect_now
+		case "40001", "40P01", "57P01", "57P03":
+			return true
+		}
+
+		// Connection exceptions.
+		return e.Code.Class() == "08"
+
+	case net.Error:
+		return true
+	}
+
+	return err == driver.ErrBadConn
+}
+
+// withRetry runs the given operation, and retries it with exponential backoff (for
+// a few times) if it fails because of a transient error.
+func withRetry(op func() error) error {
+	delay := dbRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > dbMaxRetries || !isTransientError(err) {
+			return err
+		}
+
+		log.Printf("Retrying database operation (attempt %d) after error: %s\n", attempt, err.Error())
+		// Add some jitter, so that conflicting operations don't retry in lockstep.
+		time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		if delay *= 2; delay > dbMaxRetryDelay {
+			delay = dbMaxRetryDelay
+		}
+	}
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabaseErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.EqualValues(errNotFound, dbError(gorm.ErrRecordNotFound))
+	assert.EqualValues(errNotFound, dbError(gorm.Errors{gorm.ErrRecordNotFound}))
+	assert.EqualValues(driver.ErrBadConn, dbError(driver.ErrBadConn))
+
+	assert.True(isTransientError(&pq.Error{Code: "40001"}))
+	assert.True(isTransientError(&pq.Error{Code: "08006"}))
+	assert.True(isTransientError(gorm.Errors{gorm.ErrRecordNotFound, &pq.Error{Code: "40P01"}}))
+	assert.True(isTransientError(driver.ErrBadConn))
+	assert.False(isTransientError(&pq.Error{Code: "23505"}))
+	assert.False(isTransientError(gorm.ErrRecordNotFound))
+
+	// Serialization failures are retried until the operation succeeds.
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		if attempts < 3 {
+			return &pq.Error{Code: "40001"}
+		}
+
+		return nil
+	})
+	assert.Nil(err)
+	assert.EqualValues(3, attempts)
+
+	// Other errors aren't retried.
+	attempts = 0
+	err = withRetry(func() error {
+		attempts++
+		return gorm.ErrRecordNotFound
+	})
+	assert.EqualValues(gorm.ErrRecordNotFound, err)
+	assert.EqualValues(1, attempts)
+}
+
+func TestMigrations(t *testing.T) {
+	assert := assert.New(t)
+
+	// Versions are sequential, and every step can be rolled back.
+	for i, step := range migrations {
+		assert.EqualValues(i+1, step.version)
+		assert.NotEmpty(step.description)
+		assert.NotEmpty(step.up)
+		assert.NotEmpty(step.down)
+	}
+	assert.EqualValues(len(migrations), latestSchemaVersion())
+
+	step, up := nextMigration(0, 2)
+	assert.EqualValues(1, step.version)
+	assert.True(up)
+	step, up = nextMigration(3, 1)
+	assert.EqualValues(3, step.version)
+	assert.False(up)
+	step, _ = nextMigration(2, 2)
+	assert.Nil(step)
+
+	os.Setenv(envDataStore, "memory://")
+	defer os.Unsetenv(envDataStore)
+
+	assert.EqualValues(errInvalidMigrateArgs, runMigrateCommand([]string{"foo"}, DBPoolConfig{}))
+	assert.EqualValues(errInvalidMigrateArgs, runMigrateCommand([]string{"-1"}, DBPoolConfig{}))
+	assert.EqualValues(errInvalidMigrateArgs, runMigrateCommand([]string{"1", "2"}, DBPoolConfig{}))
+	// Nothing to migrate in memory.
+	assert.Nil(runMigrateCommand([]string{"1"}, DBPoolConfig{}))
+	assert.Nil(runMigrateCommand(nil, DBPoolConfig{}))
+}
+
+// envTestPostgresURL has the URL of some PostgreSQL (or CockroachDB) database for
+// testing the schema (tests which need it are skipped if it's not set). Each test uses
+// its own schema.
+const envTestPostgresURL = "TEST_POSTGRES_URL"
+
+// testPostgresURL for a new schema in the test database, which is dropped once the
+// test is done.
+func testPostgresURL(t *testing.T) string {
+	url := os.Getenv(envTestPostgresURL)
+	if url == "" {
+		t.Skipf("%s isn't set", envTestPostgresURL)
+	}
+
+	db, err := gorm.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema := strings.ToLower("test_" + randomAlphanumeric(8))
+	if err = db.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		db.Close()
+	})
+
+	if strings.Contains(url, "?") {
+		return url + "&search_path=" + schema
+	}
+
+	return url + "?search_path=" + schema
+}
+
+func TestPostgreSQLMigrations(t *testing.T) {
+	assert := assert.New(t)
+	url := testPostgresURL(t)
+
+	// Tables which were created by the oldest versions.
+	store := NewPostgreSQLStore(url, DBPoolConfig{})
+	assert.Nil(store.connect())
+	defer store.db.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, statement := range []string{
+		`CREATE TABLE upload_links (id text PRIMARY KEY, expiry timestamp with time zone)`,
+		`CREATE TABLE image_meta (id text PRIMARY KEY, hash text, media_type text, size integer,
+			uploaded timestamp with time zone, camera_model text, latitude numeric, longitude numeric)`,
+		fmt.Sprintf(`INSERT INTO upload_links VALUES ('foo', '%s')`, now.Add(time.Hour).Format(time.RFC3339)),
+		// Same image, which has been uploaded twice.
+		fmt.Sprintf(`INSERT INTO image_meta (id, hash, media_type, size, uploaded) VALUES
+			('a', 'abc', 'image/png', 5, '%s'), ('b', 'abc', 'image/png', 5, '%s')`,
+			now.Format(time.RFC3339), now.Add(time.Second).Format(time.RFC3339)),
+	} {
+		assert.Nil(store.db.Exec(statement).Error)
+	}
+
+	version, err := store.migrate(1)
+	assert.Nil(err)
+	assert.EqualValues(1, version)
+	assert.Nil(store.addLinkUpload(LinkUpload{LinkID: "foo", ImageID: "b", Hash: "abc", Size: 5, Uploaded: now}))
+
+	// Concurrent migrations don't get in each other's way.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			other := NewPostgreSQLStore(url, DBPoolConfig{})
+			version, err := other.migrate(-1)
+			assert.Nil(err)
+			assert.EqualValues(latestSchemaVersion(), version)
+			other.db.Close()
+		}()
+	}
+	wg.Wait()
+
+	// Lock is released once we're done, and the lock of an instance which crashed
+	// while migrating expires.
+	var locks int
+	assert.Nil(store.db.Table("schema_migrations_lock").Count(&locks).Error)
+	assert.EqualValues(0, locks)
+	assert.Nil(store.db.Exec("INSERT INTO schema_migrations_lock VALUES (?, 'crashed', ?)", migrationLockID, now.Add(-time.Minute)).Error)
+	version, err = store.migrate(-1)
+	assert.Nil(err)
+	assert.EqualValues(latestSchemaVersion(), version)
+
+	link, err := store.getUploadLink("foo")
+	assert.Nil(err)
+	assert.True(link.Expiry.Equal(now.Add(time.Hour)))
+	assert.EqualValues(0, link.Images)
+	link.Images = 1
+	assert.Nil(store.updateUploadLink(*link))
+
+	// Duplicates have been merged into the earliest image.
+	_, err = store.fetchImageMeta("b")
+	assert.EqualValues(errNotFound, err)
+	uploads, err := store.fetchLinkUploads("foo")
+	assert.Nil(err)
+	assert.Len(uploads, 1)
+	assert.EqualValues("a", uploads[0].ImageID)
+	assert.True(uploads[0].Duplicate)
+	id, err := store.addImageMeta(ImageMeta{ID: "c", Hash: "abc", MediaType: "image/png", Size: 5, LinkID: "foo", Filename: "c.png"})
+	assert.Nil(err)
+	assert.EqualValues("a", id)
+	id, err = store.addImageMeta(ImageMeta{ID: "d", Hash: "def", MediaType: "image/png", Size: 5, LinkID: "foo", Filename: "d.png"})
+	assert.Nil(err)
+	assert.EqualValues("d", id)
+
+	// Everything can be rolled back, and applied again.
+	version, err = store.migrate(0)
+	assert.Nil(err)
+	assert.EqualValues(0, version)
+	version, err = store.migrate(-1)
+	assert.Nil(err)
+	assert.EqualValues(latestSchemaVersion(), version)
+}
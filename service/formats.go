@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Formats which we can encode images into, in the order of our preference
+// (the names are the same as the ones returned by `image.Decode`).
+var outputFormats = []string{"png", "jpeg", "webp", "gif"}
+
+var errNotAcceptable = errors.New("None of the acceptable media types can be served for image")
+
+// isOutputFormat checks whether we can encode images into the given format.
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+// variantMediaType of the image with the given media type after applying the given
+// params (if any). Variants retain the original format, unless we can't encode it.
+func variantMediaType(mediaType string, params *VariantParams) string {
+	if params == nil {
+		return mediaType
+	}
+
+	format := params.Format
+	if format == "" {
+		format = strings.TrimPrefix(mediaType, imageMediaType)
+	}
+
+	if !isOutputFormat(format) {
+		format = "png"
+	}
+
+	return imageMediaType + format
+}
+
+// encodeImage in the given format (PNG if we can't encode that) with the given
+// quality (used only for JPEG). Returns the media type of the encoded image.
+func encodeImage(w io.Writer, img image.Image, format string, quality int) (string, error) {
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "webp":
+		err = encodeWebP(w, img)
+	case "gif":
+		err = gif.Encode(w, img, nil)
+	default:
+		format = "png"
+		err = png.Encode(w, img)
+	}
+
+	return imageMediaType + format, err
+}
+
+// negotiateFormat using the given `Accept` header for an image of the given media type.
+// Returns an empty string if that media type is acceptable (or if the header is empty),
+// or the most preferred format that we can encode otherwise.
+func negotiateFormat(accept, mediaType string) (string, error) {
+	if strings.TrimSpace(accept) == "" || acceptQuality(accept, mediaType) > 0 {
+		return "", nil
+	}
+
+	best, bestQuality := "", 0.0
+	for _, format := range outputFormats {
+		quality := acceptQuality(accept, imageMediaType+format)
+		if quality > bestQuality {
+			best, bestQuality = format, quality
+		}
+	}
+
+	if best == "" {
+		return "", errNotAcceptable
+	}
+
+	return best, nil
+}
+
+// acceptQuality of the given media type in the given `Accept` header, using the
+// quality of the most specific range matching the media type.
+func acceptQuality(accept, mediaType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, value := range strings.Split(accept, ",") {
+		acceptable, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+
+		matches := 0
+		if acceptable == mediaType {
+			matches = 2
+		} else if acceptable == "*/*" {
+			matches = 0
+		} else if strings.HasSuffix(acceptable, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(acceptable, "*")) {
+			matches = 1
+		} else {
+			continue
+		}
+
+		if matches <= specificity {
+			continue
+		}
+
+		specificity, quality = matches, 1
+		if q, exists := params["q"]; exists {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				quality = 0
+			}
+		}
+	}
+
+	return quality
+}
@@ -1,13 +1,28 @@
 module hasty_service
 
-go 1.12
+go 1.21
 
 require (
 	github.com/gorilla/mux v1.7.3
 	github.com/h2non/filetype v1.0.10
 	github.com/hashicorp/golang-lru v0.5.3
 	github.com/jinzhu/gorm v1.9.11
+	github.com/lib/pq v1.1.1
 	github.com/rickb777/date v1.12.4
 	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
 	github.com/stretchr/testify v1.4.0
+	github.com/tetratelabs/wazero v1.8.0
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/image v0.18.0
+	golang.org/x/sync v0.7.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/rickb777/plural v1.2.0 // indirect
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
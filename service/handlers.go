@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -18,13 +20,35 @@ func (service *ImageService) registerRoutes() {
 	ephemeralEndpoint := fmt.Sprintf("%s/{id}", service.uploadLinkPrefix)
 	r.HandleFunc(ephemeralEndpoint, service.handleImageUpload).Methods("POST")
 	r.HandleFunc("/images/{id}", service.fetchImage).Methods("GET")
+	r.HandleFunc("/bridge/images/{id}", service.fetchSignedImage).Methods("GET")
+
+	// Resumable uploads (tus protocol) for ephemeral links.
+	t := r.PathPrefix(ephemeralEndpoint + "/tus").Subrouter()
+	t.Use(tusMiddleware)
+
+	t.HandleFunc("", service.handleTusOptions).Methods("OPTIONS")
+	t.HandleFunc("", service.handleTusCreation).Methods("POST")
+	t.HandleFunc("/{upload}", service.handleTusOptions).Methods("OPTIONS")
+	t.HandleFunc("/{upload}", service.fetchTusOffset).Methods("HEAD")
+	t.HandleFunc("/{upload}", service.handleTusAppend).Methods("PATCH")
+	t.HandleFunc("/{upload}", service.handleTusTermination).Methods("DELETE")
 
 	// Endpoints that require an access token are behind the auth middleware.
 	s := r.PathPrefix("/admin").Subrouter()
 	s.Use(amw.Middleware)
 
 	s.HandleFunc("/ephemeral-links", service.handleLinkCreation).Methods("POST")
+	s.HandleFunc("/ephemeral-links", service.handleLinkListing).Methods("GET")
+	s.HandleFunc("/ephemeral-links/{id}", service.fetchLinkDetails).Methods("GET")
+	s.HandleFunc("/ephemeral-links/{id}", service.handleLinkUpdate).Methods("PATCH")
+	s.HandleFunc("/ephemeral-links/{id}", service.handleLinkRevocation).Methods("DELETE")
+	s.HandleFunc("/ephemeral-links/{id}/uploads", service.fetchLinkUploads).Methods("GET")
 	s.HandleFunc("/stats", service.fetchStats).Methods("GET")
+	s.HandleFunc("/analysis", service.fetchAnalysisStatus).Methods("GET")
+	s.HandleFunc("/analysis/{id}", service.fetchAnalysisJob).Methods("GET")
+	s.HandleFunc("/backfills", service.handleBackfillCreation).Methods("POST")
+	s.HandleFunc("/backfills", service.handleBackfillListing).Methods("GET")
+	s.HandleFunc("/backfills/{id}", service.fetchBackfill).Methods("GET")
 
 	http.Handle("/", r)
 }
@@ -37,13 +61,99 @@ func (service *ImageService) handleLinkCreation(w http.ResponseWriter, r *http.R
 	}
 
 	resp, err := service.CreateUploadLink(req)
+	if err == errDataUnavailable {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+	} else {
+		respondJSON(w, resp)
+	}
+}
+
+func (service *ImageService) handleLinkListing(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, perPage := 1, defaultLinksPerPage
+	var err error
+
+	if value := query.Get("page"); value != "" {
+		page, err = strconv.Atoi(value)
+	}
+
+	if value := query.Get("perPage"); value != "" && err == nil {
+		perPage, err = strconv.Atoi(value)
+	}
+
 	if err != nil {
+		respondError(w, errInvalidPage.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := service.ListUploadLinks(query.Get("status"), page, perPage)
+	if err == errDataUnavailable {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
 		respondError(w, err.Error(), http.StatusBadRequest)
 	} else {
 		respondJSON(w, resp)
 	}
 }
 
+func (service *ImageService) fetchLinkDetails(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	details, err := service.GetUploadLink(vars["id"])
+	if err == errUnknownLink {
+		respondError(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		respondJSON(w, details)
+	}
+}
+
+func (service *ImageService) handleLinkUpdate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req LinkUpdateRequest
+	err := acceptJSON(w, r, &req)
+	if err != nil {
+		return
+	}
+
+	details, err := service.UpdateUploadLinkExpiry(vars["id"], req)
+	if err == errUnknownLink {
+		respondError(w, err.Error(), http.StatusNotFound)
+	} else if err == errDataUnavailable {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+	} else {
+		respondJSON(w, details)
+	}
+}
+
+func (service *ImageService) handleLinkRevocation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := service.RevokeUploadLink(vars["id"])
+	if err == errUnknownLink {
+		respondError(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (service *ImageService) fetchLinkUploads(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	resp, err := service.GetLinkUploads(vars["id"])
+	if err == errUnknownLink {
+		respondError(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		respondJSON(w, resp)
+	}
+}
+
 func (service *ImageService) handleImageUpload(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	uploadID := vars["id"]
@@ -56,32 +166,289 @@ func (service *ImageService) handleImageUpload(w http.ResponseWriter, r *http.Re
 	resp, code := service.StreamImagesToBackend(uploadID, reader)
 	if code == streamInvalidUploadID {
 		http.Error(w, "404 page not found", http.StatusNotFound)
+	} else if code == streamInactiveUploadID {
+		respondError(w, "Upload link is not active yet.", http.StatusForbidden)
+	} else if code == streamInsufficientStorage {
+		// Parts which have been processed so far are still reported.
+		respondJSONWithStatus(w, resp, http.StatusInsufficientStorage)
+	} else if code == streamOverloaded {
+		w.Header().Set(headerRetryAfter, strconv.Itoa(retryAfterSeconds))
+		respondError(w, errServiceOverloaded.Error(), http.StatusServiceUnavailable)
+	} else if code == streamUnavailable {
+		// Parts which have been processed so far are still reported.
+		respondJSONWithStatus(w, resp, http.StatusServiceUnavailable)
+	} else if code == streamFailure {
+		respondJSONWithStatus(w, resp, http.StatusInternalServerError)
 	} else {
-		respondJSON(w, resp)
+		respondJSONWithStatus(w, resp, uploadStatus(resp))
 	}
 }
 
+// uploadStatus code for the given response, so that clients can figure out
+// whether they need to retry some (or all) of the parts.
+func uploadStatus(resp *ImageUploadResponse) int {
+	var failed, rejected int
+	for _, part := range resp.Rejected {
+		if part.Status == partFailed {
+			failed++
+		} else {
+			rejected++
+		}
+	}
+
+	if failed == 0 && rejected == 0 {
+		return http.StatusOK
+	} else if len(resp.Processed) > 0 || (failed > 0 && rejected > 0) {
+		return http.StatusMultiStatus
+	} else if failed > 0 {
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusUnprocessableEntity
+}
+
 func (service *ImageService) fetchImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	service.streamImage(vars["id"], r, w)
+}
+
+// fetchSignedImage for the bridge, which is served only if the URL has been signed
+// (see `signImageURL`), so that this path can be exposed to the processor even if
+// `/images` isn't.
+func (service *ImageService) fetchSignedImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	imageID := vars["id"]
+	if !verifyImageSignature(imageID, r.URL.Query(), service.signingKey, time.Now()) {
+		respondError(w, errInvalidSignature.Error(), http.StatusForbidden)
+		return
+	}
+
+	service.streamImage(imageID, r, w)
+}
 
-	code := service.StreamImageFromBackend(imageID, w.Header(), w)
+// streamImage with the given ID for the given request.
+func (service *ImageService) streamImage(imageID string, r *http.Request, w http.ResponseWriter) {
+	code := service.StreamImageFromBackend(imageID, r.URL.Query(), r.Header, w)
 	if code == streamInvalidImage {
 		respondError(w, "Invalid image ID", http.StatusNotFound)
+	} else if code == streamBrokenImage {
+		respondError(w, errBrokenImage.Error(), http.StatusGone)
+	} else if code == streamNotModified {
+		w.WriteHeader(http.StatusNotModified)
+	} else if code == streamInvalidRange {
+		respondError(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+	} else if code == streamInvalidVariant {
+		respondError(w, "Invalid width, height, fit, quality, format or preset for image", http.StatusBadRequest)
+	} else if code == streamNotAcceptable {
+		respondError(w, "None of the acceptable media types can be served for image", http.StatusNotAcceptable)
+	} else if code == streamUnsupportedImage {
+		respondError(w, "Image format does not support variants", http.StatusUnsupportedMediaType)
+	} else if code == streamImageTooLarge {
+		respondError(w, errImageTooLarge.Error(), http.StatusUnprocessableEntity)
+	} else if code == streamUnavailable {
+		respondError(w, errDataUnavailable.Error(), http.StatusServiceUnavailable)
 	} else if code == streamFailure {
 		respondError(w, "Unable to stream image", http.StatusInternalServerError)
 	}
 }
 
 func (service *ImageService) fetchStats(w http.ResponseWriter, r *http.Request) {
-	stats := service.data.fetchStats()
-	if stats == nil {
+	stats, err := service.data.fetchStats()
+	if err != nil {
+		respondError(w, errDataUnavailable.Error(), http.StatusServiceUnavailable)
+	} else if stats == nil {
 		respondError(w, "Error collecting stats", http.StatusInternalServerError)
 	} else {
 		respondJSON(w, *stats)
 	}
 }
 
+func (service *ImageService) fetchAnalysisStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := service.GetAnalysisStatus()
+	if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		respondJSON(w, *status)
+	}
+}
+
+func (service *ImageService) fetchAnalysisJob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	job, err := service.GetAnalysisJob(vars["id"])
+	if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if job == nil {
+		respondError(w, "Analysis job does not exist for image", http.StatusNotFound)
+	} else {
+		respondJSON(w, job)
+	}
+}
+
+func (service *ImageService) handleBackfillCreation(w http.ResponseWriter, r *http.Request) {
+	var req BackfillRequest
+	err := acceptJSON(w, r, &req)
+	if err != nil {
+		return
+	}
+
+	backfill, err := service.StartBackfill(req)
+	if err == errDataUnavailable {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+	} else {
+		respondJSONWithStatus(w, backfill, http.StatusAccepted)
+	}
+}
+
+func (service *ImageService) handleBackfillListing(w http.ResponseWriter, r *http.Request) {
+	backfills, err := service.ListBackfills()
+	if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else {
+		respondJSON(w, backfills)
+	}
+}
+
+func (service *ImageService) fetchBackfill(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	backfill, err := service.GetBackfill(vars["id"])
+	if err != nil {
+		respondError(w, err.Error(), http.StatusServiceUnavailable)
+	} else if backfill == nil {
+		respondError(w, "Backfill does not exist", http.StatusNotFound)
+	} else {
+		respondJSON(w, backfill)
+	}
+}
+
+func (service *ImageService) handleTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headerTusVersion, tusVersion)
+	w.Header().Set(headerTusExtension, tusExtensions)
+	w.Header().Set(headerTusMaxSize, strconv.FormatUint(uint64(service.tusMaxSize), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *ImageService) handleTusCreation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	length, err := strconv.ParseUint(r.Header.Get(headerUploadLength), 10, 64)
+	if err != nil {
+		respondError(w, "Invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get(headerUploadMetadata))
+	if err != nil {
+		respondError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	upload, err := service.CreateTusUpload(vars["id"], uint(length), metadata)
+	if err == errServiceOverloaded {
+		w.Header().Set(headerRetryAfter, strconv.Itoa(retryAfterSeconds))
+	}
+
+	if err != nil {
+		respondError(w, err.Error(), tusErrorStatus(err))
+		return
+	}
+
+	w.Header().Set(headerLocation, fmt.Sprintf("%s/%s/tus/%s", service.uploadLinkPrefix, vars["id"], upload.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (service *ImageService) fetchTusOffset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	upload := service.GetTusUpload(vars["id"], vars["upload"])
+	if upload == nil {
+		// HEAD responses don't have a body.
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set(headerUploadOffset, strconv.FormatUint(uint64(upload.Offset), 10))
+	w.Header().Set(headerUploadLength, strconv.FormatUint(uint64(upload.Length), 10))
+	w.Header().Set(headerCacheControl, "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (service *ImageService) handleTusAppend(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if r.Header.Get(headerContentType) != tusOffsetMediaType {
+		respondError(w, fmt.Sprintf("Content-Type must be %s", tusOffsetMediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseUint(r.Header.Get(headerUploadOffset), 10, 64)
+	if err != nil {
+		respondError(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	upload, processed, err := service.AppendTusUpload(vars["id"], vars["upload"], uint(offset), r.Body)
+	if err != nil {
+		respondError(w, err.Error(), tusErrorStatus(err))
+		return
+	}
+
+	w.Header().Set(headerUploadOffset, strconv.FormatUint(uint64(upload.Offset), 10))
+	if processed != nil {
+		// Image ID may be different if this is a duplicate.
+		w.Header().Set(headerImageID, processed.ID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (service *ImageService) handleTusTermination(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := service.TerminateTusUpload(vars["id"], vars["upload"])
+	if err != nil {
+		respondError(w, err.Error(), tusErrorStatus(err))
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// tusErrorStatus returns the status code for errors from resumable uploads.
+func tusErrorStatus(err error) int {
+	switch err {
+	case errUnknownLink, errUnknownUpload:
+		return http.StatusNotFound
+	case errInactiveLink, errImageLimitReached:
+		return http.StatusForbidden
+	case errNotAnImage, errInvalidMetadata:
+		return http.StatusBadRequest
+	case errMediaTypeNotAllowed, errNotImageContent:
+		return http.StatusUnsupportedMediaType
+	case errFileTooLarge, errByteLimitReached:
+		return http.StatusRequestEntityTooLarge
+	case errUploadOffsetMismatch:
+		return http.StatusConflict
+	case errUploadBusy:
+		return http.StatusLocked
+	case errInsufficientStorage:
+		return http.StatusInsufficientStorage
+	case errServiceOverloaded, errDataUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// tusMiddleware checks the protocol version for resumable uploads.
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(headerTusResumable, tusVersion)
+		if r.Method != http.MethodOptions && r.Header.Get(headerTusResumable) != tusVersion {
+			w.Header().Set(headerTusVersion, tusVersion)
+			respondError(w, "Unsupported version of tus protocol", http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // AuthMiddleware for securing some endpoints.
 type AuthMiddleware struct {
 	accessToken string
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+// newTestRepos creates the data repository (using the memory store) and the objects
+// repository (using a file store in a temporary directory, which is removed once the
+// test is done). Commands for the data repository are already being handled.
+func newTestRepos(t testing.TB) (*DataRepository, *ObjectsRepository) {
+	t.Setenv(envDataStore, "memory://")
+	t.Setenv(envStorePath, t.TempDir())
+	t.Setenv(envS3Region, "")
+	t.Setenv(envS3Bucket, "")
+
+	data, err := NewDataRepository(defaultLinkCacheCapacity, defaultMetaCacheCapacity, defaultHashesCacheCapacity, DBPoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// It's fine if all those goroutines keep blocking - they're efficient,
+	// and they'll be killed when the program ends.
+	go data.handleCommands()
+
+	objects, err := NewObjectsRepository(data, defaultVariantsCapacity, defaultMaxWrites, defaultMaxDecodes, AnalysisConfig{
+		Workers:   1,
+		QueueSize: 16,
+		Policy:    queuePolicySpill,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data, objects
+}
+
+// createService using the test repositories.
+func createService(t testing.TB) *ImageService {
+	data, objects := newTestRepos(t)
+	return &ImageService{
+		accessToken:      "foobar",
+		uploadLinkPrefix: "/booya",
+		data:             data,
+		objects:          objects,
+		presets:          map[string]VariantParams{"thumb": {Width: 16, Height: 16, Fit: fitCover, Quality: 80}},
+		tusMaxSize:       defaultTusMaxSize,
+		tusIdleTimeout:   defaultTusIdleTimeout,
+	}
+}
+
+// storeDir of the file store used by the given service.
+func storeDir(service *ImageService) string {
+	return service.objects.objectStore.(*FileStore).pathPrefix
+}
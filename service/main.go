@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"time"
@@ -13,32 +12,146 @@ import (
 const (
 	envAccessToken = "ACCESS_TOKEN"
 	envStorePath   = "STORE_PATH"
+	envDataStore   = "DATA_STORE"
 	envPostgresURL = "POSTGRES_URL"
+	envS3Region    = "S3_REGION"
+	envS3Bucket    = "S3_BUCKET"
+	envS3Endpoint  = "S3_ENDPOINT"
+
+	envAWSAccessKey = "AWS_ACCESS_KEY_ID"
+	envAWSSecretKey = "AWS_SECRET_ACCESS_KEY"
 
 	defaultBufSize             = 512
+	uploadBufSize              = 32 * 1024
+	defaultMaxWrites           = 64
+	defaultMaxDecodes          = 4
+	defaultDBMaxConns          = 20
+	defaultDBMaxIdleConns      = 5
+	defaultDBConnLifetime      = 5 * time.Minute
+	dbMaxRetries               = 5
+	dbRetryBaseDelay           = 50 * time.Millisecond
+	dbMaxRetryDelay            = 2 * time.Second
+	analysisBatchSize          = 50
+	analysisPollInterval       = 10 * time.Second
+	analysisJobTimeout         = 5 * time.Minute
+	maxAnalysisAttempts        = 5
+	analysisRetryBaseDelay     = 5 * time.Second
+	analysisMaxRetryDelay      = 10 * time.Minute
+	defaultAnalysisWorkers     = 4
+	defaultAnalysisQueueSize   = 256
+	defaultAnalysisQueuePolicy = queuePolicySpill
+	retryAfterSeconds          = 30
+	defaultBackfillRate        = 10
+	maxBackfillRate            = 1000
+	backfillBatchSize          = 100
+	backfillPollInterval       = time.Second
+	backfillIDLength           = 24
+	defaultBridgeName          = "bridge"
+	defaultBridgeTimeout       = 30 * time.Second
+	defaultBridgeRetries       = 2
+	defaultBridgeConcurrency   = 4
+	defaultBridgeFetchTTL      = 15 * time.Minute
+	bridgeSigningKeyLength     = 32
+	bridgeRetryBaseDelay       = 500 * time.Millisecond
+	bridgeMaxRetryDelay        = 10 * time.Second
+	maxBridgeResponseBytes     = 1024 * 1024
+	defaultPluginMemory        = 64 * 1024 * 1024
+	defaultPluginTimeout       = 10 * time.Second
+	pluginExtension            = ".wasm"
+	wasmPageSize               = 64 * 1024
+	sniffLength                = 512
+	unknownCameraModel         = "unknown"
+	defaultTusMaxSize          = 1024 * 1024 * 1024
+	defaultTusIdleTimeout      = time.Hour
+	tusExpiryInterval          = time.Minute
 	defaultPort                = 3000
 	defaultLinkCacheCapacity   = 1000
 	defaultMetaCacheCapacity   = 250
 	defaultHashesCacheCapacity = 1000
+	defaultVariantsCapacity    = 256 * 1024 * 1024
+	defaultVariantPresets      = "thumbnail=256x256:cover,preview=1280x1280:contain"
+	defaultVariantQuality      = 85
+	maxVariantDimension        = 4096
+	maxDecodePixels            = 50 * 1000 * 1000
+	variantStagingSuffixLength = 8
 	defaultStorePath           = "./store"
 	defaultUploadLinkPrefix    = "/uploads"
+	defaultLinksPerPage        = 50
+	maxLinksPerPage            = 500
 	minExpirySeconds           = 30
 	uploadLinkIDLength         = 48
 	imageIDLength              = 48
 
-	headerAccessToken = "X-Access-Token"
-	headerContentType = "Content-Type"
-	imageMediaType    = "image/"
+	linkStatusActive  = "active"
+	linkStatusExpired = "expired"
+
+	headerAccessToken     = "X-Access-Token"
+	headerContentType     = "Content-Type"
+	headerContentLength   = "Content-Length"
+	headerContentRange    = "Content-Range"
+	headerAcceptRanges    = "Accept-Ranges"
+	headerRange           = "Range"
+	headerIfRange         = "If-Range"
+	headerETag            = "ETag"
+	headerLastModified    = "Last-Modified"
+	headerIfNoneMatch     = "If-None-Match"
+	headerIfModifiedSince = "If-Modified-Since"
+	headerAccept          = "Accept"
+	headerRetryAfter      = "Retry-After"
+	headerVary            = "Vary"
+	imageMediaType        = "image/"
+	paramExpires          = "expires"
+	paramSignature        = "signature"
+	maxByteRanges         = 16
 )
 
 func main() {
-	// Seed PRNG as we use it for generating upload links.
-	rand.Seed(time.Now().UnixNano())
-
 	portPtr := flag.Uint("port", defaultPort, "Listening port")
 	linksCacheCapPtr := flag.Uint("cache-links", defaultLinkCacheCapacity, "Cache capacity for upload links")
 	metaCacheCapPtr := flag.Uint("cache-meta", defaultLinkCacheCapacity, "Cache capacity for image metadata")
 	hashesCacheCapPtr := flag.Uint("cache-hashes", defaultHashesCacheCapacity, "Cache capacity for image hashes")
+	variantsCapPtr := flag.Uint("cache-variants", defaultVariantsCapacity, "Capacity (in bytes) for stored image variants")
+	maxWritesPtr := flag.Uint("max-writes", defaultMaxWrites, "Maximum number of concurrent writes to the object store")
+	maxDecodesPtr := flag.Uint("max-decodes", defaultMaxDecodes, "Maximum number of images decoded concurrently (for creating variants)")
+	dbMaxConnsPtr := flag.Int("db-max-conns", defaultDBMaxConns, "Maximum number of open database connections (zero means no limit)")
+	dbMaxIdlePtr := flag.Int("db-max-idle", defaultDBMaxIdleConns, "Maximum number of idle database connections")
+	dbConnLifetimePtr := flag.Duration("db-conn-lifetime", defaultDBConnLifetime, "Maximum amount of time a database connection may be reused")
+	analysisWorkersPtr := flag.Int("analysis-workers", defaultAnalysisWorkers, "Number of workers analyzing images concurrently")
+	analysisQueuePtr := flag.Int("analysis-queue", defaultAnalysisQueueSize, "Maximum number of images waiting for an analysis worker")
+	analysisPolicyPtr := flag.String("analysis-queue-policy", defaultAnalysisQueuePolicy, "Policy when the analysis queue is full (block, shed or spill)")
+	bridgeURLPtr := flag.String("bridge-url", "", "Endpoint of an external processor for analyzing images (empty for none)")
+	bridgeNamePtr := flag.String("bridge-name", defaultBridgeName, "Name of the external processor (namespace of its results)")
+	bridgeFetchBasePtr := flag.String("bridge-fetch-base", "", "Base URL of this service, for sending image URLs instead of their content")
+	bridgeSigningKeyPtr := flag.String("bridge-signing-key", "", "Key for signing the image URLs sent to the external processor (random if empty, which doesn't work across instances)")
+	bridgeFetchTTLPtr := flag.Duration("bridge-fetch-ttl", defaultBridgeFetchTTL, "Amount of time for which the image URLs sent to the external processor are valid")
+	bridgeTimeoutPtr := flag.Duration("bridge-timeout", defaultBridgeTimeout, "Timeout for each request to the external processor")
+	bridgeRetriesPtr := flag.Int("bridge-retries", defaultBridgeRetries, "Number of retries for failed requests to the external processor")
+	bridgeConcurrencyPtr := flag.Int("bridge-concurrency", defaultBridgeConcurrency, "Maximum number of concurrent requests to the external processor")
+	bridgeSchemaPtr := flag.String("bridge-schema", "", "Required fields in responses from the external processor (comma-separated field:type)")
+	pluginsDirPtr := flag.String("plugins-dir", "", "Directory with WebAssembly modules for analyzing images (empty for none)")
+	pluginMemoryPtr := flag.Uint("plugin-memory", defaultPluginMemory, "Maximum memory (in bytes) for each invocation of a plugin")
+	pluginTimeoutPtr := flag.Duration("plugin-timeout", defaultPluginTimeout, "Timeout for each invocation of a plugin")
+	tusMaxSizePtr := flag.Uint("tus-max-size", defaultTusMaxSize, "Maximum size (in bytes) of resumable uploads")
+	tusIdleTimeoutPtr := flag.Duration("tus-idle-timeout", defaultTusIdleTimeout, "Amount of time after which idle resumable uploads are removed")
+	presetsPtr := flag.String("presets", defaultVariantPresets, "Image variant presets (comma-separated name=WxH[:fit[:quality]])")
+	flag.Parse()
+
+	pool := DBPoolConfig{
+		MaxOpen:     *dbMaxConnsPtr,
+		MaxIdle:     *dbMaxIdlePtr,
+		MaxLifetime: *dbConnLifetimePtr,
+	}
+
+	// `migrate [version]` only migrates the schema of the data store (without serving).
+	if flag.Arg(0) == "migrate" {
+		err := runMigrateCommand(flag.Args()[1:], pool)
+		if err != nil {
+			fmt.Printf("Error migrating data store: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
 
 	token := os.Getenv(envAccessToken)
 	if token == "" {
@@ -46,29 +159,104 @@ func main() {
 		os.Exit(1)
 	}
 
-	dataRepo, err := NewDataRepository(int(*linksCacheCapPtr), int(*metaCacheCapPtr), int(*hashesCacheCapPtr))
+	// `backfill [flags]` asks the running service to reanalyze its images.
+	if flag.Arg(0) == "backfill" {
+		err := runBackfillCommand(flag.Args()[1:], fmt.Sprintf("http://localhost:%d", *portPtr), token)
+		if err != nil {
+			fmt.Printf("Error running backfill: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	dataRepo, err := NewDataRepository(int(*linksCacheCapPtr), int(*metaCacheCapPtr), int(*hashesCacheCapPtr), pool)
 	if err != nil {
 		fmt.Printf("Error initializing data repository: %s", err.Error())
 		os.Exit(1)
 	}
 
-	objectsRepo, err := NewObjectsRepository(dataRepo)
+	presets, err := parsePresets(*presetsPtr)
+	if err != nil {
+		fmt.Printf("Error parsing image presets: %s", err.Error())
+		os.Exit(1)
+	}
+
+	analysis := AnalysisConfig{
+		Workers:   *analysisWorkersPtr,
+		QueueSize: *analysisQueuePtr,
+		Policy:    *analysisPolicyPtr,
+	}
+
+	objectsRepo, err := NewObjectsRepository(dataRepo, *variantsCapPtr, *maxWritesPtr, *maxDecodesPtr, analysis)
 	if err != nil {
 		fmt.Printf("Error initializing objects repository: %s", err.Error())
 		os.Exit(1)
 	}
 
+	// Image URLs sent to the bridge are signed with their own key (which is never the
+	// access token, since it's shared with the processor, in effect).
+	signingKey := []byte(*bridgeSigningKeyPtr)
+	if len(signingKey) == 0 {
+		signingKey = []byte(randomAlphanumeric(bridgeSigningKeyLength))
+	}
+
+	if *bridgeURLPtr != "" {
+		bridge, err := newHTTPAnalyzer(HTTPAnalyzerConfig{
+			Name:        *bridgeNamePtr,
+			URL:         *bridgeURLPtr,
+			FetchBase:   *bridgeFetchBasePtr,
+			FetchTTL:    *bridgeFetchTTLPtr,
+			SigningKey:  signingKey,
+			Timeout:     *bridgeTimeoutPtr,
+			Retries:     *bridgeRetriesPtr,
+			Concurrency: *bridgeConcurrencyPtr,
+			Schema:      *bridgeSchemaPtr,
+		})
+
+		if err == nil {
+			err = objectsRepo.registerAnalyzers(bridge)
+		}
+
+		if err != nil {
+			fmt.Printf("Error initializing bridge for analyzing images: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if *pluginsDirPtr != "" {
+		plugins, err := loadPlugins(PluginConfig{
+			Dir:         *pluginsDirPtr,
+			MemoryLimit: *pluginMemoryPtr,
+			Timeout:     *pluginTimeoutPtr,
+		})
+
+		if err == nil {
+			err = objectsRepo.registerAnalyzers(plugins...)
+		}
+
+		if err != nil {
+			fmt.Printf("Error initializing plugins for analyzing images: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	go dataRepo.handleCommands()   // for processing API commands.
-	go objectsRepo.processChunks() // for streaming images back and forth.
-	go objectsRepo.processImages() // for processing stored images one by one.
+	go objectsRepo.processChunks() // for streaming images from the store.
+	go objectsRepo.processImages() // for dispatching stored images to the analysis workers.
 
 	service := &ImageService{
 		accessToken:      token,
+		signingKey:       signingKey,
 		data:             dataRepo,
 		objects:          objectsRepo,
 		uploadLinkPrefix: defaultUploadLinkPrefix,
+		presets:          presets,
+		tusMaxSize:       *tusMaxSizePtr,
+		tusIdleTimeout:   *tusIdleTimeoutPtr,
 	}
 	service.registerRoutes()
+	go service.expireTusUploads() // for removing idle (or expired) resumable uploads.
 
 	log.Printf("Listening on port %d\n", *portPtr)
 	http.ListenAndServe(fmt.Sprintf(":%d", *portPtr), nil)
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, which is useful for single-node
+// deployments (where it's fine to lose the data on restart) and for testing.
+// This is safe for concurrent use.
+type MemoryStore struct {
+	lock  sync.RWMutex
+	links map[string]UploadLink
+	// Uploads for each link, in the order in which they were added.
+	linkUploads  map[string][]LinkUpload
+	lastUploadID uint
+	metas        map[string]ImageMeta
+	// Image IDs for hashes.
+	hashes map[string]string
+	// Analysis jobs for image IDs.
+	jobs map[string]AnalysisJob
+	// Image IDs of the analysis jobs in each state.
+	jobStates map[string]map[string]struct{}
+	backfills map[string]Backfill
+	variants  map[string]ImageVariant
+}
+
+// NewMemoryStore for keeping data in memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		links:       make(map[string]UploadLink),
+		linkUploads: make(map[string][]LinkUpload),
+		metas:       make(map[string]ImageMeta),
+		hashes:      make(map[string]string),
+		jobs:        make(map[string]AnalysisJob),
+		jobStates:   make(map[string]map[string]struct{}),
+		backfills:   make(map[string]Backfill),
+		variants:    make(map[string]ImageVariant),
+	}
+}
+
+// MARK: `DataStore` interface methods.
+
+func (s *MemoryStore) initialize() error {
+	return nil
+}
+
+func (s *MemoryStore) addUploadID(id string, expiry time.Time, policy LinkPolicy) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.links[id] = UploadLink{
+		ID:     id,
+		Expiry: expiry,
+		Policy: policy,
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) getUploadLink(id string) (*UploadLink, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	link, exists := s.links[id]
+	if !exists {
+		return nil, errNotFound
+	}
+
+	return &link, nil
+}
+
+func (s *MemoryStore) updateUploadLink(link UploadLink) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.links[link.ID] = link
+	return nil
+}
+
+func (s *MemoryStore) listUploadLinks(filter LinkFilter) (*LinkList, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	links := make([]UploadLink, 0, len(s.links))
+	for _, link := range s.links {
+		links = append(links, link)
+	}
+
+	return filterLinks(links, filter), nil
+}
+
+func (s *MemoryStore) addLinkUpload(upload LinkUpload) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.lastUploadID++
+	upload.ID = s.lastUploadID
+	s.linkUploads[upload.LinkID] = append(s.linkUploads[upload.LinkID], upload)
+	return nil
+}
+
+func (s *MemoryStore) fetchLinkUploads(linkID string) ([]LinkUpload, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	uploads := append([]LinkUpload{}, s.linkUploads[linkID]...)
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return uploads[i].Uploaded.Before(uploads[j].Uploaded)
+	})
+
+	return uploads, nil
+}
+
+func (s *MemoryStore) addImageMeta(meta ImageMeta) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id, exists := s.hashes[meta.Hash]; exists {
+		return id, nil
+	}
+
+	s.metas[meta.ID] = meta
+	s.hashes[meta.Hash] = meta.ID
+	return meta.ID, nil
+}
+
+func (s *MemoryStore) fetchImageMeta(id string) (*ImageMeta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	meta, exists := s.metas[id]
+	if !exists {
+		return nil, errNotFound
+	}
+
+	return &meta, nil
+}
+
+func (s *MemoryStore) fetchMetaForHash(hash string) (*ImageMeta, error) {
+	s.lock.RLock()
+	id, exists := s.hashes[hash]
+	s.lock.RUnlock()
+
+	if !exists {
+		return nil, errNotFound
+	}
+
+	return s.fetchImageMeta(id)
+}
+
+func (s *MemoryStore) updateImageMeta(meta ImageMeta) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, exists := s.metas[meta.ID]; exists && old.Hash != meta.Hash {
+		delete(s.hashes, old.Hash)
+	}
+
+	s.metas[meta.ID] = meta
+	s.hashes[meta.Hash] = meta.ID
+	return nil
+}
+
+func (s *MemoryStore) listImageMeta(offset, limit int) ([]ImageMeta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	metas := make([]ImageMeta, 0, len(s.metas))
+	for _, meta := range s.metas {
+		metas = append(metas, meta)
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].ID < metas[j].ID
+	})
+
+	start, end := pageBounds(len(metas), offset, limit)
+	return metas[start:end], nil
+}
+
+func (s *MemoryStore) listImagesAfter(id string, limit int) ([]ImageMeta, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	metas := []ImageMeta{}
+	for _, meta := range s.metas {
+		if meta.ID > id {
+			metas = append(metas, meta)
+		}
+	}
+
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].ID < metas[j].ID
+	})
+
+	_, end := pageBounds(len(metas), 0, limit)
+	return metas[:end], nil
+}
+
+func (s *MemoryStore) removeImageMeta(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if meta, exists := s.metas[id]; exists {
+		delete(s.hashes, meta.Hash)
+		delete(s.metas, id)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) getServiceStats() (*ServiceStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counter := newStatsCounter(time.Now())
+	for _, meta := range s.metas {
+		counter.add(meta)
+	}
+
+	return counter.stats(), nil
+}
+
+func (s *MemoryStore) saveAnalysisJob(job AnalysisJob) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if existing, exists := s.jobs[job.ImageID]; exists {
+		delete(s.jobStates[existing.State], job.ImageID)
+	}
+
+	if s.jobStates[job.State] == nil {
+		s.jobStates[job.State] = make(map[string]struct{})
+	}
+
+	s.jobs[job.ImageID] = job
+	s.jobStates[job.State][job.ImageID] = struct{}{}
+	return nil
+}
+
+func (s *MemoryStore) fetchAnalysisJob(imageID string) (*AnalysisJob, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	job, exists := s.jobs[imageID]
+	if !exists {
+		return nil, errNotFound
+	}
+
+	return &job, nil
+}
+
+func (s *MemoryStore) listAnalysisJobs(filter JobFilter) ([]AnalysisJob, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// Only the jobs in the given states are checked (most of them are usually done).
+	jobs := []AnalysisJob{}
+	for state, ids := range s.jobStates {
+		if len(filter.States) > 0 && !containsString(filter.States, state) {
+			continue
+		}
+
+		for id := range ids {
+			jobs = append(jobs, s.jobs[id])
+		}
+	}
+
+	return filterJobs(jobs, filter), nil
+}
+
+func (s *MemoryStore) countAnalysisJobs() (map[string]uint, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	counts := make(map[string]uint)
+	for state, ids := range s.jobStates {
+		if len(ids) > 0 {
+			counts[state] = uint(len(ids))
+		}
+	}
+
+	return counts, nil
+}
+
+func (s *MemoryStore) saveBackfill(backfill Backfill) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.backfills[backfill.ID] = backfill
+	return nil
+}
+
+func (s *MemoryStore) fetchBackfill(id string) (*Backfill, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	backfill, exists := s.backfills[id]
+	if !exists {
+		return nil, errNotFound
+	}
+
+	return &backfill, nil
+}
+
+func (s *MemoryStore) listBackfills() ([]Backfill, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	backfills := make([]Backfill, 0, len(s.backfills))
+	for _, backfill := range s.backfills {
+		backfills = append(backfills, backfill)
+	}
+
+	sortBackfills(backfills)
+	return backfills, nil
+}
+
+func (s *MemoryStore) saveVariant(variant ImageVariant) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.variants[variant.ID] = variant
+	return nil
+}
+
+func (s *MemoryStore) removeVariant(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.variants, id)
+	return nil
+}
+
+func (s *MemoryStore) listVariants() ([]ImageVariant, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	variants := make([]ImageVariant, 0, len(s.variants))
+	for _, variant := range s.variants {
+		variants = append(variants, variant)
+	}
+
+	sortVariants(variants)
+	return variants, nil
+}
+
+// MARK: Helpers for stores which can't filter or aggregate in queries.
+
+// sortVariants by their creation time (and then by their ID).
+func sortVariants(variants []ImageVariant) {
+	sort.Slice(variants, func(i, j int) bool {
+		if !variants[i].Created.Equal(variants[j].Created) {
+			return variants[i].Created.Before(variants[j].Created)
+		}
+
+		return variants[i].ID < variants[j].ID
+	})
+}
+
+// sortBackfills by their creation time (and then by their ID).
+func sortBackfills(backfills []Backfill) {
+	sort.Slice(backfills, func(i, j int) bool {
+		if !backfills[i].Created.Equal(backfills[j].Created) {
+			return backfills[i].Created.Before(backfills[j].Created)
+		}
+
+		return backfills[i].ID < backfills[j].ID
+	})
+}
+
+// filterLinks matching the given filter, ordered by expiry (latest first) and
+// paged using the filter's offset and limit.
+func filterLinks(links []UploadLink, filter LinkFilter) *LinkList {
+	matching := []UploadLink{}
+	for _, link := range links {
+		active := link.Expiry.After(filter.Now) && !link.Used
+		if (filter.Status == linkStatusActive && !active) || (filter.Status == linkStatusExpired && active) {
+			continue
+		}
+
+		matching = append(matching, link)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Expiry.Equal(matching[j].Expiry) {
+			return matching[i].ID < matching[j].ID
+		}
+
+		return matching[i].Expiry.After(matching[j].Expiry)
+	})
+
+	start, end := pageBounds(len(matching), filter.Offset, filter.Limit)
+	return &LinkList{
+		Links: matching[start:end],
+		Total: uint(len(matching)),
+	}
+}
+
+// filterJobs matching the given filter, ordered by their next attempt.
+func filterJobs(jobs []AnalysisJob, filter JobFilter) []AnalysisJob {
+	matching := []AnalysisJob{}
+	for _, job := range jobs {
+		if len(filter.States) > 0 && !containsString(filter.States, job.State) {
+			continue
+		}
+
+		if !filter.DueBy.IsZero() && job.NextAttempt.After(filter.DueBy) {
+			continue
+		}
+
+		matching = append(matching, job)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].NextAttempt.Equal(matching[j].NextAttempt) {
+			return matching[i].ImageID < matching[j].ImageID
+		}
+
+		return matching[i].NextAttempt.Before(matching[j].NextAttempt)
+	})
+
+	_, end := pageBounds(len(matching), 0, filter.Limit)
+	return matching[:end]
+}
+
+// statsCounter accumulates service stats from image metadata (in the same way
+// as the queries in `PostgreSQLStore`).
+type statsCounter struct {
+	formats map[string]uint
+	models  map[string]uint
+	days    map[time.Time]uint
+	// Images uploaded before this aren't counted for the daily uploads.
+	since time.Time
+}
+
+// newStatsCounter for daily uploads in the 30 days before the given time.
+func newStatsCounter(now time.Time) *statsCounter {
+	return &statsCounter{
+		formats: make(map[string]uint),
+		models:  make(map[string]uint),
+		days:    make(map[time.Time]uint),
+		since:   now.Add(-30 * 24 * time.Hour),
+	}
+}
+
+// add the given image metadata to the stats.
+func (c *statsCounter) add(meta ImageMeta) {
+	c.formats[meta.MediaType]++
+	c.models[meta.CameraModel]++
+	if meta.Uploaded.After(c.since) {
+		uploaded := meta.Uploaded.UTC()
+		c.days[time.Date(uploaded.Year(), uploaded.Month(), uploaded.Day(), 0, 0, 0, 0, time.UTC)]++
+	}
+}
+
+// stats from the metadata added so far.
+func (c *statsCounter) stats() *ServiceStats {
+	stats := ServiceStats{
+		PopularFormat:         PopularFormat{},
+		Top10CameraModels:     []CameraModel{},
+		UploadFrequency30Days: []DayFrequency{},
+	}
+
+	for _, count := range countsByUploads(c.formats, 1) {
+		stats.PopularFormat = PopularFormat{
+			Format:  strings.ToUpper(strings.TrimPrefix(count.name, imageMediaType)),
+			Uploads: count.uploads,
+		}
+	}
+
+	for _, count := range countsByUploads(c.models, 10) {
+		stats.Top10CameraModels = append(stats.Top10CameraModels, CameraModel{
+			Model:   count.name,
+			Uploads: count.uploads,
+		})
+	}
+
+	for day, uploads := range c.days {
+		stats.UploadFrequency30Days = append(stats.UploadFrequency30Days, DayFrequency{
+			Date:    day,
+			Uploads: uploads,
+		})
+	}
+
+	sort.Slice(stats.UploadFrequency30Days, func(i, j int) bool {
+		return stats.UploadFrequency30Days[i].Date.Before(stats.UploadFrequency30Days[j].Date)
+	})
+
+	return &stats
+}
+
+// uploadCount is the number of uploads for some name (format, camera model, etc.).
+type uploadCount struct {
+	name    string
+	uploads uint
+}
+
+// countsByUploads from the given counts, in descending order of uploads (at most the given limit).
+func countsByUploads(counts map[string]uint, limit int) []uploadCount {
+	sorted := make([]uploadCount, 0, len(counts))
+	for name, uploads := range counts {
+		sorted = append(sorted, uploadCount{name, uploads})
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].uploads == sorted[j].uploads {
+			return sorted[i].name < sorted[j].name
+		}
+
+		return sorted[i].uploads > sorted[j].uploads
+	})
+
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+
+	return sorted
+}
+
+// pageBounds in a list of the given length for the given offset and limit
+// (negative for no limit).
+func pageBounds(length, offset, limit int) (int, int) {
+	if offset > length {
+		offset = length
+	}
+
+	end := length
+	if limit >= 0 && offset+limit < length {
+		end = offset + limit
+	}
+
+	return offset, end
+}
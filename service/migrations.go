@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const (
+	// Row of the lock which is held while migrating (in `schema_migrations_lock`).
+	migrationLockID = 1
+	// Lock expires if it isn't renewed (before each step) for this long, so that an
+	// instance which crashed while migrating doesn't block the others forever.
+	migrationLockLease        = 15 * time.Minute
+	migrationLockPollInterval = time.Second
+	migrationLockHolderLength = 16
+)
+
+var (
+	errUnknownSchemaVersion = errors.New("Unknown schema version")
+	errInvalidMigrateArgs   = errors.New("Usage: migrate [version]")
+	errMigrationLockLost    = errors.New("Lock for migrating the schema has expired")
+)
+
+// migration is a versioned step in the database schema. Each step is applied
+// (or rolled back) along with its version in a single transaction.
+type migration struct {
+	version     int
+	description string
+	// Statements which change the data for this step. They're run in a transaction of
+	// their own before the step, since some databases (say, CockroachDB) can't have
+	// both writes and schema changes in a transaction, so they must be safe to repeat.
+	prepare []string
+	// Statements for applying this step.
+	up []string
+	// Statements for rolling back this step.
+	down []string
+}
+
+// migrations of the database schema, ordered by their version (starting from 1).
+// Steps must never be changed once they've been released - add new ones instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create tables for upload links, image metadata and link uploads",
+		// These match the tables which were created by gorm's `AutoMigrate` in the
+		// earlier versions, so that existing databases can be adopted. The oldest of
+		// those only had `upload_links (id, expiry)`, and `image_meta` without the link
+		// and filename, so the columns which came later are added if they're missing.
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS upload_links (
+				id text PRIMARY KEY,
+				expiry timestamp with time zone,
+				not_before timestamp with time zone,
+				max_images integer,
+				max_total_bytes integer,
+				max_file_bytes integer,
+				allowed_types text,
+				single_use boolean,
+				images integer,
+				bytes integer,
+				used boolean
+			)`,
+			`CREATE TABLE IF NOT EXISTS image_meta (
+				id text PRIMARY KEY,
+				hash text,
+				media_type text,
+				size integer,
+				uploaded timestamp with time zone,
+				camera_model text,
+				latitude numeric,
+				longitude numeric,
+				link_id text,
+				filename text
+			)`,
+			`CREATE TABLE IF NOT EXISTS link_uploads (
+				id serial PRIMARY KEY,
+				link_id text,
+				image_id text,
+				filename text,
+				hash text,
+				size integer,
+				duplicate boolean,
+				uploaded timestamp with time zone
+			)`,
+			`ALTER TABLE upload_links
+				ADD COLUMN IF NOT EXISTS not_before timestamp with time zone,
+				ADD COLUMN IF NOT EXISTS max_images integer,
+				ADD COLUMN IF NOT EXISTS max_total_bytes integer,
+				ADD COLUMN IF NOT EXISTS max_file_bytes integer,
+				ADD COLUMN IF NOT EXISTS allowed_types text,
+				ADD COLUMN IF NOT EXISTS single_use boolean,
+				ADD COLUMN IF NOT EXISTS images integer,
+				ADD COLUMN IF NOT EXISTS bytes integer,
+				ADD COLUMN IF NOT EXISTS used boolean`,
+			`ALTER TABLE image_meta
+				ADD COLUMN IF NOT EXISTS link_id text,
+				ADD COLUMN IF NOT EXISTS filename text`,
+			`CREATE INDEX IF NOT EXISTS idx_link_uploads_link_id ON link_uploads (link_id)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS link_uploads`,
+			`DROP TABLE IF EXISTS image_meta`,
+			`DROP TABLE IF EXISTS upload_links`,
+		},
+	},
+	{
+		version:     2,
+		description: "Add unique index on image hashes",
+		// Earlier versions could store the same image twice (when it was uploaded
+		// concurrently), so such duplicates are merged into the earliest image.
+		prepare: []string{
+			`UPDATE link_uploads SET image_id = images.first_id, duplicate = true
+				FROM (SELECT id, first_value(id) OVER (PARTITION BY hash ORDER BY uploaded, id) AS first_id
+					FROM image_meta WHERE hash IS NOT NULL) AS images
+				WHERE link_uploads.image_id = images.id AND images.id <> images.first_id`,
+			`DELETE FROM image_meta USING
+				(SELECT id, first_value(id) OVER (PARTITION BY hash ORDER BY uploaded, id) AS first_id
+					FROM image_meta WHERE hash IS NOT NULL) AS images
+				WHERE image_meta.id = images.id AND images.id <> images.first_id`,
+		},
+		up: []string{
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_image_meta_hash ON image_meta (hash)`,
+		},
+		down: []string{
+			`DROP INDEX IF EXISTS idx_image_meta_hash CASCADE`,
+		},
+	},
+	{
+		version:     3,
+		description: "Add indexes for stats queries",
+		up: []string{
+			`CREATE INDEX IF NOT EXISTS idx_image_meta_uploaded ON image_meta (uploaded)`,
+			`CREATE INDEX IF NOT EXISTS idx_image_meta_media_type ON image_meta (media_type)`,
+			`CREATE INDEX IF NOT EXISTS idx_image_meta_camera_model ON image_meta (camera_model)`,
+		},
+		down: []string{
+			`DROP INDEX IF EXISTS idx_image_meta_camera_model`,
+			`DROP INDEX IF EXISTS idx_image_meta_media_type`,
+			`DROP INDEX IF EXISTS idx_image_meta_uploaded`,
+		},
+	},
+	{
+		version:     4,
+		description: "Create table for analysis jobs",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS analysis_jobs (
+				image_id text PRIMARY KEY,
+				state text,
+				attempts integer,
+				last_error text,
+				next_attempt timestamp with time zone,
+				created timestamp with time zone,
+				updated timestamp with time zone
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_analysis_jobs_state_next_attempt ON analysis_jobs (state, next_attempt)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS analysis_jobs`,
+		},
+	},
+	{
+		version:     5,
+		description: "Create table for backfills",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS backfills (
+				id text PRIMARY KEY,
+				uploaded_after timestamp with time zone,
+				uploaded_before timestamp with time zone,
+				media_type text,
+				missing text,
+				rate double precision,
+				dry_run boolean,
+				state text,
+				last_image_id text,
+				scanned integer,
+				matched integer,
+				created timestamp with time zone,
+				updated timestamp with time zone
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS backfills`,
+		},
+	},
+	{
+		version:     6,
+		description: "Add analysis results to image metadata",
+		up: []string{
+			`ALTER TABLE image_meta ADD COLUMN IF NOT EXISTS analysis text`,
+		},
+		down: []string{
+			`ALTER TABLE image_meta DROP COLUMN IF EXISTS analysis`,
+		},
+	},
+	{
+		version:     7,
+		description: "Create table for image variants",
+		up: []string{
+			`CREATE TABLE IF NOT EXISTS image_variants (
+				id text PRIMARY KEY,
+				hash text,
+				media_type text,
+				size integer,
+				uploaded timestamp with time zone,
+				created timestamp with time zone
+			)`,
+		},
+		down: []string{
+			`DROP TABLE IF EXISTS image_variants`,
+		},
+	},
+	{
+		version:     8,
+		description: "Add flag for broken images",
+		up: []string{
+			`ALTER TABLE image_meta ADD COLUMN IF NOT EXISTS broken boolean DEFAULT false`,
+		},
+		down: []string{
+			`ALTER TABLE image_meta DROP COLUMN IF EXISTS broken`,
+		},
+	},
+	{
+		version:     9,
+		description: "Add failures of the analyzers to analysis jobs",
+		up: []string{
+			`ALTER TABLE analysis_jobs ADD COLUMN IF NOT EXISTS failures text`,
+		},
+		down: []string{
+			`ALTER TABLE analysis_jobs DROP COLUMN IF EXISTS failures`,
+		},
+	},
+}
+
+// latestSchemaVersion is the version after applying all the migrations.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaMigration records a migration which has been applied to the database.
+type schemaMigration struct {
+	Version     int `gorm:"primary_key;auto_increment:false"`
+	Description string
+	Applied     time.Time
+}
+
+// MARK: Running migrations.
+
+// migrateSchema of the given database to the given version (or the latest version,
+// if negative). Migrations are applied (or rolled back) one by one, and their versions
+// are tracked in the `schema_migrations` table. Concurrent migrations (say, when
+// several instances start at once) are serialized by a lock row, which is used instead
+// of advisory locks so that it also works on CockroachDB. Returns the version after
+// migrating.
+func migrateSchema(db *gorm.DB, target int) (int, error) {
+	if target < 0 {
+		target = latestSchemaVersion()
+	} else if target > latestSchemaVersion() {
+		return 0, errUnknownSchemaVersion
+	}
+
+	err := createMigrationTables(db)
+	if err != nil {
+		return 0, err
+	}
+
+	holder := randomAlphanumeric(migrationLockHolderLength)
+	err = acquireMigrationLock(db, holder)
+	if err != nil {
+		return 0, err
+	}
+
+	defer releaseMigrationLock(db, holder)
+	for {
+		acquired, err := renewMigrationLock(db, holder)
+		if err == nil && !acquired {
+			err = errMigrationLockLost
+		}
+
+		current := 0
+		if err == nil {
+			err = withRetry(func() error {
+				current, err = schemaVersion(db)
+				return err
+			})
+		}
+
+		if err != nil {
+			return current, err
+		}
+
+		step, up := nextMigration(current, target)
+		if step == nil {
+			return current, nil
+		} else if up {
+			log.Printf("Applying schema migration %d: %s\n", step.version, step.description)
+			if len(step.prepare) > 0 {
+				err = runTransaction(db, func(tx *gorm.DB) error {
+					return runMigration(tx, step.prepare, func() error { return nil })
+				})
+			}
+
+			if err == nil {
+				err = runTransaction(db, func(tx *gorm.DB) error {
+					return runMigration(tx, step.up, func() error {
+						return tx.Create(&schemaMigration{
+							Version:     step.version,
+							Description: step.description,
+							Applied:     time.Now().UTC(),
+						}).Error
+					})
+				})
+			}
+
+			if err != nil {
+				return current, fmt.Errorf("Migration %d failed: %s", step.version, err.Error())
+			}
+
+			continue
+		}
+
+		log.Printf("Rolling back schema migration %d: %s\n", step.version, step.description)
+		err = runTransaction(db, func(tx *gorm.DB) error {
+			return runMigration(tx, step.down, func() error {
+				return tx.Where("version = ?", step.version).Delete(&schemaMigration{}).Error
+			})
+		})
+		if err != nil {
+			return current, fmt.Errorf("Rollback of migration %d failed: %s", step.version, err.Error())
+		}
+	}
+}
+
+// nextMigration to apply (or roll back, if `up` is false) for getting from the current
+// version to the target version. Returns nil if we're already there.
+func nextMigration(current, target int) (step *migration, up bool) {
+	for i := range migrations {
+		if current < target && migrations[i].version == current+1 {
+			return &migrations[i], true
+		} else if current > target && migrations[i].version == current {
+			return &migrations[i], false
+		}
+	}
+
+	return nil, false
+}
+
+// schemaVersion of the given database (zero if no migrations have been applied).
+func schemaVersion(db *gorm.DB) (int, error) {
+	var result struct {
+		Version int
+	}
+
+	err := db.Raw("SELECT coalesce(max(version), 0) AS version FROM schema_migrations").Scan(&result).Error
+	return result.Version, err
+}
+
+// createMigrationTables (if they don't exist) for tracking the versions and for the
+// lock. Other instances may be creating them at the same time, which is fine.
+func createMigrationTables(db *gorm.DB) error {
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			description text,
+			applied timestamp with time zone
+		)`,
+		`CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+			id integer PRIMARY KEY,
+			holder text,
+			expires timestamp with time zone
+		)`,
+	} {
+		err := withRetry(func() error {
+			return db.Exec(statement).Error
+		})
+
+		// PostgreSQL reports a unique violation (or a duplicate table) if the table
+		// was created concurrently.
+		if e, ok := err.(*pq.Error); ok && (e.Code == "23505" || e.Code == "42P07") {
+			err = nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// acquireMigrationLock for the given holder, waiting until other instances are done
+// (or until their lock expires).
+func acquireMigrationLock(db *gorm.DB, holder string) error {
+	for waiting := false; ; waiting = true {
+		acquired, err := renewMigrationLock(db, holder)
+		if err != nil || acquired {
+			return err
+		}
+
+		if !waiting {
+			log.Println("Waiting for another instance to finish migrating the schema")
+		}
+
+		time.Sleep(migrationLockPollInterval)
+	}
+}
+
+// renewMigrationLock for the given holder, which takes the lock if it's free (or if
+// it has expired). Returns whether the given holder has the lock.
+func renewMigrationLock(db *gorm.DB, holder string) (bool, error) {
+	var rows int64
+	err := withRetry(func() error {
+		now := time.Now().UTC()
+		result := db.Exec(`INSERT INTO schema_migrations_lock (id, holder, expires) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET holder = excluded.holder, expires = excluded.expires
+			WHERE schema_migrations_lock.holder = excluded.holder OR schema_migrations_lock.expires < ?`,
+			migrationLockID, holder, now.Add(migrationLockLease), now)
+		rows = result.RowsAffected
+		return result.Error
+	})
+
+	return rows == 1, err
+}
+
+// releaseMigrationLock if it's held by the given holder.
+func releaseMigrationLock(db *gorm.DB, holder string) {
+	err := withRetry(func() error {
+		return db.Exec("DELETE FROM schema_migrations_lock WHERE id = ? AND holder = ?", migrationLockID, holder).Error
+	})
+
+	if err != nil {
+		// Others can take it once it expires.
+		log.Printf("Cannot release the lock for migrating the schema: %s\n", err.Error())
+	}
+}
+
+// runTransaction runs the given function in a transaction, which is retried on
+// transient errors.
+func runTransaction(db *gorm.DB, run func(tx *gorm.DB) error) error {
+	return withRetry(func() error {
+		tx := db.Begin()
+		if tx.Error != nil {
+			return tx.Error
+		}
+
+		err := run(tx)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		return tx.Commit().Error
+	})
+}
+
+// runMigration executes the given statements in the given transaction, and then
+// records the change using the given function.
+func runMigration(tx *gorm.DB, statements []string, record func() error) error {
+	for _, statement := range statements {
+		err := tx.Exec(statement).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return record()
+}
+
+// runMigrateCommand migrates the schema of the data store configured in the environment
+// (see `newDataStoreFromEnv`) to the version in the given arguments (or the latest
+// version, if there aren't any).
+func runMigrateCommand(args []string, pool DBPoolConfig) error {
+	target := -1
+	if len(args) > 1 {
+		return errInvalidMigrateArgs
+	} else if len(args) == 1 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil || version < 0 {
+			return errInvalidMigrateArgs
+		}
+
+		target = version
+	}
+
+	dataStore, err := newDataStoreFromEnv(pool)
+	if err != nil {
+		return err
+	}
+
+	store, ok := dataStore.(MigratableStore)
+	if !ok {
+		log.Println("Data store doesn't have a schema, so there's nothing to migrate.")
+		return nil
+	}
+
+	version, err := store.migrate(target)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Schema is at version %d (latest: %d)\n", version, latestSchemaVersion())
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // LinkCreationRequest for creating ephemeral links.
 type LinkCreationRequest struct {
@@ -8,12 +11,62 @@ type LinkCreationRequest struct {
 	Duration string `json:"sinceNow"`
 	// Timestamp in ISO 8601 (RFC 3339) format.
 	Timestamp string `json:"timeExact"`
+	// Timestamp (ISO 8601) before which the link cannot be used.
+	NotBefore string `json:"notBefore"`
+	// Maximum number of images that can be uploaded (zero means no limit).
+	MaxImages uint `json:"maxImages"`
+	// Maximum bytes that can be uploaded in total (zero means no limit).
+	MaxTotalBytes uint `json:"maxTotalBytes"`
+	// Maximum bytes for a single image (zero means no limit).
+	MaxFileBytes uint `json:"maxFileBytes"`
+	// Media types allowed for upload (say, `image/jpeg`). Empty means all images.
+	AllowedTypes []string `json:"allowedTypes"`
+	// Whether this link can be used only for a single upload request.
+	SingleUse bool `json:"singleUse"`
+}
+
+// LinkUpdateRequest for changing the expiry of ephemeral links.
+type LinkUpdateRequest struct {
+	// Duration (from now) in ISO 8601 duration format.
+	Duration string `json:"sinceNow"`
+	// Timestamp in ISO 8601 (RFC 3339) format.
+	Timestamp string `json:"timeExact"`
+}
+
+// LinkFilter for listing ephemeral links.
+type LinkFilter struct {
+	// Status of the links ("active", "expired" or empty for all).
+	Status string
+	Offset int
+	Limit  int
+	// Now is the time used for checking expiry.
+	Now time.Time
+}
+
+// LinkPolicy restricts the uploads through an ephemeral link.
+type LinkPolicy struct {
+	NotBefore     time.Time
+	MaxImages     uint
+	MaxTotalBytes uint
+	MaxFileBytes  uint
+	// Comma-separated list of allowed media types.
+	AllowedTypes string
+	SingleUse    bool
 }
 
 // UploadLink model for ephemeral upload links.
 type UploadLink struct {
 	ID     string
 	Expiry time.Time
+	Policy LinkPolicy `gorm:"embedded"`
+	// Number of images uploaded through this link so far (including the ones
+	// which are being uploaded right now).
+	Images uint
+	// Number of bytes uploaded through this link so far (including the ones
+	// which have been reserved by ongoing uploads).
+	Bytes uint
+	// Whether this link has been used (for single use links).
+	Used bool
 }
 
 // EphemeralLinkResponse for generated ephemeral links.
@@ -22,6 +75,41 @@ type EphemeralLinkResponse struct {
 	RelativePath string `json:"relativePath"`
 	// Timestamp after which this link expires.
 	Timestamp string `json:"expiresOn"`
+	// Timestamp before which this link cannot be used.
+	NotBefore string `json:"startsOn,omitempty"`
+}
+
+// LinkDetails for an ephemeral link along with its policy and usage.
+type LinkDetails struct {
+	ID            string   `json:"id"`
+	RelativePath  string   `json:"relativePath"`
+	Timestamp     string   `json:"expiresOn"`
+	NotBefore     string   `json:"startsOn,omitempty"`
+	Active        bool     `json:"active"`
+	MaxImages     uint     `json:"maxImages"`
+	MaxTotalBytes uint     `json:"maxTotalBytes"`
+	MaxFileBytes  uint     `json:"maxFileBytes"`
+	AllowedTypes  []string `json:"allowedTypes"`
+	SingleUse     bool     `json:"singleUse"`
+	// Usage of this link so far.
+	Images uint `json:"images"`
+	Bytes  uint `json:"bytes"`
+	Used   bool `json:"used"`
+}
+
+// LinkListResponse for a page of ephemeral links.
+type LinkListResponse struct {
+	Links   []LinkDetails `json:"links"`
+	Page    int           `json:"page"`
+	PerPage int           `json:"perPage"`
+	// Total number of links matching the filter.
+	Total uint `json:"total"`
+}
+
+// LinkList is a page of links along with the total matching the filter.
+type LinkList struct {
+	Links []UploadLink
+	Total uint
 }
 
 // ErrorResponse for the API.
@@ -29,17 +117,41 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// Statuses of the parts in an upload.
+const (
+	// Image has been stored.
+	partStored = "stored"
+	// Image is identical to an existing one, which is used instead.
+	partDuplicate = "duplicate"
+	// Part is not an image or it violates the link's policy.
+	partRejected = "rejected"
+	// Part couldn't be read or stored, so it can be retried.
+	partFailed = "failed"
+)
+
 // ProcessedImage from an upload.
 type ProcessedImage struct {
+	Field    string `json:"field,omitempty"`
 	Filename string `json:"name"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
 	ID       string `json:"id"`
 	Hash     string `json:"hash"`
 	Size     uint   `json:"size"`
 }
 
+// RejectedImage from an upload.
+type RejectedImage struct {
+	Field    string `json:"field,omitempty"`
+	Filename string `json:"name"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason"`
+}
+
 // ImageUploadResponse after uploading one or more images.
 type ImageUploadResponse struct {
 	Processed []ProcessedImage `json:"processed"`
+	Rejected  []RejectedImage  `json:"rejected"`
 }
 
 // ImageMeta for holding metadata for images.
@@ -52,6 +164,180 @@ type ImageMeta struct {
 	CameraModel string    `json:"cameraModel,omitempty"`
 	Latitude    float64   `json:"latitude"`
 	Longitude   float64   `json:"longitude"`
+	// LinkID of the ephemeral link through which this image was uploaded.
+	LinkID string `json:"linkId,omitempty"`
+	// Filename of the multipart upload.
+	Filename string `json:"name,omitempty"`
+	// Analysis results, namespaced by the analyzers.
+	Analysis AnalysisResults `json:"analysis,omitempty"`
+	// Broken is set by the store recovery if the object is missing, or if it doesn't
+	// match the size (it's cleared once the object is back).
+	Broken bool `json:"broken,omitempty"`
+}
+
+// ImageVariant stored in the object store. These are tracked in the data store, so
+// that the variant cache (and its capacity) survives restarts.
+type ImageVariant struct {
+	ID        string `gorm:"primary_key"`
+	Hash      string
+	MediaType string
+	Size      uint
+	// Uploaded time of the original image.
+	Uploaded time.Time
+	// Created time of this variant.
+	Created time.Time
+}
+
+// meta for serving this variant.
+func (v ImageVariant) meta() ImageMeta {
+	return ImageMeta{
+		ID:        v.ID,
+		Hash:      v.Hash,
+		MediaType: v.MediaType,
+		Size:      v.Size,
+		Uploaded:  v.Uploaded,
+	}
+}
+
+// LinkUpload records an image uploaded through some ephemeral link. Unlike
+// `ImageMeta`, this is also recorded for duplicates.
+type LinkUpload struct {
+	ID        uint      `json:"-" gorm:"primary_key"`
+	LinkID    string    `json:"-" gorm:"index"`
+	ImageID   string    `json:"id"`
+	Filename  string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Size      uint      `json:"size"`
+	Duplicate bool      `json:"duplicate"`
+	Uploaded  time.Time `json:"uploadedOn"`
+}
+
+// LinkUploadsResponse lists the images uploaded through an ephemeral link.
+type LinkUploadsResponse struct {
+	Images     []LinkUpload `json:"images"`
+	TotalBytes uint         `json:"totalBytes"`
+}
+
+// States of analysis jobs.
+const (
+	// Job is waiting for its (next) attempt.
+	jobPending = "pending"
+	// Job is being processed.
+	jobRunning = "running"
+	// Image has been analyzed.
+	jobDone = "done"
+	// Job has run out of attempts.
+	jobFailed = "failed"
+)
+
+// AnalysisJob for extracting additional metadata (EXIF, etc.) from a stored image.
+// Jobs are persisted, so that they survive restarts, and failed attempts are retried
+// with exponential backoff.
+type AnalysisJob struct {
+	ImageID string `json:"imageId" gorm:"primary_key"`
+	State   string `json:"state"`
+	// Number of attempts so far.
+	Attempts uint `json:"attempts"`
+	// Error from the last failed attempt.
+	LastError string `json:"lastError,omitempty"`
+	// Time at which the job is due (for pending jobs), or after which a running
+	// job is considered abandoned (say, because of a crash), so that it's retried.
+	NextAttempt time.Time `json:"nextAttempt"`
+	// Errors of the analyzers which failed in the last attempt (only those are run
+	// again in the next attempt).
+	Failures AnalyzerFailures `json:"failures,omitempty"`
+	Created  time.Time        `json:"createdOn"`
+	Updated  time.Time        `json:"updatedOn"`
+}
+
+// JobFilter for listing analysis jobs.
+type JobFilter struct {
+	// States of the jobs (empty for all jobs).
+	States []string
+	// Only jobs which are due by this time (zero for all jobs).
+	DueBy time.Time
+	// Maximum number of jobs (negative for no limit).
+	Limit int
+}
+
+// AnalysisStatus shows the number of analysis jobs in each state, along with the
+// queue of the analysis workers.
+type AnalysisStatus struct {
+	Pending uint                `json:"pending"`
+	Running uint                `json:"running"`
+	Done    uint                `json:"done"`
+	Failed  uint                `json:"failed"`
+	Queue   AnalysisQueueStatus `json:"queue"`
+}
+
+// AnalysisQueueStatus shows the jobs waiting for a worker, and the throughput of
+// each worker (since the service started).
+type AnalysisQueueStatus struct {
+	Policy   string                 `json:"policy"`
+	Depth    int                    `json:"depth"`
+	Capacity int                    `json:"capacity"`
+	Workers  []AnalysisWorkerStatus `json:"workers"`
+}
+
+// AnalysisWorkerStatus shows the jobs run by an analysis worker.
+type AnalysisWorkerStatus struct {
+	Jobs          uint64  `json:"jobs"`
+	Failed        uint64  `json:"failed"`
+	BusySeconds   float64 `json:"busySeconds"`
+	JobsPerSecond float64 `json:"jobsPerSecond"`
+}
+
+// States of backfills.
+const (
+	// Backfill is scanning the images.
+	backfillRunning = "running"
+	// All the images have been scanned.
+	backfillDone = "done"
+)
+
+// Fields which can be missing in the metadata of images (for backfills).
+const (
+	fieldCameraModel = "cameraModel"
+	fieldLocation    = "location"
+)
+
+// BackfillRequest for reanalyzing the images which have already been stored.
+type BackfillRequest struct {
+	// Only images uploaded after this timestamp (ISO 8601), if given.
+	UploadedAfter string `json:"uploadedAfter"`
+	// Only images uploaded before this timestamp (ISO 8601), if given.
+	UploadedBefore string `json:"uploadedBefore"`
+	// Only images of this media type (say, `image/jpeg`), if given.
+	MediaType string `json:"mediaType"`
+	// Only images missing this field ("cameraModel" or "location"), if given.
+	Missing string `json:"missing"`
+	// Maximum number of images queued for analysis per second (zero for the default).
+	Rate float64 `json:"rate"`
+	// Only count the matching images, without reanalyzing them.
+	DryRun bool `json:"dryRun"`
+}
+
+// Backfill reanalyzes the stored images which match its filter. Images are scanned
+// in the order of their IDs, and the progress is persisted, so that the backfill is
+// resumed from where it left off (say, after a restart).
+type Backfill struct {
+	ID             string    `json:"id" gorm:"primary_key"`
+	UploadedAfter  time.Time `json:"uploadedAfter"`
+	UploadedBefore time.Time `json:"uploadedBefore"`
+	MediaType      string    `json:"mediaType,omitempty"`
+	Missing        string    `json:"missing,omitempty"`
+	Rate           float64   `json:"rate"`
+	DryRun         bool      `json:"dryRun"`
+	State          string    `json:"state"`
+	// ID of the last image which has been scanned.
+	LastImageID string `json:"lastImageId,omitempty"`
+	// Number of images scanned so far.
+	Scanned uint `json:"scanned"`
+	// Number of images which have matched the filter (and queued for analysis,
+	// unless this is a dry run).
+	Matched uint      `json:"matched"`
+	Created time.Time `json:"createdOn"`
+	Updated time.Time `json:"updatedOn"`
 }
 
 // ServiceStats shows statistics for the service.
@@ -79,7 +365,99 @@ type DayFrequency struct {
 	Uploads uint      `json:"uploads"`
 }
 
-// applyDefaults for unknown metadata.
-func (m *ImageMeta) applyDefaults() {
-	m.CameraModel = "unknown"
+// matches checks whether the given image should be reanalyzed by this backfill.
+func (b *Backfill) matches(meta ImageMeta) bool {
+	// Broken images can't be read (see `FileStore.recover`).
+	if meta.Broken {
+		return false
+	}
+
+	if !b.UploadedAfter.IsZero() && !meta.Uploaded.After(b.UploadedAfter) {
+		return false
+	}
+
+	if !b.UploadedBefore.IsZero() && !meta.Uploaded.Before(b.UploadedBefore) {
+		return false
+	}
+
+	if b.MediaType != "" && meta.MediaType != b.MediaType {
+		return false
+	}
+
+	switch b.Missing {
+	case fieldCameraModel:
+		return meta.CameraModel == "" || meta.CameraModel == unknownCameraModel
+	case fieldLocation:
+		return meta.Latitude == 0 && meta.Longitude == 0
+	}
+
+	return true
+}
+
+// allowsType checks whether the given media type is allowed by this policy.
+func (p *LinkPolicy) allowsType(mediaType string) bool {
+	if p.AllowedTypes == "" {
+		return true
+	}
+
+	for _, ty := range strings.Split(p.AllowedTypes, ",") {
+		if ty == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPart before streaming it, given the link's usage so far.
+func (p *LinkPolicy) checkPart(mediaType string, link *UploadLink) error {
+	if !p.allowsType(mediaType) {
+		return errMediaTypeNotAllowed
+	}
+
+	if p.MaxImages > 0 && link.Images >= p.MaxImages {
+		return errImageLimitReached
+	}
+
+	return nil
+}
+
+// checkUsage of the given images and bytes on top of the link's usage so far.
+func (p *LinkPolicy) checkUsage(images, bytes uint, link *UploadLink) error {
+	if images > 0 && p.MaxImages > 0 && link.Images+images > p.MaxImages {
+		return errImageLimitReached
+	}
+
+	if bytes > 0 && p.MaxTotalBytes > 0 && link.Bytes+bytes > p.MaxTotalBytes {
+		return errByteLimitReached
+	}
+
+	return nil
+}
+
+// checkSize of a part whilst streaming it, given the link's usage so far.
+func (p *LinkPolicy) checkSize(partBytes uint, link *UploadLink) error {
+	if p.MaxFileBytes > 0 && partBytes > p.MaxFileBytes {
+		return errFileTooLarge
+	}
+
+	if p.MaxTotalBytes > 0 && link.Bytes+partBytes > p.MaxTotalBytes {
+		return errByteLimitReached
+	}
+
+	return nil
+}
+
+// releaseUsage of the given images and bytes (which have been reserved earlier).
+func (link *UploadLink) releaseUsage(images, bytes uint) {
+	if images > link.Images {
+		images = link.Images
+	}
+
+	if bytes > link.Bytes {
+		bytes = link.Bytes
+	}
+
+	link.Images -= images
+	link.Bytes -= bytes
 }
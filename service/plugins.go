@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	errInvalidPluginConfig = errors.New("Plugins need a memory limit of at least one page (64 KiB) and a positive timeout")
+	errInvalidPluginABI    = errors.New("Plugin must export 'memory', 'alloc(i32) -> i32' and 'analyze(i32, i32) -> i64'")
+	errPluginImageTooLarge = errors.New("Image is larger than the memory limit of the plugin")
+	errPluginMemoryAccess  = errors.New("Plugin has returned a buffer outside its memory")
+	errInvalidPluginResult = errors.New("Plugin result must be a JSON object")
+)
+
+// PluginConfig for loading analyzers from WebAssembly modules.
+type PluginConfig struct {
+	// Directory which has the modules (`{name}.wasm`, where the name is also the name
+	// of the analyzer). Empty for no plugins.
+	Dir string
+	// Maximum memory (in bytes) of each invocation, which is rounded down to pages.
+	MemoryLimit uint
+	// Timeout for each invocation.
+	Timeout time.Duration
+}
+
+// wasmAnalyzer runs a WebAssembly module for analyzing images. Modules are compiled
+// once, and they're instantiated for each image, so that each invocation has its own
+// memory (within the limit), and nothing leaks from one image to the next.
+//
+// Modules must export their `memory`, `alloc(size i32) -> i32` (which returns a buffer
+// of the given size in that memory) and `analyze(ptr i32, len i32) -> i64`. The image
+// is written into a buffer from `alloc`, and `analyze` returns the pointer to its JSON
+// result (in the upper 32 bits) and its length (in the lower 32 bits). WASI modules
+// are supported (as reactors, with `_initialize`), but they can't access files, the
+// environment or the network.
+type wasmAnalyzer struct {
+	name    string
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	config  PluginConfig
+}
+
+// loadPlugins from the directory in the given config. All plugins share a runtime
+// (which is pure Go, so that static builds keep working).
+func loadPlugins(config PluginConfig) ([]Analyzer, error) {
+	if config.MemoryLimit < wasmPageSize || config.Timeout <= 0 {
+		return nil, errInvalidPluginConfig
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.Dir, "*"+pluginExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(config.MemoryLimit/wasmPageSize)).
+		WithCloseOnContextDone(true))
+	_, err = wasi_snapshot_preview1.Instantiate(ctx, runtime)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	sort.Strings(paths)
+	analyzers := []Analyzer{}
+	for _, path := range paths {
+		analyzer, err := loadPlugin(runtime, path, config)
+		if err != nil {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("Cannot load plugin %s: %s", filepath.Base(path), err.Error())
+		}
+
+		log.Printf("Loaded plugin %s for analyzing images\n", analyzer.name)
+		analyzers = append(analyzers, analyzer)
+	}
+
+	return analyzers, nil
+}
+
+// loadPlugin in the given path (which is compiled using the given runtime), and check
+// that it has the functions we need.
+func loadPlugin(runtime wazero.Runtime, path string, config PluginConfig) (*wasmAnalyzer, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	module, err := runtime.CompileModule(context.Background(), code)
+	if err != nil {
+		return nil, err
+	}
+
+	functions := module.ExportedFunctions()
+	if module.ExportedMemories()["memory"] == nil ||
+		!hasSignature(functions["alloc"], []api.ValueType{api.ValueTypeI32}, []api.ValueType{api.ValueTypeI32}) ||
+		!hasSignature(functions["analyze"], []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, []api.ValueType{api.ValueTypeI64}) {
+		return nil, errInvalidPluginABI
+	}
+
+	return &wasmAnalyzer{
+		name:    strings.TrimSuffix(filepath.Base(path), pluginExtension),
+		runtime: runtime,
+		module:  module,
+		config:  config,
+	}, nil
+}
+
+// hasSignature checks whether the given function (if any) has the given parameters
+// and results.
+func hasSignature(function api.FunctionDefinition, params, results []api.ValueType) bool {
+	return function != nil && bytes.Equal(function.ParamTypes(), params) && bytes.Equal(function.ResultTypes(), results)
+}
+
+func (a *wasmAnalyzer) Name() string {
+	return a.name
+}
+
+func (a *wasmAnalyzer) Dependencies() []string {
+	return nil
+}
+
+func (a *wasmAnalyzer) Analyze(meta *ImageMeta, content io.ReadSeeker) (interface{}, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return nil, err
+	} else if uint(len(data)) > a.config.MemoryLimit {
+		return nil, errPluginImageTooLarge
+	}
+
+	// Module is closed once the time is up, which stops whatever it's running.
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.Timeout)
+	defer cancel()
+
+	instance, err := a.runtime.InstantiateModule(ctx, a.module, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+
+	defer instance.Close(context.Background())
+	results, err := instance.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := uint32(results[0])
+	if !instance.Memory().Write(ptr, data) {
+		return nil, errPluginMemoryAccess
+	}
+
+	results, err = instance.ExportedFunction("analyze").Call(ctx, uint64(ptr), uint64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Memory of the instance goes away when it's closed, so the result is copied.
+	result, ok := instance.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, errPluginMemoryAccess
+	}
+
+	var object map[string]json.RawMessage
+	if json.Unmarshal(result, &object) != nil || object == nil {
+		return nil, errInvalidPluginResult
+	}
+
+	return json.RawMessage(append([]byte{}, result...)), nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPluginsDir has `png.wasm` (compiled from `png.wat`), which reports whether
+// images are PNGs.
+const testPluginsDir = "testdata/plugins"
+
+func TestPluginConfig(t *testing.T) {
+	assert := assert.New(t)
+	config := PluginConfig{Dir: testPluginsDir, MemoryLimit: wasmPageSize, Timeout: time.Second}
+
+	plugins, err := loadPlugins(config)
+	assert.Nil(err)
+	assert.Len(plugins, 1)
+	assert.EqualValues("png", plugins[0].Name())
+	assert.Empty(plugins[0].Dependencies())
+
+	for _, modify := range []func(c *PluginConfig){
+		func(c *PluginConfig) { c.MemoryLimit = wasmPageSize - 1 },
+		func(c *PluginConfig) { c.Timeout = 0 },
+	} {
+		c := config
+		modify(&c)
+		_, err = loadPlugins(c)
+		assert.EqualValues(errInvalidPluginConfig, err)
+	}
+
+	// Directories without modules have no plugins.
+	config.Dir = t.TempDir()
+	plugins, err = loadPlugins(config)
+	assert.Nil(err)
+	assert.Empty(plugins)
+
+	// Modules must be valid, and they must have the functions we need.
+	path := filepath.Join(config.Dir, "foo.wasm")
+	ioutil.WriteFile(path, []byte("booya"), 0644)
+	_, err = loadPlugins(config)
+	assert.True(strings.HasPrefix(err.Error(), "Cannot load plugin foo.wasm: "))
+
+	ioutil.WriteFile(path, []byte("\x00asm\x01\x00\x00\x00"), 0644)
+	_, err = loadPlugins(config)
+	assert.EqualValues("Cannot load plugin foo.wasm: "+errInvalidPluginABI.Error(), err.Error())
+}
+
+func TestPlugins(t *testing.T) {
+	assert := assert.New(t)
+	plugins, err := loadPlugins(PluginConfig{Dir: testPluginsDir, MemoryLimit: 2 * wasmPageSize, Timeout: time.Second})
+	assert.Nil(err)
+	plugin := plugins[0]
+	meta := &ImageMeta{ID: "foo", Hash: "abc", MediaType: "image/png"}
+
+	// Each invocation has its own instance, so they can run concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		content, expected := pngMagic+"foo", `{"png":true}`
+		if i%2 == 1 {
+			content, expected = "GIF89a", `{"png":false}`
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := plugin.Analyze(meta, bytes.NewReader([]byte(content)))
+			assert.Nil(err)
+			data, _ := json.Marshal(result)
+			assert.JSONEq(expected, string(data))
+		}()
+	}
+
+	wg.Wait()
+
+	// Invocations can't use more memory than the limit.
+	_, err = plugin.Analyze(meta, bytes.NewReader(make([]byte, 3*wasmPageSize)))
+	assert.EqualValues(errPluginImageTooLarge, err)
+	_, err = plugin.Analyze(meta, bytes.NewReader(make([]byte, 2*wasmPageSize)))
+	assert.NotNil(err)
+
+	// Invocations are stopped once the time is up.
+	start := time.Now()
+	_, err = plugin.Analyze(meta, bytes.NewReader([]byte("loop")))
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 10*time.Second)
+
+	// Plugin keeps working after those failures.
+	result, err := plugin.Analyze(meta, bytes.NewReader([]byte(pngMagic)))
+	assert.Nil(err)
+	data, _ := json.Marshal(result)
+	assert.JSONEq(`{"png":true}`, string(data))
+}
@@ -1,49 +1,76 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
 	"log"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/h2non/filetype"
 	lru "github.com/hashicorp/golang-lru"
-	"github.com/rwcarlsen/goexif/exif"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
-	defaultExpiry = time.Unix(int64(1<<63-1), 0)
+	errNotSeekable      = errors.New("Object store does not support random access")
+	errInvalidDataStore = errors.New("Invalid data store URL")
+	errMissingImage     = errors.New("Image metadata does not exist")
+	errBrokenImage      = errors.New("Image is no longer available in the store")
+	errInvalidDecodes   = errors.New("Maximum number of concurrent decodes must be positive")
 )
 
 // Internally used commands for querying/updating the repository.
 const (
 	cmdCreateUploadID = iota
-	cmdFetchExpiry
+	cmdFetchUploadLink
+	cmdReserveLinkUsage
+	cmdReleaseLinkUsage
+	cmdClaimUploadLink
+	cmdUpdateLinkExpiry
+	cmdListUploadLinks
+	cmdAddLinkUpload
+	cmdFetchLinkUploads
+	cmdAddTusUpload
+	cmdFetchTusUpload
+	cmdLockTusUpload
+	cmdReleaseTusUpload
+	cmdRemoveTusUpload
+	cmdListTusUploads
 	cmdAddMeta
 	cmdFetchMeta
 	cmdFetchIDForHash
 	cmdUpdateMeta
-	cmdStoreChunk
 	cmdFetchChunks
-	cmdDiscardObject
-	cmdAnalyzeImage
 	cmdFetchStats
+	cmdSaveAnalysisJob
+	cmdFetchAnalysisJob
+	cmdListAnalysisJobs
+	cmdCountAnalysisJobs
+	cmdListImages
+	cmdSaveBackfill
+	cmdFetchBackfill
+	cmdListBackfills
+	cmdSaveVariant
+	cmdRemoveVariant
 )
 
-// MessageHub has a bunch of channels for passing commands from the service,
-// handling them in the repository, persisting/retrieving from the store, etc.
+// MessageHub has the channel for passing commands from the service to the repository,
+// which handles them (say, by persisting/retrieving from the store) and responds
+// through the channel in each message.
 type MessageHub struct {
-	cmdChan  chan repoMessage
-	respChan chan interface{}
-	ackChan  chan struct{}
+	cmdChan chan repoMessage
 }
 
 // NewMessageHub for creating a new hub.
 func NewMessageHub() MessageHub {
 	return MessageHub{
-		cmdChan:  make(chan repoMessage),
-		respChan: make(chan interface{}),
-		ackChan:  make(chan struct{}),
+		cmdChan: make(chan repoMessage),
 	}
 }
 
@@ -52,25 +79,47 @@ type repoMessage struct {
 	ty   int
 	id   string
 	data interface{}
+	// Channel for the response to this message.
+	resp chan repoResponse
+}
+
+// repoResponse for some message, with the error from the store (if it has failed).
+type repoResponse struct {
+	value interface{}
+	err   error
+}
+
+// send the given message through this hub and wait for its response.
+func (hub MessageHub) send(msg repoMessage) repoResponse {
+	msg.resp = make(chan repoResponse, 1)
+	hub.cmdChan <- msg
+	return <-msg.resp
 }
 
 // MARK: API layer.
 
 // DataRepository caches and proxies the database. In order for it to function,
-// `handleCommands` must be spawned into a goroutine.
+// `handleCommands` must be spawned into a goroutine. Commands are handled concurrently,
+// so that slow queries (and their retries) don't hold up the others.
 type DataRepository struct {
 	linkCache *lru.Cache
 	metaCache *lru.Cache
 	hashes    *lru.Cache
-	dataStore DataStore
-	cmdHub    MessageHub
+	// Ongoing resumable uploads. These can't be evicted, so we don't use a cache.
+	tusUploads map[string]TusUpload
+	dataStore  DataStore
+	cmdHub     MessageHub
+	// Locks for updating the links and the resumable uploads (commands are handled
+	// concurrently).
+	linkLock sync.Mutex
+	tusLock  sync.Mutex
 }
 
 // NewDataRepository initialized from the environment and the given configuration parameters.
 //
-// If `POSTGRES_URL` is set, then the store for PostgreSQL database is initialized.
-// Otherwise, a no-op store is initialized.
-func NewDataRepository(linkCacheCap, metaCacheCap, hashesCap int) (*DataRepository, error) {
+// The data store is chosen by the environment (see `newDataStoreFromEnv`), and the
+// connections to the database server (if any) are limited by the given pool config.
+func NewDataRepository(linkCacheCap, metaCacheCap, hashesCap int, pool DBPoolConfig) (*DataRepository, error) {
 	linkCache, err := lru.New(linkCacheCap)
 	if err != nil {
 		return nil, err
@@ -86,17 +135,9 @@ func NewDataRepository(linkCacheCap, metaCacheCap, hashesCap int) (*DataReposito
 		return nil, err
 	}
 
-	var dataStore DataStore
-
-	postgresURL := os.Getenv(envPostgresURL)
-	if postgresURL != "" {
-		log.Println("Initializing PostgreSQL database driver.")
-		dataStore = &PostgreSQLStore{
-			url: postgresURL,
-		}
-	} else {
-		log.Println("Initializing no-op store for metadata.")
-		dataStore = NoOpStore{}
+	dataStore, err := newDataStoreFromEnv(pool)
+	if err != nil {
+		return nil, err
 	}
 
 	err = dataStore.initialize()
@@ -107,230 +148,872 @@ func NewDataRepository(linkCacheCap, metaCacheCap, hashesCap int) (*DataReposito
 	cmdHub := NewMessageHub()
 
 	return &DataRepository{
-		linkCache,
-		metaCache,
-		hashes,
-		dataStore,
-		cmdHub,
+		linkCache:  linkCache,
+		metaCache:  metaCache,
+		hashes:     hashes,
+		tusUploads: make(map[string]TusUpload),
+		dataStore:  dataStore,
+		cmdHub:     cmdHub,
 	}, nil
 }
 
-// createUploadID binds the given ID to the given expiry time.
-func (r *DataRepository) createUploadID(linkID string, expiry time.Time) {
-	r.cmdHub.cmdChan <- repoMessage{
-		ty:   cmdCreateUploadID,
+// createUploadID binds the given ID to the given expiry time and policy.
+func (r *DataRepository) createUploadID(linkID string, expiry time.Time, policy LinkPolicy) error {
+	return r.cmdHub.send(repoMessage{
+		ty: cmdCreateUploadID,
+		id: linkID,
+		data: UploadLink{
+			ID:     linkID,
+			Expiry: expiry,
+			Policy: policy,
+		},
+	}).err
+}
+
+// fetchUploadLink for the given upload ID (nil if it doesn't exist).
+func (r *DataRepository) fetchUploadLink(linkID string) (*UploadLink, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdFetchUploadLink,
+		id: linkID,
+	})
+	return resp.value.(*UploadLink), resp.err
+}
+
+// reserveLinkUsage for the given upload ID and return the updated link (nil if it
+// doesn't exist). Usage is checked against the limits of the link's policy and added
+// in one go, so concurrent uploads can't go over them. Returns `errImageLimitReached`
+// or `errByteLimitReached` if the usage doesn't fit.
+func (r *DataRepository) reserveLinkUsage(linkID string, images, bytes uint) (*UploadLink, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty:   cmdReserveLinkUsage,
+		id:   linkID,
+		data: UploadLink{Images: images, Bytes: bytes},
+	})
+	return resp.value.(*UploadLink), resp.err
+}
+
+// releaseLinkUsage which has been reserved for some upload that has failed.
+func (r *DataRepository) releaseLinkUsage(linkID string, images, bytes uint) error {
+	return r.cmdHub.send(repoMessage{
+		ty:   cmdReleaseLinkUsage,
+		id:   linkID,
+		data: UploadLink{Images: images, Bytes: bytes},
+	}).err
+}
+
+// claimUploadLink marks the given upload ID as used. Returns false if it's
+// already been used (or if it doesn't exist).
+func (r *DataRepository) claimUploadLink(linkID string) (bool, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdClaimUploadLink,
+		id: linkID,
+	})
+	return resp.value.(bool), resp.err
+}
+
+// updateLinkExpiry of the given upload ID and return the updated link (nil if it
+// doesn't exist).
+func (r *DataRepository) updateLinkExpiry(linkID string, expiry time.Time) (*UploadLink, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty:   cmdUpdateLinkExpiry,
 		id:   linkID,
 		data: expiry,
-	}
-	_ = <-r.cmdHub.ackChan
+	})
+	return resp.value.(*UploadLink), resp.err
 }
 
-// hasExpired checks whether the given upload ID has expired.
-func (r *DataRepository) hasExpired(linkID string) bool {
-	r.cmdHub.cmdChan <- repoMessage{
-		ty: cmdFetchExpiry,
+// listUploadLinks matching the given filter.
+func (r *DataRepository) listUploadLinks(filter LinkFilter) (*LinkList, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty:   cmdListUploadLinks,
+		data: filter,
+	})
+	return resp.value.(*LinkList), resp.err
+}
+
+// addLinkUpload records an image uploaded through some upload ID.
+func (r *DataRepository) addLinkUpload(upload LinkUpload) error {
+	return r.cmdHub.send(repoMessage{
+		ty:   cmdAddLinkUpload,
+		data: upload,
+	}).err
+}
+
+// fetchLinkUploads for the given upload ID.
+func (r *DataRepository) fetchLinkUploads(linkID string) ([]LinkUpload, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdFetchLinkUploads,
 		id: linkID,
-	}
-	expiry := <-r.cmdHub.respChan
-	diff := expiry.(time.Time).Sub(time.Now().UTC())
-	return diff.Seconds() <= 0
+	})
+	return resp.value.([]LinkUpload), resp.err
+}
+
+// addTusUpload for tracking a new resumable upload.
+func (r *DataRepository) addTusUpload(upload TusUpload) {
+	r.cmdHub.send(repoMessage{
+		ty:   cmdAddTusUpload,
+		id:   upload.ID,
+		data: upload,
+	})
+}
+
+// fetchTusUpload for the given upload ID (if it exists).
+func (r *DataRepository) fetchTusUpload(uploadID string) *TusUpload {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdFetchTusUpload,
+		id: uploadID,
+	})
+	return resp.value.(*TusUpload)
+}
+
+// lockTusUpload for the given upload ID, so that it can be appended. If the upload
+// is already locked, then it's returned as busy. Returns nil if it doesn't exist.
+func (r *DataRepository) lockTusUpload(uploadID string) *TusUpload {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdLockTusUpload,
+		id: uploadID,
+	})
+	return resp.value.(*TusUpload)
+}
+
+// releaseTusUpload by updating its state and unlocking it.
+func (r *DataRepository) releaseTusUpload(upload TusUpload) {
+	r.cmdHub.send(repoMessage{
+		ty:   cmdReleaseTusUpload,
+		id:   upload.ID,
+		data: upload,
+	})
+}
+
+// listTusUploads which are ongoing right now.
+func (r *DataRepository) listTusUploads() []TusUpload {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdListTusUploads,
+	})
+	return resp.value.([]TusUpload)
+}
+
+// removeTusUpload once it's been completed or terminated.
+func (r *DataRepository) removeTusUpload(uploadID string) {
+	r.cmdHub.send(repoMessage{
+		ty: cmdRemoveTusUpload,
+		id: uploadID,
+	})
 }
 
 // fetchIDForHash of an image (if it exists, then we have a possible duplicate).
-func (r *DataRepository) fetchIDForHash(hash string) string {
-	r.cmdHub.cmdChan <- repoMessage{
+func (r *DataRepository) fetchIDForHash(hash string) (string, error) {
+	resp := r.cmdHub.send(repoMessage{
 		ty: cmdFetchIDForHash,
 		id: hash,
-	}
-	value := <-r.cmdHub.respChan
-	return value.(string)
+	})
+	return resp.value.(string), resp.err
 }
 
-// addImageData adds the given metadata for an image.
-func (r *DataRepository) addImageData(meta ImageMeta) {
-	r.cmdHub.cmdChan <- repoMessage{
+// addImageData adds the given metadata for an image, unless we already have an image
+// with the same hash. Returns the ID of the image for that hash (which is the ID of
+// the existing image for duplicates).
+func (r *DataRepository) addImageData(meta ImageMeta) (string, error) {
+	resp := r.cmdHub.send(repoMessage{
 		ty:   cmdAddMeta,
 		data: meta,
-	}
-	_ = <-r.cmdHub.ackChan
+	})
+	return resp.value.(string), resp.err
 }
 
 // updateImageData updates existing metadata for an image.
-func (r *DataRepository) updateImageData(meta ImageMeta) {
-	r.cmdHub.cmdChan <- repoMessage{
+func (r *DataRepository) updateImageData(meta ImageMeta) error {
+	return r.cmdHub.send(repoMessage{
 		ty:   cmdUpdateMeta,
 		data: meta,
-	}
-	_ = <-r.cmdHub.ackChan
+	}).err
 }
 
-// fetchImageMeta for the given image ID.
-func (r *DataRepository) fetchImageMeta(id string) *ImageMeta {
-	r.cmdHub.cmdChan <- repoMessage{
+// fetchImageMeta for the given image ID (nil if it doesn't exist).
+func (r *DataRepository) fetchImageMeta(id string) (*ImageMeta, error) {
+	resp := r.cmdHub.send(repoMessage{
 		ty: cmdFetchMeta,
 		id: id,
-	}
-	value := <-r.cmdHub.respChan
-	return value.(*ImageMeta)
+	})
+	return resp.value.(*ImageMeta), resp.err
 }
 
 // fetchStats collected from the service so far.
-func (r *DataRepository) fetchStats() *ServiceStats {
-	r.cmdHub.cmdChan <- repoMessage{
+func (r *DataRepository) fetchStats() (*ServiceStats, error) {
+	resp := r.cmdHub.send(repoMessage{
 		ty: cmdFetchStats,
-	}
-	value := <-r.cmdHub.respChan
-	return value.(*ServiceStats)
+	})
+	return resp.value.(*ServiceStats), resp.err
+}
+
+// saveAnalysisJob in the store.
+func (r *DataRepository) saveAnalysisJob(job AnalysisJob) error {
+	return r.cmdHub.send(repoMessage{
+		ty:   cmdSaveAnalysisJob,
+		data: job,
+	}).err
+}
+
+// fetchAnalysisJob for the given image ID (nil if it doesn't exist).
+func (r *DataRepository) fetchAnalysisJob(imageID string) (*AnalysisJob, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdFetchAnalysisJob,
+		id: imageID,
+	})
+	return resp.value.(*AnalysisJob), resp.err
+}
+
+// listAnalysisJobs matching the given filter.
+func (r *DataRepository) listAnalysisJobs(filter JobFilter) ([]AnalysisJob, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty:   cmdListAnalysisJobs,
+		data: filter,
+	})
+	return resp.value.([]AnalysisJob), resp.err
+}
+
+// countAnalysisJobs in each state.
+func (r *DataRepository) countAnalysisJobs() (map[string]uint, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdCountAnalysisJobs,
+	})
+	return resp.value.(map[string]uint), resp.err
+}
+
+// listImages after the given image ID (ordered by image ID).
+func (r *DataRepository) listImages(afterID string, limit int) ([]ImageMeta, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty:   cmdListImages,
+		id:   afterID,
+		data: limit,
+	})
+	return resp.value.([]ImageMeta), resp.err
+}
+
+// saveBackfill in the store.
+func (r *DataRepository) saveBackfill(backfill Backfill) error {
+	return r.cmdHub.send(repoMessage{
+		ty:   cmdSaveBackfill,
+		data: backfill,
+	}).err
+}
+
+// fetchBackfill for the given ID (nil if it doesn't exist).
+func (r *DataRepository) fetchBackfill(id string) (*Backfill, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdFetchBackfill,
+		id: id,
+	})
+	return resp.value.(*Backfill), resp.err
+}
+
+// listBackfills ordered by their creation time.
+func (r *DataRepository) listBackfills() ([]Backfill, error) {
+	resp := r.cmdHub.send(repoMessage{
+		ty: cmdListBackfills,
+	})
+	return resp.value.([]Backfill), resp.err
+}
+
+// saveVariant stored in the object store.
+func (r *DataRepository) saveVariant(variant ImageVariant) error {
+	return r.cmdHub.send(repoMessage{
+		ty:   cmdSaveVariant,
+		data: variant,
+	}).err
+}
+
+// removeVariant which has been evicted from the object store.
+func (r *DataRepository) removeVariant(id string) error {
+	return r.cmdHub.send(repoMessage{
+		ty: cmdRemoveVariant,
+		id: id,
+	}).err
 }
 
-// handleCommands sent by the service.
+// handleCommands sent by the service. Each command is handled in its own goroutine,
+// so that slow queries (or queries which are being retried) don't hold up the others,
+// and the queries can make use of all the connections in the pool. Commands which
+// update some state (say, the usage of a link) take the lock for that state.
 //
 // **NOTE:** This is blocking and hence, it must be spawn into a separate goroutine.
 func (r *DataRepository) handleCommands() {
-	// FIXME: Cleanup and isole commands handling into their own functions.
-	for {
-		cmd := <-r.cmdHub.cmdChan
-
-		switch cmd.ty {
-		case cmdCreateUploadID:
-			expiry := cmd.data.(time.Time)
-			r.linkCache.Add(cmd.id, expiry)
-			r.dataStore.addUploadID(cmd.id, expiry)
-			r.cmdHub.ackChan <- struct{}{}
-
-		case cmdFetchExpiry:
-			value, exists := r.linkCache.Get(cmd.id)
-			if exists {
-				r.cmdHub.respChan <- value
-			} else {
-				expiry, _ := r.dataStore.getUploadExpiry(cmd.id)
-				if expiry != nil {
-					r.linkCache.Add(cmd.id, *expiry)
-					r.cmdHub.respChan <- *expiry
-				} else {
-					r.cmdHub.respChan <- defaultExpiry
-				}
+	for cmd := range r.cmdHub.cmdChan {
+		go func(cmd repoMessage) {
+			value, err := r.handleCommand(cmd)
+			cmd.resp <- repoResponse{value, err}
+		}(cmd)
+	}
+}
+
+// handleCommand and return its response. Failures of the store are logged and
+// returned, but missing records aren't errors (the response is nil instead).
+func (r *DataRepository) handleCommand(cmd repoMessage) (interface{}, error) {
+	switch cmd.ty {
+	case cmdCreateUploadID:
+		link := cmd.data.(UploadLink)
+		err := r.dataStore.addUploadID(cmd.id, link.Expiry, link.Policy)
+		if err == nil {
+			r.linkCache.Add(cmd.id, link)
+		}
+		return nil, logStoreError("adding upload link", err)
+
+	case cmdFetchUploadLink:
+		return r.getUploadLink(cmd.id)
+
+	case cmdReserveLinkUsage:
+		r.linkLock.Lock()
+		defer r.linkLock.Unlock()
+		usage := cmd.data.(UploadLink)
+		var limitErr error
+		link, err := r.updateUploadLink(cmd.id, func(link *UploadLink) bool {
+			limitErr = link.Policy.checkUsage(usage.Images, usage.Bytes, link)
+			if limitErr != nil {
+				return false
 			}
 
-		case cmdAddMeta:
-			meta := cmd.data.(ImageMeta)
+			link.Images += usage.Images
+			link.Bytes += usage.Bytes
+			return true
+		})
+
+		if err == nil && limitErr != nil {
+			return (*UploadLink)(nil), limitErr
+		}
+		return link, err
+
+	case cmdReleaseLinkUsage:
+		r.linkLock.Lock()
+		defer r.linkLock.Unlock()
+		usage := cmd.data.(UploadLink)
+		_, err := r.updateUploadLink(cmd.id, func(link *UploadLink) bool {
+			link.releaseUsage(usage.Images, usage.Bytes)
+			return true
+		})
+		return nil, err
+
+	case cmdClaimUploadLink:
+		r.linkLock.Lock()
+		defer r.linkLock.Unlock()
+		claimed := false
+		_, err := r.updateUploadLink(cmd.id, func(link *UploadLink) bool {
+			claimed = !link.Used
+			link.Used = true
+			return claimed
+		})
+		return claimed && err == nil, err
+
+	case cmdUpdateLinkExpiry:
+		r.linkLock.Lock()
+		defer r.linkLock.Unlock()
+		return r.updateUploadLink(cmd.id, func(link *UploadLink) bool {
+			link.Expiry = cmd.data.(time.Time)
+			return true
+		})
+
+	case cmdListUploadLinks:
+		list, err := r.dataStore.listUploadLinks(cmd.data.(LinkFilter))
+		return list, logStoreError("listing upload links", err)
+
+	case cmdAddLinkUpload:
+		return nil, logStoreError("adding link upload", r.dataStore.addLinkUpload(cmd.data.(LinkUpload)))
+
+	case cmdFetchLinkUploads:
+		uploads, err := r.dataStore.fetchLinkUploads(cmd.id)
+		return uploads, logStoreError("fetching link uploads", err)
+
+	case cmdAddTusUpload:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		r.tusUploads[cmd.id] = cmd.data.(TusUpload)
+		return nil, nil
+
+	case cmdFetchTusUpload:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		upload, exists := r.tusUploads[cmd.id]
+		if !exists {
+			return (*TusUpload)(nil), nil
+		}
+		return &upload, nil
+
+	case cmdLockTusUpload:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		upload, exists := r.tusUploads[cmd.id]
+		if !exists {
+			return (*TusUpload)(nil), nil
+		} else if !upload.busy {
+			locked := upload
+			locked.busy = true
+			r.tusUploads[cmd.id] = locked
+		}
+		return &upload, nil
+
+	case cmdReleaseTusUpload:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		upload := cmd.data.(TusUpload)
+		upload.busy = false
+		r.tusUploads[cmd.id] = upload
+		return nil, nil
+
+	case cmdRemoveTusUpload:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		delete(r.tusUploads, cmd.id)
+		return nil, nil
+
+	case cmdListTusUploads:
+		r.tusLock.Lock()
+		defer r.tusLock.Unlock()
+		uploads := make([]TusUpload, 0, len(r.tusUploads))
+		for _, upload := range r.tusUploads {
+			uploads = append(uploads, upload)
+		}
+		return uploads, nil
+
+	case cmdAddMeta:
+		meta := cmd.data.(ImageMeta)
+		id, err := r.dataStore.addImageMeta(meta)
+		if err == nil && id == meta.ID {
 			r.metaCache.Add(meta.ID, meta)
+		}
+		if err == nil {
+			r.hashes.Add(meta.Hash, id)
+		}
+		return id, logStoreError("adding image metadata", err)
+
+	case cmdFetchMeta:
+		value, exists := r.metaCache.Get(cmd.id)
+		if exists {
+			meta := value.(ImageMeta)
+			return &meta, nil
+		}
+
+		meta, err := r.dataStore.fetchImageMeta(cmd.id)
+		if meta != nil {
+			r.metaCache.Add(cmd.id, *meta)
 			r.hashes.Add(meta.Hash, meta.ID)
-			r.dataStore.addImageMeta(meta)
-			r.cmdHub.ackChan <- struct{}{}
-
-		case cmdFetchMeta:
-			value, exists := r.metaCache.Get(cmd.id)
-			if exists {
-				meta := value.(ImageMeta)
-				r.cmdHub.respChan <- &meta
-			} else {
-				meta, _ := r.dataStore.fetchImageMeta(cmd.id)
-				if meta != nil {
-					r.metaCache.Add(cmd.id, *meta)
-					r.hashes.Add(meta.Hash, meta.ID)
-				}
-				r.cmdHub.respChan <- meta
-			}
+		}
+		return meta, logStoreError("fetching image metadata", err)
 
-		case cmdFetchIDForHash:
-			value, exists := r.hashes.Get(cmd.id)
-			if exists {
-				r.cmdHub.respChan <- value
-			} else {
-				meta, _ := r.dataStore.fetchMetaForHash(cmd.id)
-				if meta != nil {
-					r.metaCache.Add(cmd.id, *meta)
-					r.hashes.Add(meta.Hash, meta.ID)
-				}
-				r.cmdHub.respChan <- meta.ID
-			}
+	case cmdFetchIDForHash:
+		value, exists := r.hashes.Get(cmd.id)
+		if exists {
+			return value.(string), nil
+		}
 
-		case cmdUpdateMeta:
-			meta := cmd.data.(ImageMeta)
+		meta, err := r.dataStore.fetchMetaForHash(cmd.id)
+		if meta == nil || meta.ID == "" {
+			return "", logStoreError("fetching metadata for hash", err)
+		}
+
+		r.metaCache.Add(meta.ID, *meta)
+		r.hashes.Add(meta.Hash, meta.ID)
+		return meta.ID, nil
+
+	case cmdUpdateMeta:
+		meta := cmd.data.(ImageMeta)
+		err := r.dataStore.updateImageMeta(meta)
+		if err == nil {
 			r.metaCache.Add(meta.ID, meta)
 			r.hashes.Add(meta.Hash, meta.ID)
-			r.dataStore.updateImageMeta(meta)
-			r.cmdHub.ackChan <- struct{}{}
+		} else {
+			// We don't know what's in the store now.
+			r.metaCache.Remove(meta.ID)
+		}
+		return nil, logStoreError("updating image metadata", err)
+
+	case cmdFetchStats:
+		stats, err := r.dataStore.getServiceStats()
+		return stats, logStoreError("fetching stats", err)
+
+	case cmdSaveAnalysisJob:
+		return nil, logStoreError("saving analysis job", r.dataStore.saveAnalysisJob(cmd.data.(AnalysisJob)))
+
+	case cmdFetchAnalysisJob:
+		job, err := r.dataStore.fetchAnalysisJob(cmd.id)
+		return job, logStoreError("fetching analysis job", err)
+
+	case cmdListAnalysisJobs:
+		jobs, err := r.dataStore.listAnalysisJobs(cmd.data.(JobFilter))
+		return jobs, logStoreError("listing analysis jobs", err)
+
+	case cmdCountAnalysisJobs:
+		counts, err := r.dataStore.countAnalysisJobs()
+		return counts, logStoreError("counting analysis jobs", err)
+
+	case cmdListImages:
+		metas, err := r.dataStore.listImagesAfter(cmd.id, cmd.data.(int))
+		return metas, logStoreError("listing images", err)
+
+	case cmdSaveBackfill:
+		return nil, logStoreError("saving backfill", r.dataStore.saveBackfill(cmd.data.(Backfill)))
+
+	case cmdFetchBackfill:
+		backfill, err := r.dataStore.fetchBackfill(cmd.id)
+		return backfill, logStoreError("fetching backfill", err)
+
+	case cmdListBackfills:
+		backfills, err := r.dataStore.listBackfills()
+		return backfills, logStoreError("listing backfills", err)
+
+	case cmdSaveVariant:
+		return nil, logStoreError("saving variant", r.dataStore.saveVariant(cmd.data.(ImageVariant)))
+
+	case cmdRemoveVariant:
+		return nil, logStoreError("removing variant", r.dataStore.removeVariant(cmd.id))
+	}
+
+	return nil, fmt.Errorf("Unknown repository command: %d", cmd.ty)
+}
+
+// getUploadLink from the cache (or the store, if it's not in the cache).
+func (r *DataRepository) getUploadLink(linkID string) (*UploadLink, error) {
+	value, exists := r.linkCache.Get(linkID)
+	if exists {
+		link := value.(UploadLink)
+		return &link, nil
+	}
+
+	link, err := r.dataStore.getUploadLink(linkID)
+	if link != nil {
+		r.linkCache.Add(linkID, *link)
+	}
+
+	return link, logStoreError("fetching upload link", err)
+}
+
+// updateUploadLink with the given ID using the given function, which returns whether
+// the link should be saved. Returns the link (nil if it doesn't exist). Callers must
+// hold the lock for links.
+func (r *DataRepository) updateUploadLink(linkID string, update func(link *UploadLink) bool) (*UploadLink, error) {
+	link, err := r.getUploadLink(linkID)
+	if link == nil || err != nil || !update(link) {
+		return link, err
+	}
+
+	err = r.dataStore.updateUploadLink(*link)
+	if err != nil {
+		// We don't know what's in the store now.
+		r.linkCache.Remove(linkID)
+		return nil, logStoreError("updating upload link", err)
+	}
+
+	// Replace the cached link, so that the update takes effect right away.
+	r.linkCache.Add(linkID, *link)
+	return link, nil
+}
+
+// logStoreError (if any) from the data store while doing the given action, and return
+// it. Missing records are expected, so they're neither logged nor returned.
+func logStoreError(action string, err error) error {
+	if err == nil || err == errNotFound {
+		return nil
+	}
+
+	log.Printf("Error %s: %s\n", action, err.Error())
+	return err
+}
 
-		case cmdFetchStats:
-			stats, _ := r.dataStore.getServiceStats()
-			r.cmdHub.respChan <- stats
+// newDataStoreFromEnv using the given pool config for database connections.
+//
+// If `DATA_STORE` is set, then the store is chosen by its URL scheme (see `newDataStore`).
+// Otherwise, if `POSTGRES_URL` is set, then the store for PostgreSQL database is initialized.
+// Otherwise, data is kept in memory.
+func newDataStoreFromEnv(pool DBPoolConfig) (DataStore, error) {
+	storeURL, postgresURL := os.Getenv(envDataStore), os.Getenv(envPostgresURL)
+	if storeURL != "" {
+		return newDataStore(storeURL, pool)
+	} else if postgresURL != "" {
+		log.Println("Initializing PostgreSQL database driver.")
+		return NewPostgreSQLStore(postgresURL, pool), nil
+	}
+
+	log.Println("Initializing in-memory store for metadata.")
+	return NewMemoryStore(), nil
+}
+
+// newDataStore for the given URL. The scheme decides the store - `postgres://...` (or
+// `postgresql://`) for PostgreSQL database, `bolt:///path/to/data.db` for an embedded
+// database file (relative paths can be written as `bolt://data.db`), and `memory://`
+// for keeping data in memory. Connections to the database server are limited by the
+// given pool config.
+func newDataStore(storeURL string, pool DBPoolConfig) (DataStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		log.Println("Initializing PostgreSQL database driver.")
+		return NewPostgreSQLStore(storeURL, pool), nil
+
+	case "bolt":
+		path := u.Opaque
+		if path == "" {
+			path = u.Host + u.Path
+		}
+
+		if path == "" {
+			return nil, errInvalidDataStore
 		}
+
+		log.Printf("Initializing embedded database in %s\n", path)
+		return NewBoltStore(path), nil
+
+	case "memory":
+		log.Println("Initializing in-memory store for metadata.")
+		return NewMemoryStore(), nil
 	}
+
+	return nil, errInvalidDataStore
 }
 
 // MARK: Streaming layer.
 
 // ObjectsRepository acts as a bridge for streaming chunks from the service to the
-// store and back.
+// store and back. Objects are written to the store by their own writers (so that
+// uploads don't wait for each other), but the number of concurrent writes is bounded.
 type ObjectsRepository struct {
 	objectStore ObjectStore
 	data        *DataRepository
-	streamHub   MessageHub
-	imageHub    MessageHub
+	variants    *VariantCache
+	// Slots for writing to the store. Writers block until they get a slot.
+	writeSlots chan struct{}
+	// Slots for decoding images, since each of them can take a lot of memory (see
+	// `maxDecodePixels`). Requests for variants block until they get a slot.
+	decodeSlots chan struct{}
+	// Requests for creating the same variant, which share a single decode.
+	variantFlights singleflight.Group
+	streamHub      MessageHub
+	// Workers for analyzing stored images.
+	analysis *analysisPool
+	// Analyzers for stored images, ordered by their dependencies.
+	analyzers []Analyzer
 }
 
 // NewObjectsRepository initialized from the environment and the DataRepository.
 //
-// - If `S3_REGION` and `S3_BUCKET` is set, then AWS S3 store is initialized (**unimplemented**).
+// - If `S3_REGION` and `S3_BUCKET` is set, then S3 store is initialized.
 // - Otherwise, file store is initialized (store path can be set in environment).
-func NewObjectsRepository(data *DataRepository) (*ObjectsRepository, error) {
-	log.Println("Initializing file store for images.")
-	storePathPrefix := os.Getenv(envStorePath)
-	if storePathPrefix == "" {
-		storePathPrefix = defaultStorePath
+//
+// Stored images are analyzed (using the built-in analyzers, and any other analyzers
+// registered later) by a pool of workers using the given config.
+func NewObjectsRepository(data *DataRepository, variantsCap, maxWrites, maxDecodes uint, analysis AnalysisConfig) (*ObjectsRepository, error) {
+	err := analysis.validate()
+	if err != nil {
+		return nil, err
+	} else if maxDecodes == 0 {
+		return nil, errInvalidDecodes
+	}
+
+	var objectStore ObjectStore
+
+	region, bucket := os.Getenv(envS3Region), os.Getenv(envS3Bucket)
+	if region != "" && bucket != "" {
+		log.Println("Initializing S3 store for images.")
+		objectStore = NewS3Store(region, bucket)
+	} else {
+		log.Println("Initializing file store for images.")
+		storePathPrefix := os.Getenv(envStorePath)
+		if storePathPrefix == "" {
+			storePathPrefix = defaultStorePath
+		}
+
+		storePathPrefix = strings.TrimSuffix(storePathPrefix, "/")
+		err := os.MkdirAll(storePathPrefix, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+
+		fileStore := &FileStore{
+			pathPrefix: storePathPrefix,
+		}
+
+		// Nothing else is using the data store yet, so we can access it directly.
+		err = fileStore.recover(data.dataStore)
+		if err != nil {
+			return nil, err
+		}
+
+		objectStore = fileStore
+	}
+
+	repo := &ObjectsRepository{
+		data:        data,
+		objectStore: objectStore,
+		variants:    NewVariantCache(variantsCap),
+		writeSlots:  make(chan struct{}, maxWrites),
+		decodeSlots: make(chan struct{}, maxDecodes),
+		streamHub:   NewMessageHub(),
+		analysis:    newAnalysisPool(analysis),
 	}
 
-	storePathPrefix = strings.TrimSuffix(storePathPrefix, "/")
-	err := os.MkdirAll(storePathPrefix, os.ModePerm)
+	err = repo.loadVariants()
 	if err != nil {
 		return nil, err
 	}
 
-	return &ObjectsRepository{
-		data: data,
-		objectStore: &FileStore{
-			pathPrefix: storePathPrefix,
-			openFds:    make(map[string]*os.File),
-		},
-		streamHub: NewMessageHub(),
-		imageHub:  NewMessageHub(),
-	}, nil
+	err = repo.registerAnalyzers(builtinAnalyzers()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
 }
 
-// sendChunk for the given image ID to the store. Since this goes through
-// a channel all the way to the store, where it may be buffered before
-// sending to the actual storage, the slice must retain its data. Hence,
-// it's important to send a fresh copy of buffer. If we've reached EOF,
-// then this must be called with an empty chunk.
-func (r *ObjectsRepository) sendChunk(id string, chunk []byte) {
-	r.streamHub.cmdChan <- repoMessage{
-		ty:   cmdStoreChunk,
-		id:   id,
-		data: chunk,
+// stageObject for the given image ID and return a writer for streaming it to the store.
+// Writes go straight to the store from the caller's goroutine, so writers must not be
+// shared between goroutines. If writing (or closing) fails, then the writer must be aborted.
+func (r *ObjectsRepository) stageObject(id string) (*objectWriter, error) {
+	writer, err := r.objectStore.stageObject(id)
+	if err != nil {
+		return nil, err
 	}
-	_ = <-r.streamHub.ackChan
+
+	return &objectWriter{writer, r.writeSlots}, nil
 }
 
-// fetchChunks for the given image ID and return a channel to stream them.
-func (r *ObjectsRepository) fetchChunks(id string) <-chan Chunk {
-	r.streamHub.cmdChan <- repoMessage{
-		ty: cmdFetchChunks,
-		id: id,
+// commitObject streamed for the given image ID to the given hash. Returns whether
+// an object already exists for that hash (in which case the streamed one is discarded).
+func (r *ObjectsRepository) commitObject(id, hash string) (bool, error) {
+	return r.objectStore.commitObject(id, hash)
+}
+
+// discardObject staged for the given image ID (once its writer is done).
+func (r *ObjectsRepository) discardObject(id string) error {
+	return r.objectStore.discardObject(id)
+}
+
+// objectWriter writes an object to the store, sharing the slots with other writers.
+type objectWriter struct {
+	ObjectWriter
+	slots chan struct{}
+}
+
+func (w *objectWriter) Write(chunk []byte) (int, error) {
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+	return w.ObjectWriter.Write(chunk)
+}
+
+func (w *objectWriter) Close() error {
+	// Closing may flush buffered bytes to the store.
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+	return w.ObjectWriter.Close()
+}
+
+// openObject committed under the given hash for random access. Returns
+// `errNotSeekable` if the store doesn't support that (in which case the chunks
+// must be fetched instead).
+func (r *ObjectsRepository) openObject(hash string) (ObjectReader, error) {
+	store, ok := r.objectStore.(SeekableStore)
+	if !ok {
+		return nil, errNotSeekable
 	}
-	value := <-r.streamHub.respChan
-	streamChan := value.(chan Chunk)
-	return streamChan
+
+	return store.openObject(hash)
 }
 
-// discardChunks corresponding to the given image ID.
-func (r *ObjectsRepository) discardChunks(id string) {
-	r.streamHub.cmdChan <- repoMessage{
-		ty: cmdDiscardObject,
-		id: id,
+// fetchChunks for the given hash and return a channel to stream them. Chunks start
+// at the given offset and span the given length (negative for the entire object).
+func (r *ObjectsRepository) fetchChunks(hash string, offset, length int64) <-chan Chunk {
+	resp := r.streamHub.send(repoMessage{
+		ty:   cmdFetchChunks,
+		id:   hash,
+		data: byteRange{offset, length},
+	})
+	return resp.value.(chan Chunk)
+}
+
+// loadVariants tracked in the data store into the variant cache (evicting the ones
+// which don't fit anymore). Nothing else is using the data store yet, so we can
+// access it directly.
+func (r *ObjectsRepository) loadVariants() error {
+	variants, err := r.data.dataStore.listVariants()
+	if err != nil {
+		return err
+	}
+
+	// Oldest variants are added first, so that they're evicted first.
+	for _, variant := range variants {
+		for _, evicted := range r.variants.add(variant.meta()) {
+			r.removeVariantObject(evicted)
+			r.data.dataStore.removeVariant(evicted.ID)
+		}
+	}
+
+	return nil
+}
+
+// fetchVariant for the given variant ID (if it's been stored).
+func (r *ObjectsRepository) fetchVariant(id string) *ImageMeta {
+	return r.variants.get(id)
+}
+
+// storeVariant with the given metadata and bytes, evicting older variants if needed.
+// Like uploads, this writes to the store from the caller's goroutine.
+func (r *ObjectsRepository) storeVariant(meta ImageMeta, data []byte) {
+	err := r.storeVariantObject(meta, data)
+	if err != nil {
+		// Variants can be regenerated, so we don't bother the client.
+		log.Printf("Error storing variant %s: %s\n", meta.ID, err.Error())
+		return
+	}
+
+	err = r.data.saveVariant(ImageVariant{
+		ID:        meta.ID,
+		Hash:      meta.Hash,
+		MediaType: meta.MediaType,
+		Size:      meta.Size,
+		Uploaded:  meta.Uploaded,
+		Created:   time.Now().UTC(),
+	})
+	if err != nil {
+		// The object is reused if the variant is regenerated after a restart.
+		log.Printf("Variant %s won't be tracked after restarting\n", meta.ID)
+	}
+
+	for _, evicted := range r.variants.add(meta) {
+		r.removeVariantObject(evicted)
+		r.data.removeVariant(evicted.ID)
+	}
+}
+
+// removeVariantObject for the given variant, which has been evicted from the cache.
+func (r *ObjectsRepository) removeVariantObject(variant ImageMeta) {
+	log.Printf("Evicting variant %s\n", variant.ID)
+	err := r.objectStore.removeObject(variant.Hash)
+	if err != nil {
+		log.Printf("Error removing variant %s: %s\n", variant.ID, err.Error())
 	}
-	_ = <-r.streamHub.ackChan
+}
+
+// decodeImage for the given hash. Returns the image along with the format name, or
+// `errImageTooLarge` if the image has too many pixels to be decoded.
+func (r *ObjectsRepository) decodeImage(hash string) (image.Image, string, error) {
+	reader, err := r.objectStore.getImageReader(hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer r.objectStore.cleanupImageReader(hash, reader)
+
+	// Check the dimensions in the header before allocating anything for the pixels.
+	// Whatever's read for that is replayed for decoding.
+	var head bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(reader, &head))
+	if err != nil {
+		return nil, "", err
+	} else if int64(config.Width)*int64(config.Height) > maxDecodePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	return image.Decode(io.MultiReader(&head, reader))
 }
 
 // Chunk represents a streamable chunk.
@@ -348,105 +1031,207 @@ func (r *ObjectsRepository) processChunks() {
 		msg := <-r.streamHub.cmdChan
 
 		switch msg.ty {
-		case cmdStoreChunk:
-			bytes := msg.data.([]byte)
-			r.objectStore.storeChunk(msg.id, bytes, len(bytes) == 0)
-			r.streamHub.ackChan <- struct{}{}
-
 		case cmdFetchChunks:
 			chunkChan := make(chan Chunk)
 			// Spawn in a separate goroutine because we don't wanna
 			// block other chunks whilst retrieving this file's chunks.
-			go r.objectStore.retrieveChunks(msg.id, chunkChan)
-			r.streamHub.respChan <- chunkChan
+			span := msg.data.(byteRange)
+			go r.objectStore.retrieveChunks(msg.id, span.start, span.length, chunkChan)
+			msg.resp <- repoResponse{value: chunkChan}
 
-		case cmdDiscardObject:
-			r.objectStore.discardObject(msg.id)
-			r.streamHub.ackChan <- struct{}{}
 		}
 	}
 }
 
+// storeVariantObject with the given metadata and bytes in the store. The same variant
+// may be stored by concurrent requests, so each of them is staged under its own ID.
+func (r *ObjectsRepository) storeVariantObject(meta ImageMeta, data []byte) error {
+	id := meta.ID + "-" + randomAlphanumeric(variantStagingSuffixLength)
+	writer, err := r.stageObject(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err == nil {
+		_, err = r.objectStore.commitObject(id, meta.Hash)
+	}
+
+	if err != nil {
+		writer.abort()
+	}
+
+	return err
+}
+
 // MARK: Processing layer
 
-// queueImageForAnalysis using the given metadata.
-func (r *ObjectsRepository) queueImageForAnalysis(meta ImageMeta) {
-	r.imageHub.cmdChan <- repoMessage{
-		ty:   cmdAnalyzeImage,
-		data: meta,
+// queueImageForAnalysis using the given metadata. The job is persisted, so that it's
+// processed even if the service restarts before getting to it. If the queue is full,
+// then this blocks or leaves the job in the data store, depending on the queue policy.
+// Returns error if the job couldn't be persisted (it's not queued either).
+func (r *ObjectsRepository) queueImageForAnalysis(meta ImageMeta) error {
+	now := time.Now().UTC()
+	job := AnalysisJob{
+		ImageID:     meta.ID,
+		State:       jobPending,
+		NextAttempt: now,
+		Created:     now,
+		Updated:     now,
 	}
+
+	err := r.data.saveAnalysisJob(job)
+	if err != nil {
+		return err
+	}
+
+	r.analysis.enqueue(job)
+	return nil
+}
+
+// analysisOverloaded checks whether new uploads should be rejected for now, because
+// the analysis queue is full.
+func (r *ObjectsRepository) analysisOverloaded() bool {
+	return r.analysis.overloaded()
 }
 
 // processImages we've stored so far. We've already done sanitation checks
-// when we received the image, so now we just need to update the metadata
-// by processing the tags.
+// (including the format) when we received the image, so now we just need to
+// update the metadata by processing the tags.
+//
+// This starts the workers, and then queues the jobs waiting in the data store when
+// they're due - after the backoff for failed attempts, when running jobs haven't
+// finished in time (say, because the service crashed while processing them), or
+// when they couldn't be queued earlier because the queue was full.
 //
 // **NOTE:** This is blocking and hence, it must be spawn into a separate goroutine.
 func (r *ObjectsRepository) processImages() {
+	for _, stats := range r.analysis.workers {
+		go r.analysis.work(stats, r.runAnalysisJob)
+	}
+
+	r.resumeBackfills()
+
 	for {
-		msg := <-r.imageHub.cmdChan
+		// If the store has failed, then we just look again later.
+		jobs, _ := r.data.listAnalysisJobs(JobFilter{
+			States: []string{jobPending, jobRunning},
+			DueBy:  time.Now().UTC(),
+			Limit:  analysisBatchSize,
+		})
 
-		switch msg.ty {
-		case cmdAnalyzeImage:
-			data := msg.data
-			meta := data.(ImageMeta)
-			meta.applyDefaults()
+		for _, job := range jobs {
+			if !r.analysis.enqueue(job) {
+				break
+			}
+		}
 
-			r.updateMetaFromExif(&meta)
-			r.updateFormat(&meta)
+		// There may be more jobs due, so we should look again once a job finishes.
+		if len(jobs) == analysisBatchSize {
+			r.analysis.spill()
+		}
 
-			log.Printf("Updating image (ID: %s, size: %d)\n", meta.ID, meta.Size)
-			r.data.updateImageData(meta)
+		select {
+		case <-r.analysis.wake:
+		case <-time.After(analysisPollInterval):
 		}
 	}
 }
 
-// updateMetaFromExif of the image in the given metadata.
-func (r *ObjectsRepository) updateMetaFromExif(meta *ImageMeta) {
-	reader, err := r.objectStore.getImageReader(meta.ID)
+// runAnalysisJob and update its state. Failed attempts are retried with exponential
+// backoff, until the job runs out of attempts. Returns whether the job has succeeded.
+func (r *ObjectsRepository) runAnalysisJob(job AnalysisJob) bool {
+	now := time.Now().UTC()
+	job.State = jobRunning
+	job.Attempts++
+	job.NextAttempt = now.Add(analysisJobTimeout)
+	job.Updated = now
+	err := r.data.saveAnalysisJob(job)
 	if err != nil {
-		log.Printf("Cannot obtain reader for getting image metadata (ID: %s): %s\n",
-			meta.ID, err.Error())
-		return
+		// Job will be picked up again once the store is back.
+		return false
 	}
 
-	x, err := exif.Decode(reader)
-	if err != nil {
-		log.Printf("Cannot decode exif data from image (ID: %s): %s\n",
-			meta.ID, err.Error())
-		return
+	failures, err := r.analyzeImage(job.ImageID, job.Failures)
+	if err == nil {
+		// Results of the analyzers which succeeded have been stored, and only the
+		// failed ones are retried.
+		job.Failures = failures
+		err = failures.err()
 	}
 
-	// NOTE: Right now, we're only worried about the camera model
-	// and GPS coords, but we can always get more.
+	now = time.Now().UTC()
+	job.Updated = now
+	job.LastError = ""
 
-	value, err := x.Get(exif.Model)
 	if err == nil {
-		meta.CameraModel = value.String()
+		job.State = jobDone
+	} else if err == errBrokenImage {
+		// There's nothing to read until the image is restored (and reanalyzed).
+		log.Printf("Skipping analysis of broken image (ID: %s)\n", job.ImageID)
+		job.State = jobFailed
+		job.LastError = err.Error()
+	} else if job.Attempts >= maxAnalysisAttempts {
+		log.Printf("Giving up on analyzing image (ID: %s) after %d attempts: %s\n",
+			job.ImageID, job.Attempts, err.Error())
+		job.State = jobFailed
+		job.LastError = err.Error()
+	} else {
+		log.Printf("Error analyzing image (ID: %s, attempt: %d): %s\n", job.ImageID, job.Attempts, err.Error())
+		job.State = jobPending
+		job.LastError = err.Error()
+		job.NextAttempt = now.Add(analysisBackoff(job.Attempts))
 	}
 
-	lat, long, err := x.LatLong()
+	if r.data.saveAnalysisJob(job) != nil {
+		// Job will be picked up again when it times out.
+		return false
+	}
+
+	return err == nil
+}
+
+// analysisBackoff before the next attempt of a job which has failed the given number of times.
+func analysisBackoff(attempts uint) time.Duration {
+	delay := analysisRetryBaseDelay
+	for i := uint(1); i < attempts && delay < analysisMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > analysisMaxRetryDelay {
+		delay = analysisMaxRetryDelay
+	}
+
+	return delay
+}
+
+// analyzeImage with the given ID using the registered analyzers (or only the ones which
+// have failed earlier, see `runAnalyzers`), and update its metadata. The image is read
+// only once, and its content is shared by all the analyzers. Returns the failures.
+func (r *ObjectsRepository) analyzeImage(id string, failed AnalyzerFailures) (AnalyzerFailures, error) {
+	meta, err := r.data.fetchImageMeta(id)
 	if err != nil {
-		meta.Latitude = lat
-		meta.Longitude = long
+		return nil, err
+	} else if meta == nil {
+		return nil, errMissingImage
+	} else if meta.Broken {
+		return nil, errBrokenImage
 	}
 
-	err = r.objectStore.cleanupImageReader(meta.ID, reader)
+	content, err := r.readImage(meta.Hash)
 	if err != nil {
-		log.Printf("Error cleaning up reader (id: %s): %s\n", meta.ID, err.Error())
+		return nil, err
 	}
-}
 
-// updateFormat of the image in the given metadata.
-func (r *ObjectsRepository) updateFormat(meta *ImageMeta) {
-	reader, err := r.objectStore.getImageReader(meta.ID)
+	failures, err := r.runAnalyzers(meta, content, failed)
 	if err != nil {
-		log.Printf("Cannot obtain reader for checking image (ID: %s): %s\n",
-			meta.ID, err.Error())
-		return
+		return nil, err
 	}
 
-	kind, _ := filetype.MatchReader(reader)
-	meta.MediaType = kind.MIME.Value
-	// FIXME: If this isn't an image, then we should discard that in store.
+	log.Printf("Updating image (ID: %s, size: %d)\n", meta.ID, meta.Size)
+	return failures, r.data.updateImageData(*meta)
 }
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// S3 requires all parts (except the last one) to be at least 5 MiB.
+	s3MinPartSize      = 5 * 1024 * 1024
+	s3DefaultRangeSize = 1024 * 1024
+	// Each request moves at most a part or a range, so a stalled store can't hold
+	// uploads (and their write slots) or downloads forever.
+	s3RequestTimeout   = time.Minute
+	s3SigningAlgorithm = "AWS4-HMAC-SHA256"
+	s3ServiceName      = "s3"
+	s3TimeFormat       = "20060102T150405Z"
+	s3DateFormat       = "20060102"
+	// Objects are staged under one prefix and committed (content-addressed) into another.
+	s3StagingPrefix = "staging/"
+	s3ObjectsPrefix = "objects/"
+
+	headerAmzDate          = "X-Amz-Date"
+	headerAmzContentSHA256 = "X-Amz-Content-Sha256"
+	headerAuthorization    = "Authorization"
+	headerAmzCopySource    = "X-Amz-Copy-Source"
+)
+
+var errS3NotFound = errors.New("Object not found in S3")
+
+// emptyPayloadHash is the SHA-256 hash of an empty body (used for signing).
+var emptyPayloadHash = fmt.Sprintf("%x", sha256.Sum256(nil))
+
+// S3Store is used for persisting objects in an S3-compatible object storage.
+type S3Store struct {
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	// Endpoint for S3-compatible stores (MinIO, localstack, etc.). If this
+	// is empty, then the AWS endpoint for the region is used.
+	endpoint string
+	// partSize is the size at which buffered chunks are uploaded as a part.
+	partSize int
+	// rangeSize is the number of bytes fetched in a single ranged GET.
+	rangeSize int
+	client    *http.Client
+}
+
+// s3Upload tracks an ongoing multipart upload for some staged object. This is
+// the writer for the object, and the multipart upload is created on the first write.
+type s3Upload struct {
+	store    *S3Store
+	key      string
+	uploadID string
+	buf      bytes.Buffer
+	parts    []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// NewS3Store for the given region and bucket. Credentials are picked from the
+// environment (`AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY`), and if
+// `S3_ENDPOINT` is set, then it's used instead of AWS.
+func NewS3Store(region, bucket string) *S3Store {
+	return &S3Store{
+		region:    region,
+		bucket:    bucket,
+		accessKey: os.Getenv(envAWSAccessKey),
+		secretKey: os.Getenv(envAWSSecretKey),
+		endpoint:  strings.TrimSuffix(os.Getenv(envS3Endpoint), "/"),
+		partSize:  s3MinPartSize,
+		rangeSize: s3DefaultRangeSize,
+		client:    &http.Client{Timeout: s3RequestTimeout},
+	}
+}
+
+// MARK: `ObjectStore` interface methods.
+
+func (store *S3Store) stageObject(id string) (ObjectWriter, error) {
+	return &s3Upload{
+		store: store,
+		key:   s3StagingPrefix + id,
+	}, nil
+}
+
+func (store *S3Store) commitObject(id, hash string) (bool, error) {
+	staged, key := s3StagingPrefix+id, s3ObjectsPrefix+contentAddress(hash)
+	resp, err := store.doRequest(http.MethodHead, key, nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		log.Printf("Object already exists for hash %s (image ID: %s)\n", hash, id)
+		return true, store.deleteObject(staged)
+	} else if err != errS3NotFound {
+		return false, err
+	}
+
+	// S3 doesn't have renames, but copying is atomic (readers never see a partial object).
+	resp, err = store.doRequest(http.MethodPut, key, nil, nil, func(req *http.Request) {
+		req.Header.Set(headerAmzCopySource, "/"+store.bucket+"/"+staged)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// Copies can fail after S3 has responded with 200.
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil {
+		err = s3ErrorFromBody(data)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return false, store.deleteObject(staged)
+}
+
+func (store *S3Store) retrieveChunks(hash string, offset, length int64, stream chan<- Chunk) {
+	key := s3ObjectsPrefix + contentAddress(hash)
+	buf := make([]byte, defaultBufSize)
+	end := int64(-1)
+	if length >= 0 {
+		end = offset + length
+	}
+
+	for end < 0 || offset < end {
+		last := offset + int64(store.rangeSize) - 1
+		if end >= 0 && last >= end {
+			last = end - 1
+		}
+
+		resp, err := store.doRequest(http.MethodGet, key, nil, nil, func(req *http.Request) {
+			req.Header.Set(headerRange, fmt.Sprintf("bytes=%d-%d", offset, last))
+		})
+
+		if err == nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// We've either reached the end or the object is empty.
+			resp.Body.Close()
+			break
+		}
+
+		if err != nil {
+			stream <- Chunk{
+				bytes:   []byte{},
+				isFinal: true,
+				err:     err,
+			}
+
+			return
+		}
+
+		total, err := s3ObjectSize(resp)
+		var body io.ReadCloser
+		if err == nil {
+			body, err = s3RangeBody(resp, offset, last)
+		}
+
+		if err == nil && end >= 0 {
+			// Servers which ignore the range send everything after the offset.
+			body = readCloser{io.LimitReader(body, end-offset), body}
+		}
+
+		for err == nil {
+			var n int
+			n, err = body.Read(buf)
+			offset += int64(n)
+			if n == 0 {
+				continue
+			}
+
+			slice := make([]byte, n)
+			copy(slice, buf[:n])
+			stream <- Chunk{
+				bytes: slice,
+			}
+		}
+
+		resp.Body.Close()
+		if err != io.EOF {
+			stream <- Chunk{
+				bytes:   []byte{},
+				isFinal: true,
+				err:     err,
+			}
+
+			return
+		}
+
+		// We've got the rest of the object if the range was ignored.
+		if resp.StatusCode != http.StatusPartialContent || offset >= total {
+			break
+		}
+	}
+
+	stream <- Chunk{
+		bytes:   []byte{},
+		isFinal: true,
+	}
+}
+
+func (store *S3Store) discardObject(id string) error {
+	return store.deleteObject(s3StagingPrefix + id)
+}
+
+func (store *S3Store) removeObject(hash string) error {
+	return store.deleteObject(s3ObjectsPrefix + contentAddress(hash))
+}
+
+func (store *S3Store) getImageReader(hash string) (io.Reader, error) {
+	reader := &s3RangeReader{
+		store: store,
+		key:   s3ObjectsPrefix + contentAddress(hash),
+		total: -1,
+	}
+
+	err := reader.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func (store *S3Store) cleanupImageReader(hash string, reader io.Reader) error {
+	body, ok := reader.(io.ReadCloser)
+	if ok {
+		return body.Close()
+	}
+
+	return nil
+}
+
+// s3RangeReader reads an object using ranged GETs (one range at a time), so that
+// reading large objects isn't cut short by the request timeout.
+type s3RangeReader struct {
+	store  *S3Store
+	key    string
+	offset int64
+	// Size of the object (-1 until we know it).
+	total int64
+	// Body of the current range (nil if we need the next range).
+	body io.ReadCloser
+	// Whether the server has ignored the range (and sent the rest of the object).
+	whole bool
+}
+
+// next range of the object.
+func (r *s3RangeReader) next() error {
+	last := r.offset + int64(r.store.rangeSize) - 1
+	resp, err := r.store.doRequest(http.MethodGet, r.key, nil, nil, func(req *http.Request) {
+		req.Header.Set(headerRange, fmt.Sprintf("bytes=%d-%d", r.offset, last))
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// We've either reached the end or the object is empty.
+		resp.Body.Close()
+		r.total = r.offset
+		return nil
+	}
+
+	r.total, err = s3ObjectSize(resp)
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	r.whole = resp.StatusCode != http.StatusPartialContent
+	r.body, err = s3RangeBody(resp, r.offset, last)
+	return err
+}
+
+func (r *s3RangeReader) Read(p []byte) (int, error) {
+	for {
+		if r.body == nil {
+			if r.total >= 0 && r.offset >= r.total {
+				return 0, io.EOF
+			}
+
+			err := r.next()
+			if err != nil {
+				return 0, err
+			}
+
+			continue
+		}
+
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			r.body.Close()
+			r.body = nil
+			err = nil
+			if r.whole {
+				r.total = r.offset
+			}
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *s3RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	return r.body.Close()
+}
+
+// MARK: `ObjectWriter` interface methods.
+
+func (upload *s3Upload) Write(chunk []byte) (int, error) {
+	err := upload.begin()
+	if err != nil {
+		return 0, err
+	}
+
+	upload.buf.Write(chunk)
+	if upload.buf.Len() >= upload.store.partSize {
+		err = upload.store.uploadPart(upload.key, upload)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(chunk), nil
+}
+
+func (upload *s3Upload) Close() error {
+	err := upload.begin()
+	// Last part can be smaller than the part size (or even empty if
+	// that's the only part).
+	if err == nil && (upload.buf.Len() > 0 || len(upload.parts) == 0) {
+		err = upload.store.uploadPart(upload.key, upload)
+	}
+
+	if err == nil {
+		err = upload.store.completeMultipartUpload(upload.key, upload)
+	}
+
+	if err == nil {
+		// Nothing to abort anymore (the staged object can still be deleted).
+		upload.uploadID = ""
+	}
+
+	return err
+}
+
+func (upload *s3Upload) abort() error {
+	upload.store.abortMultipartUpload(upload.key, upload)
+	upload.uploadID = ""
+	return upload.store.deleteObject(upload.key)
+}
+
+// begin the multipart upload (if it hasn't been created already).
+func (upload *s3Upload) begin() error {
+	if upload.uploadID != "" {
+		return nil
+	}
+
+	log.Printf("Creating new multipart upload for %s\n", upload.key)
+	var err error
+	upload.uploadID, err = upload.store.createMultipartUpload(upload.key)
+	return err
+}
+
+// MARK: S3 API calls.
+
+// deleteObject with the given key.
+func (store *S3Store) deleteObject(key string) error {
+	resp, err := store.doRequest(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// createMultipartUpload for the given key and return the upload ID.
+func (store *S3Store) createMultipartUpload(key string) (string, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+	resp, err := store.doRequest(http.MethodPost, key, query, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+
+	if result.UploadID == "" {
+		return "", errors.New("S3 did not return an upload ID")
+	}
+
+	return result.UploadID, nil
+}
+
+// uploadPart with the bytes buffered so far for the given upload.
+func (store *S3Store) uploadPart(key string, upload *s3Upload) error {
+	partNumber := len(upload.parts) + 1
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", upload.uploadID)
+
+	resp, err := store.doRequest(http.MethodPut, key, query, upload.buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	upload.parts = append(upload.parts, s3CompletedPart{
+		PartNumber: partNumber,
+		ETag:       resp.Header.Get(headerETag),
+	})
+	upload.buf.Reset()
+
+	return nil
+}
+
+// completeMultipartUpload by assembling all the parts uploaded so far.
+func (store *S3Store) completeMultipartUpload(key string, upload *s3Upload) error {
+	body, err := xml.Marshal(s3CompleteMultipartUpload{
+		Parts: upload.parts,
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", upload.uploadID)
+	resp, err := store.doRequest(http.MethodPost, key, query, body, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// S3 may fail the request after sending 200 OK, in which case the
+	// error is in the body.
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return s3ErrorFromBody(data)
+}
+
+// abortMultipartUpload so that S3 can free the parts uploaded so far.
+func (store *S3Store) abortMultipartUpload(key string, upload *s3Upload) {
+	if upload.uploadID == "" {
+		return
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", upload.uploadID)
+	resp, err := store.doRequest(http.MethodDelete, key, query, nil, nil)
+	if err != nil {
+		log.Printf("Error aborting multipart upload (image ID: %s): %s\n", key, err.Error())
+		return
+	}
+
+	resp.Body.Close()
+}
+
+// doRequest signs and sends a request for the given key. Responses with
+// non-2xx status codes (other than 416 for ranged requests) are turned into errors.
+func (store *S3Store) doRequest(method, key string, query url.Values, body []byte, prepare func(*http.Request)) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, store.objectURL(key, query), reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if prepare != nil {
+		prepare(req)
+	}
+
+	store.signRequest(req, body, time.Now().UTC())
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		err = s3ErrorFromBody(data)
+		if resp.StatusCode == http.StatusInsufficientStorage {
+			// S3-compatible stores (say, MinIO) can run out of space.
+			err = errStoreFull
+		} else if err == nil && resp.StatusCode == http.StatusNotFound {
+			err = errS3NotFound
+		} else if err == nil {
+			err = fmt.Errorf("S3 responded with status %d", resp.StatusCode)
+		}
+
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// objectURL for the given key. Path-style addressing is used for custom
+// endpoints, since most S3-compatible stores don't support virtual hosts.
+func (store *S3Store) objectURL(key string, query url.Values) string {
+	var base string
+	if store.endpoint != "" {
+		base = fmt.Sprintf("%s/%s/%s", store.endpoint, store.bucket, key)
+	} else {
+		base = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", store.bucket, store.region, key)
+	}
+
+	if len(query) > 0 {
+		return base + "?" + s3CanonicalQuery(query)
+	}
+
+	return base
+}
+
+// signRequest using AWS signature version 4.
+func (store *S3Store) signRequest(req *http.Request, body []byte, now time.Time) {
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		payloadHash = fmt.Sprintf("%x", sha256.Sum256(body))
+	}
+
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set(headerAmzDate, amzDate)
+	req.Header.Set(headerAmzContentSHA256, payloadHash)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", now.Format(s3DateFormat), store.region, s3ServiceName)
+	stringToSign := strings.Join([]string{
+		s3SigningAlgorithm,
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+store.secretKey), now.Format(s3DateFormat))
+	key = hmacSHA256(key, store.region)
+	key = hmacSHA256(key, s3ServiceName)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set(headerAuthorization, fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3SigningAlgorithm, store.accessKey, scope, signedHeaders, signature))
+}
+
+// MARK: Helpers.
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query sorted by key, with spaces as `%20`.
+func s3CanonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// s3ObjectSize from the `Content-Range` header of a ranged response.
+func s3ObjectSize(resp *http.Response) (int64, error) {
+	contentRange := resp.Header.Get(headerContentRange)
+	if contentRange == "" {
+		// Server ignored our range and sent the whole object.
+		return resp.ContentLength, nil
+	}
+
+	idx := strings.LastIndex(contentRange, "/")
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid Content-Range: %s", contentRange)
+	}
+
+	return strconv.ParseInt(contentRange[idx+1:], 10, 64)
+}
+
+// s3RangeBody of the given response to a GET for the given range (from the offset to
+// `last`, inclusive), which never has more than the range. Servers may ignore the
+// range and send the whole object, in which case the bytes before the offset are
+// skipped, and the body has the rest of the object.
+func s3RangeBody(resp *http.Response, offset, last int64) (io.ReadCloser, error) {
+	if resp.StatusCode == http.StatusPartialContent {
+		return readCloser{io.LimitReader(resp.Body, last-offset+1), resp.Body}, nil
+	}
+
+	_, err := io.CopyN(ioutil.Discard, resp.Body, offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// readCloser reads from some reader, and closes some other closer (say, the body
+// of a response which is read through a `LimitReader`).
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// s3ErrorFromBody returns an error if the given body is an S3 error document.
+func s3ErrorFromBody(data []byte) error {
+	var s3Err s3Error
+	if xml.Unmarshal(data, &s3Err) != nil || s3Err.Code == "" {
+		return nil
+	}
+
+	return fmt.Errorf("S3 error (%s): %s", s3Err.Code, s3Err.Message)
+}
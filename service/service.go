@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,13 +18,31 @@ import (
 )
 
 var (
-	errInvalidExpiryTime = errors.New("Invalid expiry time for upload link")
+	errInvalidExpiryTime   = errors.New("Invalid expiry time for upload link")
+	errInvalidStartTime    = errors.New("Invalid start time for upload link")
+	errInvalidMediaType    = errors.New("Allowed media types must be images")
+	errMediaTypeNotAllowed = errors.New("Media type is not allowed for this link")
+	errImageLimitReached   = errors.New("Maximum number of images for this link has been reached")
+	errByteLimitReached    = errors.New("Maximum bytes for this link has been exceeded")
+	errFileTooLarge        = errors.New("Image exceeds maximum size allowed for this link")
+	errInvalidLinkStatus   = errors.New("Link status must be either 'active' or 'expired'")
+	errInvalidPage         = errors.New("Invalid page or number of items per page")
+	errUnknownLink         = errors.New("Upload link does not exist")
+	errInactiveLink        = errors.New("Upload link is not active yet")
+	errReadingPart         = errors.New("Error reading part from the upload stream")
+	errStoringImage        = errors.New("Error storing image")
+	errInsufficientStorage = errors.New("Insufficient storage for image")
+	errDuplicateImage      = errors.New("Identical image has already been uploaded")
+	errServiceOverloaded   = errors.New("Service is overloaded, please try again later")
+	errDataUnavailable     = errors.New("Data store is unavailable, please try again later")
 )
 
 // ImageService handles the incoming HTTP requests and proxies the necessary
 // data to and from the repository.
 type ImageService struct {
 	accessToken string
+	// signingKey for the image URLs sent to the bridge (see `signImageURL`).
+	signingKey []byte
 
 	// FIXME: Add sanitation. Right now,t we assume that this prefix must begin
 	// with "/" and must not end with "/".
@@ -30,18 +51,56 @@ type ImageService struct {
 	uploadLinkPrefix string
 	data             *DataRepository
 	objects          *ObjectsRepository
+	// presets for image variants which can be requested by name.
+	presets map[string]VariantParams
+	// tusMaxSize is the maximum length of resumable uploads.
+	tusMaxSize uint
+	// tusIdleTimeout after which resumable uploads are removed (if they haven't
+	// been appended).
+	tusIdleTimeout time.Duration
 }
 
 // CreateUploadLink validates the given request, creates an upload link and returns
 // the corresponding response object. Returns error on validation failure.
 func (service *ImageService) CreateUploadLink(req LinkCreationRequest) (*EphemeralLinkResponse, error) {
+	expiry, err := parseExpiry(req.Duration, req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := parseLinkPolicy(req, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	linkID := randomAlphanumeric(uploadLinkIDLength)
+	err = service.data.createUploadID(linkID, expiry, *policy)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	resp := EphemeralLinkResponse{
+		RelativePath: fmt.Sprintf("%s/%s", service.uploadLinkPrefix, linkID),
+		Timestamp:    expiry.Format(time.RFC3339),
+	}
+
+	if !policy.NotBefore.IsZero() {
+		resp.NotBefore = policy.NotBefore.Format(time.RFC3339)
+	}
+
+	return &resp, nil
+}
+
+// parseExpiry from the given ISO 8601 duration (from now) or timestamp. Duration
+// takes precedence, and the timestamp is used only if the duration is invalid or empty.
+func parseExpiry(duration, timestamp string) (time.Time, error) {
 	now := time.Now().UTC()
 	expiry := now
 	var err error
 
 	// Try to parse duration.
-	if req.Duration != "" {
-		period, e := period.Parse(req.Duration)
+	if duration != "" {
+		period, e := period.Parse(duration)
 		if e != nil {
 			err = e
 		} else {
@@ -50,158 +109,776 @@ func (service *ImageService) CreateUploadLink(req LinkCreationRequest) (*Ephemer
 	}
 
 	// Reset error and try to parse exact timestamp.
-	if req.Timestamp != "" && ((req.Duration != "" && err != nil) || req.Duration == "") {
-		expiry, err = time.Parse(time.RFC3339, req.Timestamp)
+	if timestamp != "" && ((duration != "" && err != nil) || duration == "") {
+		expiry, err = time.Parse(time.RFC3339, timestamp)
 	}
 
 	// If we still have an error, bail out.
 	if err != nil {
-		return nil, errInvalidExpiryTime
+		return expiry, errInvalidExpiryTime
 	}
 
 	diff := expiry.Sub(now)
 	if diff.Seconds() < minExpirySeconds {
-		return nil, errInvalidExpiryTime
+		return expiry, errInvalidExpiryTime
 	}
 
-	linkID := randomAlphanumeric(uploadLinkIDLength)
-	service.data.createUploadID(linkID, expiry)
+	return expiry, nil
+}
 
-	return &EphemeralLinkResponse{
-		RelativePath: fmt.Sprintf("%s/%s", service.uploadLinkPrefix, linkID),
-		Timestamp:    expiry.Format(time.RFC3339),
+// parseLinkPolicy from the given request for a link with the given expiry.
+func parseLinkPolicy(req LinkCreationRequest, expiry time.Time) (*LinkPolicy, error) {
+	policy := LinkPolicy{
+		MaxImages:     req.MaxImages,
+		MaxTotalBytes: req.MaxTotalBytes,
+		MaxFileBytes:  req.MaxFileBytes,
+		SingleUse:     req.SingleUse,
+	}
+
+	if req.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, req.NotBefore)
+		if err != nil || !notBefore.Before(expiry) {
+			return nil, errInvalidStartTime
+		}
+
+		policy.NotBefore = notBefore.UTC()
+	}
+
+	types := make([]string, 0, len(req.AllowedTypes))
+	for _, ty := range req.AllowedTypes {
+		ty = normalizeMediaType(ty)
+		if !strings.HasPrefix(ty, imageMediaType) || len(ty) == len(imageMediaType) {
+			return nil, errInvalidMediaType
+		}
+
+		types = append(types, ty)
+	}
+
+	policy.AllowedTypes = strings.Join(types, ",")
+	return &policy, nil
+}
+
+// ListUploadLinks matching the given status ("active", "expired" or empty for all)
+// in the given page (starting from 1).
+func (service *ImageService) ListUploadLinks(status string, page, perPage int) (*LinkListResponse, error) {
+	if status != "" && status != linkStatusActive && status != linkStatusExpired {
+		return nil, errInvalidLinkStatus
+	}
+
+	if page < 1 || perPage < 1 || perPage > maxLinksPerPage {
+		return nil, errInvalidPage
+	}
+
+	now := time.Now().UTC()
+	result, err := service.data.listUploadLinks(LinkFilter{
+		Status: status,
+		Offset: (page - 1) * perPage,
+		Limit:  perPage,
+		Now:    now,
+	})
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	resp := LinkListResponse{
+		Links:   []LinkDetails{},
+		Page:    page,
+		PerPage: perPage,
+		Total:   result.Total,
+	}
+
+	for i := range result.Links {
+		resp.Links = append(resp.Links, service.linkDetails(&result.Links[i], now))
+	}
+
+	return &resp, nil
+}
+
+// GetUploadLink details for the given upload ID. Returns error if it doesn't exist.
+func (service *ImageService) GetUploadLink(linkID string) (*LinkDetails, error) {
+	link, err := service.data.fetchUploadLink(linkID)
+	if err != nil {
+		return nil, errDataUnavailable
+	} else if link == nil || link.ID == "" {
+		return nil, errUnknownLink
+	}
+
+	details := service.linkDetails(link, time.Now().UTC())
+	return &details, nil
+}
+
+// UpdateUploadLinkExpiry validates the given request and changes the expiry of the
+// given upload ID. Returns error on validation failure or if the link doesn't exist.
+func (service *ImageService) UpdateUploadLinkExpiry(linkID string, req LinkUpdateRequest) (*LinkDetails, error) {
+	expiry, err := parseExpiry(req.Duration, req.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := service.data.updateLinkExpiry(linkID, expiry)
+	if err != nil {
+		return nil, errDataUnavailable
+	} else if link == nil {
+		return nil, errUnknownLink
+	}
+
+	details := service.linkDetails(link, time.Now().UTC())
+	return &details, nil
+}
+
+// RevokeUploadLink by expiring it right away. Returns error if the link doesn't exist.
+func (service *ImageService) RevokeUploadLink(linkID string) error {
+	link, err := service.data.updateLinkExpiry(linkID, time.Now().UTC())
+	if err != nil {
+		return errDataUnavailable
+	} else if link == nil {
+		return errUnknownLink
+	}
+
+	return nil
+}
+
+// GetLinkUploads lists the images (including duplicates) uploaded through the given upload ID.
+func (service *ImageService) GetLinkUploads(linkID string) (*LinkUploadsResponse, error) {
+	_, err := service.GetUploadLink(linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	uploads, err := service.data.fetchLinkUploads(linkID)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	resp := LinkUploadsResponse{
+		Images: uploads,
+	}
+
+	for _, upload := range uploads {
+		resp.TotalBytes += upload.Size
+	}
+
+	return &resp, nil
+}
+
+// GetAnalysisJob for the given image ID (nil if it doesn't exist).
+func (service *ImageService) GetAnalysisJob(imageID string) (*AnalysisJob, error) {
+	job, err := service.data.fetchAnalysisJob(imageID)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	return job, nil
+}
+
+// GetAnalysisStatus with the number of analysis jobs in each state, and the queue
+// of the analysis workers.
+func (service *ImageService) GetAnalysisStatus() (*AnalysisStatus, error) {
+	counts, err := service.data.countAnalysisJobs()
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	return &AnalysisStatus{
+		Pending: counts[jobPending],
+		Running: counts[jobRunning],
+		Done:    counts[jobDone],
+		Failed:  counts[jobFailed],
+		Queue:   service.objects.analysis.status(),
 	}, nil
 }
 
+// linkDetails for the given link at the given time.
+func (service *ImageService) linkDetails(link *UploadLink, now time.Time) LinkDetails {
+	details := LinkDetails{
+		ID:            link.ID,
+		RelativePath:  fmt.Sprintf("%s/%s", service.uploadLinkPrefix, link.ID),
+		Timestamp:     link.Expiry.Format(time.RFC3339),
+		Active:        link.Expiry.After(now) && !link.Used,
+		MaxImages:     link.Policy.MaxImages,
+		MaxTotalBytes: link.Policy.MaxTotalBytes,
+		MaxFileBytes:  link.Policy.MaxFileBytes,
+		AllowedTypes:  []string{},
+		SingleUse:     link.Policy.SingleUse,
+		Images:        link.Images,
+		Bytes:         link.Bytes,
+		Used:          link.Used,
+	}
+
+	if !link.Policy.NotBefore.IsZero() {
+		details.NotBefore = link.Policy.NotBefore.Format(time.RFC3339)
+	}
+
+	if link.Policy.AllowedTypes != "" {
+		details.AllowedTypes = strings.Split(link.Policy.AllowedTypes, ",")
+	}
+
+	return details
+}
+
 // StreamStatus represents one of the possible status messages for stream processing.
 type StreamStatus int
 
 const (
 	streamInvalidUploadID = iota
+	streamInactiveUploadID
 	streamInvalidImage
+	streamBrokenImage
+	streamNotModified
+	streamInvalidRange
+	streamInvalidVariant
+	streamNotAcceptable
+	streamUnsupportedImage
+	streamImageTooLarge
+	streamInsufficientStorage
+	streamOverloaded
+	streamUnavailable
 	streamFailure
 	streamSuccess
 )
 
+// checkUploadLink for uploading images right now.
+func (service *ImageService) checkUploadLink(linkID string) (*UploadLink, error) {
+	link, err := service.data.fetchUploadLink(linkID)
+	if err != nil {
+		return nil, errDataUnavailable
+	}
+
+	now := time.Now().UTC()
+	if link == nil || !link.Expiry.After(now) || link.Used {
+		return nil, errUnknownLink
+	}
+
+	if now.Before(link.Policy.NotBefore) {
+		return nil, errInactiveLink
+	}
+
+	// Claim single use links right away, so that concurrent requests can't use them.
+	if link.Policy.SingleUse {
+		claimed, err := service.data.claimUploadLink(linkID)
+		if err != nil {
+			return nil, errDataUnavailable
+		} else if !claimed {
+			return nil, errUnknownLink
+		}
+	}
+
+	return link, nil
+}
+
+// reserveLinkUsage of the given images and bytes for the given upload ID, and return
+// the updated link. Returns error if that goes over the limits of the link's policy.
+func (service *ImageService) reserveLinkUsage(linkID string, images, bytes uint) (*UploadLink, error) {
+	link, err := service.data.reserveLinkUsage(linkID, images, bytes)
+	if err == errImageLimitReached || err == errByteLimitReached {
+		return nil, err
+	} else if err != nil {
+		return nil, errDataUnavailable
+	} else if link == nil {
+		return nil, errUnknownLink
+	}
+
+	return link, nil
+}
+
 // StreamImagesToBackend validates the given upload ID and streams file chunks from the given
 // reader to the repository.
 func (service *ImageService) StreamImagesToBackend(linkID string, reader *multipart.Reader) (*ImageUploadResponse, StreamStatus) {
-	if service.data.hasExpired(linkID) {
+	link, err := service.checkUploadLink(linkID)
+	if err == errInactiveLink {
+		return nil, streamInactiveUploadID
+	} else if err == errDataUnavailable {
+		return nil, streamUnavailable
+	} else if err != nil {
 		return nil, streamInvalidUploadID
 	}
 
+	if service.objects.analysisOverloaded() {
+		return nil, streamOverloaded
+	}
+
 	response := ImageUploadResponse{
 		Processed: []ProcessedImage{},
+		Rejected:  []RejectedImage{},
 	}
 
-	buf := make([]byte, defaultBufSize)
+	bufPtr := uploadBufs.Get().(*[]byte)
+	defer uploadBufs.Put(bufPtr)
+	buf := *bufPtr
 	for {
 		part, err := reader.NextPart()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			// We can't read any further parts from a broken stream.
+			log.Printf("Error reading multipart stream: %s\n", err.Error())
+			response.Rejected = append(response.Rejected, RejectedImage{
+				Status: partFailed,
+				Reason: errReadingPart.Error(),
+			})
+			break
+		}
+
+		// We don't trust the client's `Content-Type`. The part is rejected if
+		// the magic numbers in its first few bytes don't match an image.
+		fieldName, fileName := part.FormName(), part.FileName()
+		head, err := readHead(part)
+		var mediaType string
+		if err == nil {
+			mediaType, err = sniffImage(head)
+		} else {
+			log.Printf("Error reading %s: %s\n", fileName, err.Error())
+			err = errReadingPart
+		}
+
+		if err == nil {
+			ctype := normalizeMediaType(part.Header.Get(headerContentType))
+			if ctype != mediaType {
+				log.Printf("Sniffed %s for %s (client sent %q)\n", mediaType, fileName, ctype)
+			}
+
+			err = link.Policy.checkPart(mediaType, link)
+		}
+
+		if err == nil {
+			// Reserve the image before streaming, so that parallel uploads can't go
+			// over the limits (bytes are reserved once we know the size).
+			var reserved *UploadLink
+			reserved, err = service.reserveLinkUsage(linkID, 1, 0)
+			if err == nil {
+				link = reserved
+			}
 		}
 
-		ctype := part.Header.Get(headerContentType)
-		if ctype == "" || !strings.HasPrefix(ctype, imageMediaType) {
-			// Ignore this part if this is not an image. We can bail out
-			// with an error in the future, if needed. Or, we could also
-			// stream the file and discard it whilst processing. Even then,
-			// we can't take it for granted - we have to check the magic
-			// numbers when we process the image.
+		if err != nil {
+			log.Printf("Rejected %s: %s\n", fileName, err.Error())
+			response.Rejected = append(response.Rejected, rejectedPart(fieldName, fileName, err))
+			if err == errDataUnavailable {
+				return &response, streamUnavailable
+			} else if err == errReadingPart {
+				break
+			}
+
 			continue
 		}
 
+		// Stream the bytes we've sniffed along with the rest of the part.
+		content := io.MultiReader(bytes.NewReader(head), part)
 		hasher := sha256.New()
 		imageID := randomAlphanumeric(imageIDLength)
-		fileName := part.FileName()
+
+		writer, partErr := service.objects.stageObject(imageID)
+		if partErr != nil {
+			log.Printf("Error staging %s (image ID: %s): %s\n", fileName, imageID, partErr.Error())
+			partErr = storageError(partErr)
+		}
 
 		var totalBytes int
-		for {
-			n, err := part.Read(buf)
+		for partErr == nil {
+			n, err := content.Read(buf)
 			totalBytes += n
 
-			// Make new slice as we'll update the existing slice in the next read.
-			slice := make([]byte, len(buf[:n]))
-			copy(slice, buf[:n])
+			partErr = link.Policy.checkSize(uint(totalBytes), link)
+			if partErr == nil && err != nil && err != io.EOF {
+				log.Printf("Error reading %s (image ID: %s): %s\n", fileName, imageID, err.Error())
+				partErr = errReadingPart
+			}
+
+			if partErr != nil {
+				// Stop streaming and get rid of whatever we've stored so far.
+				writer.abort()
+				break
+			}
+
 			// FIXME: Right now we're doing this for a file. Should we do this for
 			// each part instead? That helps with retrying from the part that was
 			// left out in an event of failure.
-			hasher.Write(slice)
-			service.objects.sendChunk(imageID, slice)
+			hasher.Write(buf[:n])
+			_, storeErr := writer.Write(buf[:n])
+			if storeErr == nil && err == io.EOF {
+				storeErr = writer.Close()
+			}
+
+			if storeErr != nil {
+				log.Printf("Error storing %s (image ID: %s): %s\n", fileName, imageID, storeErr.Error())
+				writer.abort()
+				partErr = storageError(storeErr)
+				break
+			}
 
 			if err == io.EOF {
-				if n != 0 {
-					// Send an empty chunk to stop streaming.
-					service.objects.sendChunk(imageID, []byte{})
-				}
+				break
+			}
+		}
+
+		reservedBytes := uint(0)
+		if partErr == nil {
+			reserved, err := service.reserveLinkUsage(linkID, 0, uint(totalBytes))
+			if err == nil {
+				link = reserved
+				reservedBytes = uint(totalBytes)
+			} else {
+				service.objects.discardObject(imageID)
+				partErr = err
+			}
+		}
 
+		if partErr != nil {
+			service.data.releaseLinkUsage(linkID, 1, 0)
+			log.Printf("Rejected %s (image ID: %s): %s\n", fileName, imageID, partErr.Error())
+			response.Rejected = append(response.Rejected, rejectedPart(fieldName, fileName, partErr))
+			// We can't read any further parts from a broken stream, and
+			// there's no point in storing further parts in a broken store.
+			if status := storageStatus(partErr); status != streamSuccess {
+				return &response, status
+			} else if partErr == errDataUnavailable {
+				return &response, streamUnavailable
+			} else if partErr == errReadingPart {
 				break
 			}
+
+			continue
+		}
+
+		processed, err := service.commitImage(linkID, imageID, ImageMeta{
+			Hash:      fmt.Sprintf("%x", hasher.Sum(nil)),
+			MediaType: mediaType,
+			Size:      uint(totalBytes),
+			Filename:  fileName,
+		})
+
+		if err != nil {
+			service.data.releaseLinkUsage(linkID, 1, reservedBytes)
+			response.Rejected = append(response.Rejected, rejectedPart(fieldName, fileName, err))
+			return &response, storageStatus(err)
 		}
 
 		log.Printf("Processed %s (image ID: %s)\n", fileName, imageID)
-		contentHash := fmt.Sprintf("%x", hasher.Sum(nil))
+		processed.Field = fieldName
+		response.Processed = append(response.Processed, processed)
+	}
+
+	return &response, streamSuccess
+}
+
+// commitImage that has been completely streamed to the store. The given metadata must
+// have the hash, media type, size and filename, and its usage must have been reserved
+// in the upload link (callers release it if this fails). The object is committed under
+// its hash, and if we already have an image with that hash, then its ID is used instead.
+// If the metadata can't be stored, then the object is left for `FileStore.recover` to
+// sweep (other uploads of the same content may be referring to it by then).
+func (service *ImageService) commitImage(linkID, imageID string, meta ImageMeta) (ProcessedImage, error) {
+	_, err := service.objects.commitObject(imageID, meta.Hash)
+	if err != nil {
+		log.Printf("Error committing image (ID: %s): %s\n", imageID, err.Error())
+		service.objects.discardObject(imageID)
+		return ProcessedImage{}, storageError(err)
+	}
+
+	existingImageID, err := service.data.fetchIDForHash(meta.Hash)
+	if err != nil {
+		return ProcessedImage{}, errDataUnavailable
+	}
+
+	meta.ID = imageID
+	meta.LinkID = linkID
+	meta.Uploaded = time.Now().UTC()
+
+	// Add known metadata for now, unless we already have this image (the store checks
+	// that atomically, so concurrent uploads of the same image end up as one).
+	if existingImageID == "" {
+		storedID, err := service.data.addImageData(meta)
+		if err != nil {
+			return ProcessedImage{}, errDataUnavailable
+		} else if storedID != imageID {
+			existingImageID = storedID
+		}
+	}
+
+	if existingImageID != "" {
+		log.Printf("Using existing image (ID: %s) for duplicate (ID: %s)\n", existingImageID, imageID)
+		imageID = existingImageID
+	} else {
+		// Queue the new image for getting additional data (which can be backfilled
+		// later, if this fails).
+		err = service.objects.queueImageForAnalysis(meta)
+		if err != nil {
+			log.Printf("Error queueing image (ID: %s) for analysis: %s\n", imageID, err.Error())
+		}
+	}
+
+	err = service.data.addLinkUpload(LinkUpload{
+		LinkID:    linkID,
+		ImageID:   imageID,
+		Filename:  meta.Filename,
+		Hash:      meta.Hash,
+		Size:      meta.Size,
+		Duplicate: existingImageID != "",
+		Uploaded:  meta.Uploaded,
+	})
+	if err != nil {
+		// The image has been stored, but it won't show up in the uploads of the link.
+		log.Printf("Error recording upload of image (ID: %s): %s\n", imageID, err.Error())
+	}
+
+	processed := ProcessedImage{
+		Filename: meta.Filename,
+		Status:   partStored,
+		ID:       imageID,
+		Hash:     meta.Hash,
+		Size:     meta.Size,
+	}
+
+	if existingImageID != "" {
+		processed.Status = partDuplicate
+		processed.Reason = errDuplicateImage.Error()
+	}
+
+	return processed, nil
+}
+
+// storageError for the given error from the object store, so that clients can
+// tell whether the store has run out of space.
+func storageError(err error) error {
+	if isStoreFull(err) {
+		return errInsufficientStorage
+	}
+
+	return errStoringImage
+}
+
+// storageStatus for the given error, or `streamSuccess` if it's not a storage error.
+func storageStatus(err error) StreamStatus {
+	switch err {
+	case errInsufficientStorage:
+		return streamInsufficientStorage
+	case errDataUnavailable:
+		return streamUnavailable
+	case errStoringImage:
+		return streamFailure
+	default:
+		return streamSuccess
+	}
+}
+
+// rejectedPart with the given field name and filename, which couldn't be stored
+// because of the given error. Parts which failed to be read or stored can be retried.
+func rejectedPart(fieldName, fileName string, err error) RejectedImage {
+	status := partRejected
+	if err == errReadingPart || storageStatus(err) != streamSuccess {
+		status = partFailed
+	}
 
-		existingImageID := service.data.fetchIDForHash(contentHash)
-		if existingImageID != "" {
-			log.Printf("Discarding possible duplicate image (ID: %s)\n", imageID)
-			service.objects.discardChunks(imageID)
-			imageID = existingImageID
+	return RejectedImage{
+		Field:    fieldName,
+		Filename: fileName,
+		Status:   status,
+		Reason:   err.Error(),
+	}
+}
+
+// StreamImageFromBackend if an image exists for the given image ID. Resized, cropped or
+// transcoded variants are streamed if they've been requested in the given query, or if
+// the `Accept` header doesn't allow the original format. Conditional
+// requests (`If-None-Match` and `If-Modified-Since`) and range requests (`Range` and
+// `If-Range`) are handled using the given request headers.
+func (service *ImageService) StreamImageFromBackend(imageID string, query url.Values, reqHeader http.Header, w http.ResponseWriter) StreamStatus {
+	meta, err := service.data.fetchImageMeta(imageID)
+	if err != nil {
+		return streamUnavailable
+	} else if meta == nil {
+		return streamInvalidImage
+	} else if meta.Broken {
+		// Neither the object nor its variants can be served (see `FileStore.recover`).
+		return streamBrokenImage
+	}
+
+	params, err := parseVariantParams(query, service.presets)
+	if err != nil {
+		return streamInvalidVariant
+	}
+
+	// Unless the format has been requested explicitly, the response depends on `Accept`.
+	w.Header().Set(headerVary, headerAccept)
+	if params == nil || params.Format == "" {
+		format, err := negotiateFormat(reqHeader.Get(headerAccept), variantMediaType(meta.MediaType, params))
+		if err != nil {
+			return streamNotAcceptable
+		}
+
+		if format != "" {
+			if params == nil {
+				params = &VariantParams{}
+			}
+
+			params.Format = format
+			params.validate()
 		}
+	}
+
+	// No need for a variant if the original is what's been requested.
+	if params != nil && params.Width == 0 && params.Height == 0 && variantMediaType(meta.MediaType, params) == meta.MediaType {
+		params = nil
+	}
+
+	if params != nil {
+		meta, err = service.fetchVariant(meta, *params)
+		if err == errUnsupportedImage {
+			return streamUnsupportedImage
+		} else if err == errImageTooLarge {
+			return streamImageTooLarge
+		} else if err != nil {
+			log.Printf("Failed to create variant of image (ID: %s): %s\n", imageID, err.Error())
+			return streamFailure
+		}
+	}
+
+	// Images never change for an ID, so the hash is a strong validator.
+	etag := fmt.Sprintf("\"%s\"", meta.Hash)
+	modified := meta.Uploaded.UTC().Truncate(time.Second)
+	size := int64(meta.Size)
+
+	h := w.Header()
+	h.Set(headerETag, etag)
+	h.Set(headerLastModified, modified.Format(http.TimeFormat))
+	h.Set(headerAcceptRanges, "bytes")
+
+	if isNotModified(reqHeader, etag, modified) {
+		return streamNotModified
+	}
+
+	ranges, err := parseRanges(reqHeader.Get(headerRange), size)
+	if err == errUnsatisfiableRange {
+		h.Set(headerContentRange, fmt.Sprintf("bytes */%d", size))
+		return streamInvalidRange
+	}
+
+	// Malformed ranges are ignored and so are the ranges for a stale `If-Range`.
+	if err != nil || !rangeApplies(reqHeader, etag, modified) {
+		ranges = nil
+	}
+
+	// Objects are read directly if the store allows it, and streamed as chunks otherwise.
+	reader, err := service.objects.openObject(meta.Hash)
+	if err == nil {
+		defer reader.Close()
+	} else if err != errNotSeekable {
+		log.Printf("Failed to open image (ID: %s): %s\n", imageID, err.Error())
+		return streamFailure
+	}
 
-		response.Processed = append(response.Processed, ProcessedImage{
-			Filename: fileName,
-			ID:       imageID,
-			Hash:     contentHash,
-			Size:     uint(totalBytes),
+	var started bool
+	switch len(ranges) {
+	case 0:
+		err = service.streamRange(meta.Hash, reader, byteRange{0, -1}, w, func() {
+			started = true
+			h.Set(headerContentType, meta.MediaType)
+			h.Set(headerContentLength, strconv.FormatInt(size, 10))
+			w.WriteHeader(http.StatusOK)
 		})
 
-		meta := ImageMeta{
-			ID:        imageID,
-			Hash:      contentHash,
-			MediaType: ctype,
-			Size:      uint(totalBytes),
-			Uploaded:  time.Now().UTC(),
+	case 1:
+		err = service.streamRange(meta.Hash, reader, ranges[0], w, func() {
+			started = true
+			h.Set(headerContentType, meta.MediaType)
+			h.Set(headerContentRange, ranges[0].contentRange(size))
+			h.Set(headerContentLength, strconv.FormatInt(ranges[0].length, 10))
+			w.WriteHeader(http.StatusPartialContent)
+		})
+
+	default:
+		writer := multipart.NewWriter(w)
+		for _, r := range ranges {
+			partHeader := rangePartHeader(r, meta.MediaType, size)
+			err = service.streamRange(meta.Hash, reader, r, w, func() {
+				if !started {
+					started = true
+					length := multipartRangesLength(ranges, meta.MediaType, size, writer.Boundary())
+					h.Set(headerContentType, "multipart/byteranges; boundary="+writer.Boundary())
+					h.Set(headerContentLength, strconv.FormatInt(length, 10))
+					w.WriteHeader(http.StatusPartialContent)
+				}
+
+				writer.CreatePart(partHeader)
+			})
+
+			if err != nil {
+				break
+			}
 		}
 
-		// Update the repository only if we've encountered a new image.
-		if existingImageID == "" {
-			// Add known metadata for now.
-			service.data.addImageData(meta)
-			// ... and queue the image for getting additional data.
-			service.objects.queueImageForAnalysis(meta)
+		if err == nil {
+			writer.Close()
 		}
 	}
 
-	return &response, streamSuccess
+	if err != nil {
+		log.Printf("Failed to stream image (ID: %s): %s\n", imageID, err.Error())
+		// We can't change the status once we've started streaming.
+		if !started {
+			return streamFailure
+		}
+	}
+
+	return streamSuccess
 }
 
-// StreamImageFromBackend if an image exists for the given image ID.
-func (service *ImageService) StreamImageFromBackend(imageID string, h http.Header, w io.Writer) StreamStatus {
-	meta := service.data.fetchImageMeta(imageID)
-	if meta == nil {
-		return streamInvalidImage
+// streamRange of the object with the given hash to the given writer, using the given
+// reader (if the object could be opened for random access) or the chunks from the store.
+// The given function is called once the object is available and before anything is
+// written, so that we can still respond with an error if the object can't be read.
+func (service *ImageService) streamRange(hash string, reader ObjectReader, span byteRange, w io.Writer, begin func()) error {
+	if reader == nil {
+		return service.streamChunks(hash, span, w, begin)
 	}
 
-	h.Set(headerContentType, meta.MediaType)
+	_, err := reader.Seek(span.start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	begin()
+	// The response writer can copy files without reading them into userspace.
+	if span.length < 0 {
+		_, err = io.Copy(w, reader)
+	} else {
+		_, err = io.CopyN(w, reader, span.length)
+	}
 
-	streamChan := service.objects.fetchChunks(imageID)
+	return err
+}
+
+// streamChunks of the object with the given hash (for the given range) to the given
+// writer. The given function is called before anything is written (see `streamRange`).
+func (service *ImageService) streamChunks(hash string, span byteRange, w io.Writer, begin func()) error {
+	streamChan := service.objects.fetchChunks(hash, span.start, span.length)
 	for {
 		chunk := <-streamChan
 		if chunk.err != nil && chunk.err != io.EOF {
-			log.Printf("Failed to stream image (ID: %s): %s\n", imageID, chunk.err.Error())
-			return streamFailure
+			return chunk.err
+		}
+
+		if begin != nil {
+			begin()
+			begin = nil
 		}
 
 		if chunk.isFinal {
-			break
+			return nil
 		}
 
-		n, err := w.Write(chunk.bytes)
-		if n == 0 || err != nil {
-			break
+		_, err := w.Write(chunk.bytes)
+		if err != nil {
+			// Drain the remaining chunks, so that the store doesn't block forever.
+			go func() {
+				for chunk := range streamChan {
+					if chunk.isFinal || chunk.err != nil {
+						return
+					}
+				}
+			}()
+
+			return err
 		}
 	}
-
-	return streamSuccess
 }
@@ -1,18 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/webp"
 )
 
 func TestLinkCreation(t *testing.T) {
 	assert := assert.New(t)
-	service := createService()
+	service := createService(t)
 	now := time.Now()
 	reqExpiry := now.Add(time.Duration(60) * time.Second)
 
@@ -24,8 +50,8 @@ func TestLinkCreation(t *testing.T) {
 	assert.Nil(err)
 	id := service.data.linkCache.Keys()[0]
 	assert.EqualValues(fmt.Sprintf("/booya/%s", id), req.RelativePath)
-	expiry, _ := service.data.linkCache.Get(id)
-	diff := expiry.(time.Time).Sub(reqExpiry)
+	link, _ := service.data.linkCache.Get(id)
+	diff := link.(UploadLink).Expiry.Sub(reqExpiry)
 	assert.Zero(int(diff.Seconds()))
 
 	req, err = service.CreateUploadLink(LinkCreationRequest{
@@ -36,14 +62,14 @@ func TestLinkCreation(t *testing.T) {
 	assert.Nil(err)
 	id = service.data.linkCache.Keys()[1]
 	assert.EqualValues(fmt.Sprintf("/booya/%s", id), req.RelativePath)
-	expiry, _ = service.data.linkCache.Get(id)
-	diff = expiry.(time.Time).Sub(now)
+	link, _ = service.data.linkCache.Get(id)
+	diff = link.(UploadLink).Expiry.Sub(now)
 	assert.EqualValues(2*86400+3*3600, int(diff.Seconds()))
 }
 
 func TestInvalidTimestamp(t *testing.T) {
 	assert := assert.New(t)
-	service := createService()
+	service := createService(t)
 	now := time.Now()
 	reqExpiry := now.Add(time.Duration(10) * time.Second) // 10 seconds in the future is invalid.
 
@@ -62,35 +88,1486 @@ func TestInvalidTimestamp(t *testing.T) {
 	assert.EqualValues(err, errInvalidExpiryTime)
 }
 
-func createService() *ImageService {
-	lCache, _ := lru.New(defaultLinkCacheCapacity)
-	mCache, _ := lru.New(defaultMetaCacheCapacity)
-	hashes, _ := lru.New(defaultHashesCacheCapacity)
-
-	dataRepo := &DataRepository{
-		linkCache: lCache,
-		metaCache: mCache,
-		hashes:    hashes,
-		dataStore: NoOpStore{},
-		cmdHub:    NewMessageHub(),
-	}
-
-	// It's fine if all those goroutines keep blocking - they're efficient,
-	// and they'll be killed when the program ends.
-	go dataRepo.handleCommands()
-
-	return &ImageService{
-		accessToken:      "foobar",
-		uploadLinkPrefix: "/booya",
-		data:             dataRepo,
-		objects: &ObjectsRepository{
-			data: dataRepo,
-			objectStore: &FileStore{
-				pathPrefix: "./",
-				openFds:    make(map[string]*os.File),
-			},
-			streamHub: NewMessageHub(),
-			imageHub:  NewMessageHub(),
-		},
+func TestLinkPolicy(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	dir := storeDir(service)
+	go service.objects.processChunks()
+
+	_, err := service.CreateUploadLink(LinkCreationRequest{
+		Duration:     "PT1H",
+		AllowedTypes: []string{"text/plain"},
+	})
+	assert.EqualValues(errInvalidMediaType, err)
+
+	_, err = service.CreateUploadLink(LinkCreationRequest{
+		Duration:  "PT1H",
+		NotBefore: time.Now().Add(2 * time.Hour).Format(time.RFC3339),
+	})
+	assert.EqualValues(errInvalidStartTime, err)
+
+	resp, err := service.CreateUploadLink(LinkCreationRequest{
+		Duration:  "PT1H",
+		NotBefore: time.Now().Add(time.Minute).Format(time.RFC3339),
+	})
+	assert.Nil(err)
+	assert.NotEmpty(resp.NotBefore)
+	_, code := service.StreamImagesToBackend(strings.TrimPrefix(resp.RelativePath, "/booya/"),
+		multipartReader(map[string]string{"image/png": pngMagic + "foo"}))
+	assert.EqualValues(streamInactiveUploadID, code)
+
+	resp, err = service.CreateUploadLink(LinkCreationRequest{
+		Duration:     "PT1H",
+		AllowedTypes: []string{"IMAGE/JPEG"},
+		MaxFileBytes: 600,
+		SingleUse:    true,
+	})
+	assert.Nil(err)
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	upload, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{
+		"image/png":  pngMagic + "foo",
+		"image/jpeg": jpegMagic + strings.Repeat("booya", 200),
+	}))
+	assert.EqualValues(streamSuccess, code)
+	assert.Empty(upload.Processed)
+	assert.Len(upload.Rejected, 2)
+	reasons := []string{upload.Rejected[0].Reason, upload.Rejected[1].Reason}
+	assert.Contains(reasons, errMediaTypeNotAllowed.Error())
+	assert.Contains(reasons, errFileTooLarge.Error())
+
+	assert.Empty(storedFiles(dir))
+
+	// Single use link cannot be used again.
+	_, code = service.StreamImagesToBackend(linkID, multipartReader(map[string]string{}))
+	assert.EqualValues(streamInvalidUploadID, code)
+}
+
+func TestConcurrentUploads(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	// Parallel uploads can't go over the limits of the link.
+	resp, err := service.CreateUploadLink(LinkCreationRequest{
+		Duration:      "PT1H",
+		MaxImages:     3,
+		MaxTotalBytes: 100,
+	})
+	assert.Nil(err)
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	var wg sync.WaitGroup
+	uploads := make([]*ImageUploadResponse, 16)
+	for i := range uploads {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := pngMagic + strings.Repeat("a", 20) + strconv.Itoa(i)
+			uploads[i], _ = service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": content}))
+		}(i)
+	}
+	wg.Wait()
+
+	var processed uint
+	for _, upload := range uploads {
+		processed += uint(len(upload.Processed))
+		for _, rejected := range upload.Rejected {
+			assert.EqualValues(errImageLimitReached.Error(), rejected.Reason)
+		}
+	}
+
+	assert.EqualValues(3, processed)
+	link, err := service.data.fetchUploadLink(linkID)
+	assert.Nil(err)
+	assert.EqualValues(3, link.Images)
+	assert.True(link.Bytes <= 100)
+
+	// Usage of failed uploads is released.
+	resp, _ = service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H", MaxImages: 1, MaxTotalBytes: 20})
+	linkID = strings.TrimPrefix(resp.RelativePath, "/booya/")
+	upload, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": pngMagic + strings.Repeat("a", 20)}))
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues(errByteLimitReached.Error(), upload.Rejected[0].Reason)
+	link, _ = service.data.fetchUploadLink(linkID)
+	assert.EqualValues(0, link.Images)
+	assert.EqualValues(0, link.Bytes)
+	upload, _ = service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": pngMagic + "foo"}))
+	assert.Len(upload.Processed, 1)
+}
+
+func TestConcurrentDuplicates(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	// Parallel uploads of the same image end up as one.
+	resp, err := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	assert.Nil(err)
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	var wg sync.WaitGroup
+	uploads := make([]*ImageUploadResponse, 8)
+	for i := range uploads {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uploads[i], _ = service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": pngMagic + "same"}))
+		}(i)
+	}
+	wg.Wait()
+
+	ids, duplicates := map[string]bool{}, 0
+	for _, upload := range uploads {
+		assert.Len(upload.Processed, 1)
+		ids[upload.Processed[0].ID] = true
+		if upload.Processed[0].Status == partDuplicate {
+			duplicates++
+		}
+	}
+
+	assert.Len(ids, 1)
+	assert.EqualValues(len(uploads)-1, duplicates)
+	metas, err := service.data.listImages("", 10)
+	assert.Nil(err)
+	assert.Len(metas, 1)
+}
+
+func TestContentSniffing(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	mediaType, err := sniffImage([]byte(jpegMagic + "foo"))
+	assert.Nil(err)
+	assert.EqualValues("image/jpeg", mediaType)
+	_, err = sniffImage([]byte{})
+	assert.EqualValues(errNotImageContent, err)
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	service.data.hashes.Add(fmt.Sprintf("%x", sha256.Sum256([]byte(pngMagic+"foo"))), "foo")
+	service.data.hashes.Add(fmt.Sprintf("%x", sha256.Sum256([]byte(jpegMagic+"bar"))), "bar")
+
+	upload, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{
+		// Wrong or missing types are fine as long as the content is an image.
+		"text/plain": pngMagic + "foo",
+		"":           jpegMagic + "bar",
+		"image/png":  "booya",
+		"image/gif":  "",
+	}))
+	assert.EqualValues(streamSuccess, code)
+	assert.Len(upload.Processed, 2)
+	assert.Len(upload.Rejected, 2)
+	for _, rejected := range upload.Rejected {
+		assert.EqualValues("image", rejected.Field)
+		assert.EqualValues(partRejected, rejected.Status)
+		assert.EqualValues(errNotImageContent.Error(), rejected.Reason)
+	}
+
+	// Both images already exist.
+	for _, processed := range upload.Processed {
+		assert.EqualValues("image", processed.Field)
+		assert.EqualValues(partDuplicate, processed.Status)
+		assert.EqualValues(errDuplicateImage.Error(), processed.Reason)
+	}
+
+	link, err := service.data.fetchUploadLink(linkID)
+	assert.Nil(err)
+	assert.EqualValues(2, link.Images)
+}
+
+func TestUploadStatus(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	dir := storeDir(service)
+	go service.objects.processChunks()
+
+	stored := ProcessedImage{Status: partStored}
+	rejected := RejectedImage{Status: partRejected}
+	failed := RejectedImage{Status: partFailed}
+	for _, c := range []struct {
+		resp ImageUploadResponse
+		code int
+	}{
+		{ImageUploadResponse{}, http.StatusOK},
+		{ImageUploadResponse{Processed: []ProcessedImage{stored}}, http.StatusOK},
+		{ImageUploadResponse{Processed: []ProcessedImage{stored}, Rejected: []RejectedImage{failed}}, http.StatusMultiStatus},
+		{ImageUploadResponse{Rejected: []RejectedImage{rejected, failed}}, http.StatusMultiStatus},
+		{ImageUploadResponse{Rejected: []RejectedImage{rejected}}, http.StatusUnprocessableEntity},
+		{ImageUploadResponse{Rejected: []RejectedImage{failed, failed}}, http.StatusInternalServerError},
+	} {
+		assert.EqualValues(c.code, uploadStatus(&c.resp))
+	}
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	// Stream breaks in the middle of the second part.
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("first", "first.png")
+	part.Write([]byte(pngMagic + "foo"))
+	part, _ = writer.CreateFormFile("second", "second.png")
+	part.Write([]byte(pngMagic + strings.Repeat("booya", 1000)))
+	broken := io.LimitReader(body, int64(body.Len()-100))
+
+	upload, code := service.StreamImagesToBackend(linkID, multipart.NewReader(broken, writer.Boundary()))
+	assert.EqualValues(streamSuccess, code)
+	assert.Len(upload.Processed, 1)
+	assert.EqualValues("first", upload.Processed[0].Field)
+	assert.EqualValues(partStored, upload.Processed[0].Status)
+	assert.Len(upload.Rejected, 1)
+	assert.EqualValues("second", upload.Rejected[0].Field)
+	assert.EqualValues(partFailed, upload.Rejected[0].Status)
+	assert.EqualValues(errReadingPart.Error(), upload.Rejected[0].Reason)
+
+	// Nothing's left behind from the failed part, and the first one is content-addressed.
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(pngMagic+"foo")))
+	assert.EqualValues([]string{filepath.Join(dir, "objects", hash[:2], hash[2:4], hash)}, storedFiles(dir))
+}
+
+// fullStore is a file store which runs out of space after some bytes.
+type fullStore struct {
+	*FileStore
+	space int
+}
+
+func (store *fullStore) stageObject(id string) (ObjectWriter, error) {
+	writer, err := store.FileStore.stageObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fullWriter{writer, store}, nil
+}
+
+type fullWriter struct {
+	ObjectWriter
+	store *fullStore
+}
+
+func (w *fullWriter) Write(chunk []byte) (int, error) {
+	w.store.space -= len(chunk)
+	if w.store.space < 0 {
+		return 0, &os.PathError{Op: "write", Path: "booya", Err: syscall.ENOSPC}
+	}
+
+	return w.ObjectWriter.Write(chunk)
+}
+
+func TestStorageErrors(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	dir := storeDir(service)
+	service.objects.objectStore = &fullStore{
+		FileStore: service.objects.objectStore.(*FileStore),
+		space:     1000,
+	}
+	go service.objects.processChunks()
+
+	assert.EqualValues(errInsufficientStorage, storageError(&os.PathError{Err: syscall.EDQUOT}))
+	assert.EqualValues(errInsufficientStorage, storageError(errStoreFull))
+	assert.EqualValues(errStoringImage, storageError(os.ErrPermission))
+	assert.EqualValues(http.StatusInsufficientStorage, tusErrorStatus(errInsufficientStorage))
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(pngMagic+"foo")))
+
+	// We run out of space in the second part, so the third one isn't stored.
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, field := range []string{"first", "second", "third"} {
+		content := pngMagic + "foo"
+		if field == "second" {
+			content = pngMagic + strings.Repeat("foo", 1000)
+		}
+
+		part, _ := writer.CreateFormFile(field, field+".png")
+		part.Write([]byte(content))
+	}
+	writer.Close()
+
+	upload, code := service.StreamImagesToBackend(linkID, multipart.NewReader(body, writer.Boundary()))
+	assert.EqualValues(streamInsufficientStorage, code)
+	assert.Len(upload.Processed, 1)
+	assert.EqualValues("first", upload.Processed[0].Field)
+	assert.Len(upload.Rejected, 1)
+	assert.EqualValues("second", upload.Rejected[0].Field)
+	assert.EqualValues(partFailed, upload.Rejected[0].Status)
+	assert.EqualValues(errInsufficientStorage.Error(), upload.Rejected[0].Reason)
+
+	// Partial object has been removed, and the third part hasn't been stored.
+	assert.EqualValues([]string{filepath.Join(dir, "objects", hash[:2], hash[2:4], hash)}, storedFiles(dir))
+}
+
+// flakyStore is a data store which can go down (or fail to store metadata), or stall
+// while collecting stats.
+type flakyStore struct {
+	DataStore
+	down     bool
+	metaDown bool
+	stall    chan struct{}
+}
+
+func (store *flakyStore) addImageMeta(meta ImageMeta) (string, error) {
+	if store.metaDown {
+		return "", errors.New("connection refused")
+	}
+
+	return store.DataStore.addImageMeta(meta)
+}
+
+func (store *flakyStore) getUploadLink(id string) (*UploadLink, error) {
+	if store.down {
+		return nil, errors.New("connection refused")
+	}
+
+	return store.DataStore.getUploadLink(id)
+}
+
+func (store *flakyStore) getServiceStats() (*ServiceStats, error) {
+	<-store.stall
+	return store.DataStore.getServiceStats()
+}
+
+func TestUnstoredMetadata(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	store := &flakyStore{DataStore: service.data.dataStore, metaDown: true}
+	service.data.dataStore = store
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H", MaxImages: 1, MaxTotalBytes: 20})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	upload, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": pngMagic + "foo"}))
+	assert.EqualValues(streamUnavailable, code)
+	assert.EqualValues(partFailed, upload.Rejected[0].Status)
+
+	// Usage of the link is released, and the object (which has been committed) is
+	// swept on the next start.
+	link, _ := service.data.fetchUploadLink(linkID)
+	assert.EqualValues(0, link.Images)
+	assert.EqualValues(0, link.Bytes)
+	dir := storeDir(service)
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(pngMagic+"foo")))
+	assert.EqualValues([]string{filepath.Join(dir, "objects", hash[:2], hash[2:4], hash)}, storedFiles(dir))
+
+	// Objects of other images (and variants) are left alone.
+	store.metaDown = false
+	upload, _ = service.StreamImagesToBackend(linkID, multipartReader(map[string]string{"image/png": pngMagic + "bar"}))
+	assert.Len(upload.Processed, 1)
+	writeObject(service, "abc-16x16-cover-q80", []byte("booya"))
+	store.saveVariant(ImageVariant{ID: "variant-abc-16x16-cover-q80", Hash: "abc-16x16-cover-q80", Size: 5})
+
+	assert.Nil(service.objects.objectStore.(*FileStore).recover(store))
+	assert.ElementsMatch([]string{
+		filepath.Join(dir, "objects", "ab", "c-", "abc-16x16-cover-q80"),
+		filepath.Join(dir, "objects", upload.Processed[0].Hash[:2], upload.Processed[0].Hash[2:4], upload.Processed[0].Hash),
+		filepath.Join(dir, "quarantine", hash),
+	}, storedFiles(dir))
+}
+
+func TestDataStoreErrors(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	store := &flakyStore{DataStore: service.data.dataStore, down: true, stall: make(chan struct{})}
+	service.data.dataStore = store
+
+	resp, err := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	assert.Nil(err)
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	service.data.linkCache.Purge()
+
+	// Store failures aren't reported as missing links.
+	_, err = service.GetUploadLink(linkID)
+	assert.EqualValues(errDataUnavailable, err)
+	_, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{}))
+	assert.EqualValues(streamUnavailable, code)
+	w := httptest.NewRecorder()
+	service.fetchLinkDetails(w, mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"id": linkID}))
+	assert.EqualValues(http.StatusServiceUnavailable, w.Code)
+	assert.EqualValues(http.StatusServiceUnavailable, tusErrorStatus(errDataUnavailable))
+
+	// Slow commands don't hold up the others.
+	store.down = false
+	done := make(chan struct{})
+	go func() {
+		service.data.fetchStats()
+		close(done)
+	}()
+
+	details, err := service.GetUploadLink(linkID)
+	assert.Nil(err)
+	assert.True(details.Active)
+	close(store.stall)
+	<-done
+}
+
+func TestLinkManagement(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+
+	resp, err := service.CreateUploadLink(LinkCreationRequest{
+		Duration:  "PT1H",
+		MaxImages: 5,
+	})
+	assert.Nil(err)
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	details, err := service.GetUploadLink(linkID)
+	assert.Nil(err)
+	assert.True(details.Active)
+	assert.EqualValues(5, details.MaxImages)
+	_, err = service.GetUploadLink("foobar")
+	assert.EqualValues(errUnknownLink, err)
+
+	details, err = service.UpdateUploadLinkExpiry(linkID, LinkUpdateRequest{Duration: "P1D"})
+	assert.Nil(err)
+	link, _ := service.data.linkCache.Get(linkID)
+	diff := link.(UploadLink).Expiry.Sub(time.Now())
+	assert.EqualValues(86400, int(diff.Seconds()+1))
+
+	_, err = service.UpdateUploadLinkExpiry(linkID, LinkUpdateRequest{Duration: "PT1S"})
+	assert.EqualValues(errInvalidExpiryTime, err)
+	_, err = service.UpdateUploadLinkExpiry("foobar", LinkUpdateRequest{Duration: "P1D"})
+	assert.EqualValues(errUnknownLink, err)
+
+	_, err = service.GetLinkUploads("foobar")
+	assert.EqualValues(errUnknownLink, err)
+	uploads, err := service.GetLinkUploads(linkID)
+	assert.Nil(err)
+	assert.Empty(uploads.Images)
+
+	assert.Nil(service.RevokeUploadLink(linkID))
+	assert.EqualValues(errUnknownLink, service.RevokeUploadLink("foobar"))
+	details, _ = service.GetUploadLink(linkID)
+	assert.False(details.Active)
+	_, code := service.StreamImagesToBackend(linkID, multipartReader(map[string]string{}))
+	assert.EqualValues(streamInvalidUploadID, code)
+
+	_, err = service.ListUploadLinks("foobar", 1, 10)
+	assert.EqualValues(errInvalidLinkStatus, err)
+	_, err = service.ListUploadLinks(linkStatusActive, 0, 10)
+	assert.EqualValues(errInvalidPage, err)
+}
+
+func TestUploadFlow(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+	go service.objects.processImages()
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, content := range []string{pngMagic + "foo", pngMagic + "boo", jpegMagic + "bar", pngMagic + "foo"} {
+		part, _ := writer.CreateFormFile("image", "image")
+		part.Write([]byte(content))
+	}
+	writer.Close()
+
+	upload, code := service.StreamImagesToBackend(linkID, multipart.NewReader(body, writer.Boundary()))
+	assert.EqualValues(streamSuccess, code)
+	assert.Empty(upload.Rejected)
+	assert.Len(upload.Processed, 4)
+	for i, status := range []string{partStored, partStored, partStored, partDuplicate} {
+		assert.EqualValues(status, upload.Processed[i].Status)
+	}
+
+	// Duplicate refers to the image which has been stored first.
+	first := upload.Processed[0]
+	assert.EqualValues(first.ID, upload.Processed[3].ID)
+	meta, err := service.data.fetchImageMeta(first.ID)
+	assert.Nil(err)
+	assert.EqualValues(first.Hash, meta.Hash)
+	assert.EqualValues("image/png", meta.MediaType)
+	meta, err = service.data.fetchImageMeta("foobar")
+	assert.Nil(err)
+	assert.Nil(meta)
+
+	uploads, err := service.GetLinkUploads(linkID)
+	assert.Nil(err)
+	assert.Len(uploads.Images, 4)
+	assert.True(uploads.Images[3].Duplicate)
+
+	// Wait for the images to be analyzed.
+	for i := 0; i < 100; i++ {
+		if meta, _ := service.data.fetchImageMeta(upload.Processed[2].ID); meta.CameraModel != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	now := time.Now().UTC()
+	stats, err := service.data.fetchStats()
+	assert.Nil(err)
+	assert.EqualValues(PopularFormat{Format: "PNG", Uploads: 2}, stats.PopularFormat)
+	assert.EqualValues([]CameraModel{{Model: "unknown", Uploads: 3}}, stats.Top10CameraModels)
+	assert.EqualValues([]DayFrequency{{
+		Date:    time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC),
+		Uploads: 3,
+	}}, stats.UploadFrequency30Days)
+
+	// Links are listed by expiry, and revoked links are expired.
+	resp, _ = service.CreateUploadLink(LinkCreationRequest{Duration: "PT2H"})
+	otherID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	links, err := service.ListUploadLinks("", 1, 1)
+	assert.Nil(err)
+	assert.EqualValues(2, links.Total)
+	assert.EqualValues(otherID, links.Links[0].ID)
+	links, _ = service.ListUploadLinks("", 2, 1)
+	assert.EqualValues(linkID, links.Links[0].ID)
+	links, _ = service.ListUploadLinks("", 3, 1)
+	assert.Empty(links.Links)
+
+	service.RevokeUploadLink(otherID)
+	links, _ = service.ListUploadLinks(linkStatusActive, 1, 10)
+	assert.Len(links.Links, 1)
+	assert.EqualValues(linkID, links.Links[0].ID)
+	links, _ = service.ListUploadLinks(linkStatusExpired, 1, 10)
+	assert.Len(links.Links, 1)
+	assert.EqualValues(otherID, links.Links[0].ID)
+}
+
+func TestAnalysisJobs(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	assert.EqualValues(analysisRetryBaseDelay, analysisBackoff(1))
+	assert.EqualValues(4*analysisRetryBaseDelay, analysisBackoff(3))
+	assert.EqualValues(analysisMaxRetryDelay, analysisBackoff(100))
+
+	// Objects haven't been stored yet, so analysis fails.
+	content := []byte(pngMagic + "foo")
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))
+	for _, id := range []string{"foo", "bar"} {
+		meta := ImageMeta{ID: id, Hash: hash, MediaType: "image/png"}
+		service.data.addImageData(meta)
+		service.objects.queueImageForAnalysis(meta)
+	}
+
+	job, err := service.GetAnalysisJob("foo")
+	assert.Nil(err)
+	assert.EqualValues(jobPending, job.State)
+	assert.EqualValues(0, job.Attempts)
+	job, err = service.GetAnalysisJob("booya")
+	assert.Nil(err)
+	assert.Nil(job)
+	job, _ = service.GetAnalysisJob("foo")
+
+	now := time.Now().UTC()
+	service.objects.runAnalysisJob(*job)
+	job, _ = service.GetAnalysisJob("foo")
+	assert.EqualValues(jobPending, job.State)
+	assert.EqualValues(1, job.Attempts)
+	assert.NotEmpty(job.LastError)
+	assert.True(job.NextAttempt.After(now))
+	meta, _ := service.data.fetchImageMeta("foo")
+	assert.EqualValues("", meta.CameraModel)
+
+	// Only the other job is due right now.
+	jobs, err := service.data.listAnalysisJobs(JobFilter{States: []string{jobPending, jobRunning}, DueBy: now, Limit: 10})
+	assert.Nil(err)
+	assert.Len(jobs, 1)
+	assert.EqualValues("bar", jobs[0].ImageID)
+
+	writeObject(service, hash, content)
+	service.objects.runAnalysisJob(*job)
+	job, _ = service.GetAnalysisJob("foo")
+	assert.EqualValues(jobDone, job.State)
+	assert.EqualValues(2, job.Attempts)
+	assert.Empty(job.LastError)
+	meta, _ = service.data.fetchImageMeta("foo")
+	assert.EqualValues("unknown", meta.CameraModel)
+
+	// Jobs give up after some attempts.
+	service.data.addImageData(ImageMeta{ID: "baz", Hash: "booya"})
+	service.objects.queueImageForAnalysis(ImageMeta{ID: "baz"})
+	for i := 0; i < maxAnalysisAttempts; i++ {
+		job, _ = service.GetAnalysisJob("baz")
+		service.objects.runAnalysisJob(*job)
+	}
+
+	job, _ = service.GetAnalysisJob("baz")
+	assert.EqualValues(jobFailed, job.State)
+	assert.EqualValues(maxAnalysisAttempts, job.Attempts)
+
+	// Nothing is running the queued jobs in this test.
+	status, err := service.GetAnalysisStatus()
+	assert.Nil(err)
+	assert.EqualValues(1, status.Pending)
+	assert.EqualValues(0, status.Running)
+	assert.EqualValues(1, status.Done)
+	assert.EqualValues(1, status.Failed)
+	assert.EqualValues(queuePolicySpill, status.Queue.Policy)
+	assert.EqualValues(3, status.Queue.Depth)
+	assert.Len(status.Queue.Workers, 1)
+}
+
+func TestResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	dir := storeDir(service)
+	go service.objects.processChunks()
+
+	metadata, err := parseTusMetadata("filename Ym9veWEucG5n,filetype aW1hZ2UvcG5n, empty")
+	assert.Nil(err)
+	assert.EqualValues(map[string]string{"filename": "booya.png", "filetype": "image/png", "empty": ""}, metadata)
+	_, err = parseTusMetadata("filename !!!")
+	assert.EqualValues(errInvalidMetadata, err)
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{
+		Duration:     "PT1H",
+		MaxFileBytes: 10,
+	})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	_, err = service.CreateTusUpload(linkID, 5, map[string]string{"filetype": "text/plain"})
+	assert.EqualValues(errNotAnImage, err)
+	_, err = service.CreateTusUpload(linkID, 50, metadata)
+	assert.EqualValues(errFileTooLarge, err)
+	_, err = service.CreateTusUpload("foobar", 5, metadata)
+	assert.EqualValues(errUnknownLink, err)
+
+	upload, err := service.CreateTusUpload(linkID, 10, metadata)
+	assert.Nil(err)
+	assert.Nil(service.GetTusUpload("foobar", upload.ID))
+
+	content := pngMagic + "xy"
+	upload, processed, err := service.AppendTusUpload(linkID, upload.ID, 0, strings.NewReader(content[:5]))
+	assert.Nil(err)
+	assert.Nil(processed)
+	assert.EqualValues(5, service.GetTusUpload(linkID, upload.ID).Offset)
+
+	_, _, err = service.AppendTusUpload(linkID, upload.ID, 0, strings.NewReader(content[:5]))
+	assert.EqualValues(errUploadOffsetMismatch, err)
+
+	// Completed upload is a duplicate of some existing image.
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	service.data.hashes.Add(hash, "foo")
+	upload, processed, err = service.AppendTusUpload(linkID, upload.ID, 5, strings.NewReader(content[5:]+"booya"))
+	assert.Nil(err)
+	assert.EqualValues(10, upload.Offset)
+	assert.EqualValues("foo", processed.ID)
+	assert.EqualValues(hash, processed.Hash)
+	assert.Nil(service.GetTusUpload(linkID, upload.ID))
+
+	upload, _ = service.CreateTusUpload(linkID, 10, metadata)
+	service.AppendTusUpload(linkID, upload.ID, 0, strings.NewReader("boo"))
+	assert.Nil(service.TerminateTusUpload(linkID, upload.ID))
+	assert.EqualValues(errUnknownUpload, service.TerminateTusUpload(linkID, upload.ID))
+
+	// Content is sniffed regardless of the declared type.
+	upload, _ = service.CreateTusUpload(linkID, 10, metadata)
+	_, _, err = service.AppendTusUpload(linkID, upload.ID, 0, strings.NewReader("booyabooya"))
+	assert.EqualValues(errNotImageContent, err)
+	assert.Nil(service.GetTusUpload(linkID, upload.ID))
+
+	// Only the completed upload has been committed (and the others have released
+	// the usage reserved for them).
+	assert.EqualValues([]string{service.objects.objectStore.(*FileStore).objectPath(hash)}, storedFiles(dir))
+	link, _ := service.data.fetchUploadLink(linkID)
+	assert.EqualValues(1, link.Images)
+	assert.EqualValues(10, link.Bytes)
+
+	_, err = service.CreateTusUpload(linkID, defaultTusMaxSize+1, metadata)
+	assert.EqualValues(errFileTooLarge, err)
+}
+
+func TestIdleResumableUploads(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	dir := storeDir(service)
+	metadata := map[string]string{"filetype": "image/png"}
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H", MaxImages: 2})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+	idle, err := service.CreateTusUpload(linkID, 100, metadata)
+	assert.Nil(err)
+	service.AppendTusUpload(linkID, idle.ID, 0, strings.NewReader(pngMagic))
+	busy, err := service.CreateTusUpload(linkID, 100, metadata)
+	assert.Nil(err)
+	service.data.lockTusUpload(busy.ID)
+
+	// Limits of the link are held by the ongoing uploads.
+	_, err = service.CreateTusUpload(linkID, 100, metadata)
+	assert.EqualValues(errImageLimitReached, err)
+
+	// Recent uploads are kept.
+	now := time.Now().UTC()
+	service.removeIdleTusUploads(now)
+	assert.NotNil(service.GetTusUpload(linkID, idle.ID))
+
+	// Idle uploads are removed along with their objects, but not the ones being appended.
+	service.removeIdleTusUploads(now.Add(defaultTusIdleTimeout + time.Second))
+	assert.Nil(service.GetTusUpload(linkID, idle.ID))
+	assert.NotNil(service.GetTusUpload(linkID, busy.ID))
+	assert.Empty(storedFiles(dir))
+	link, _ := service.data.fetchUploadLink(linkID)
+	assert.EqualValues(1, link.Images)
+	assert.EqualValues(100, link.Bytes)
+
+	// Uploads are removed once their link expires.
+	upload, err := service.CreateTusUpload(linkID, 100, metadata)
+	assert.Nil(err)
+	assert.Nil(service.RevokeUploadLink(linkID))
+	service.removeIdleTusUploads(time.Now().UTC())
+	assert.Nil(service.GetTusUpload(linkID, upload.ID))
+}
+
+func TestFileStoreCommit(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store := &FileStore{
+		pathPrefix: dir,
+	}
+
+	assert.EqualValues("ab/cd/abcdef", contentAddress("abcdef"))
+	writer, err := store.stageObject("foo")
+	assert.Nil(err)
+	writer.Write([]byte("boo"))
+	writer.Write([]byte("ya"))
+	assert.Nil(writer.Close())
+
+	// Objects aren't visible until they're committed.
+	_, err = store.getImageReader("abcdef")
+	assert.NotNil(err)
+	exists, err := store.commitObject("foo", "abcdef")
+	assert.Nil(err)
+	assert.False(exists)
+
+	writer, _ = store.stageObject("bar")
+	writer.Write([]byte("booya"))
+	assert.Nil(writer.Close())
+	exists, err = store.commitObject("bar", "abcdef")
+	assert.Nil(err)
+	assert.True(exists)
+	assert.EqualValues([]string{filepath.Join(dir, "objects", "ab", "cd", "abcdef")}, storedFiles(dir))
+
+	// Aborted objects can't be committed.
+	writer, _ = store.stageObject("baz")
+	writer.Write([]byte("boo"))
+	assert.Nil(writer.abort())
+	_, err = store.commitObject("baz", "abcd00")
+	assert.NotNil(err)
+
+	reader, err := store.getImageReader("abcdef")
+	assert.Nil(err)
+	data, _ := ioutil.ReadAll(reader)
+	store.cleanupImageReader("abcdef", reader)
+	assert.EqualValues("booya", string(data))
+
+	store.removeObject("abcdef")
+	assert.Empty(storedFiles(dir))
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	store := &FileStore{
+		pathPrefix: dir,
+	}
+
+	for hash, data := range map[string]string{"abcdef": "booya", "abcd00": "boo"} {
+		writer, _ := store.stageObject(hash)
+		writer.Write([]byte(data))
+		writer.Close()
+		store.commitObject(hash, hash)
+	}
+
+	// Upload which was interrupted by a crash.
+	writer, _ := store.stageObject("foo")
+	writer.Write([]byte("boo"))
+
+	data := NewMemoryStore()
+	for _, meta := range []ImageMeta{
+		{ID: "ok", Hash: "abcdef", Size: 5},
+		{ID: "missing", Hash: "123456", Size: 5},
+		{ID: "truncated", Hash: "abcd00", Size: 5},
+	} {
+		data.addImageMeta(meta)
+	}
+	store = &FileStore{
+		pathPrefix: dir,
+	}
+
+	assert.Nil(store.recover(data))
+	metas, _ := data.listImageMeta(0, -1)
+	assert.ElementsMatch([]ImageMeta{
+		{ID: "ok", Hash: "abcdef", Size: 5},
+		{ID: "missing", Hash: "123456", Size: 5, Broken: true},
+		{ID: "truncated", Hash: "abcd00", Size: 5, Broken: true},
+	}, metas)
+	assert.EqualValues([]string{
+		filepath.Join(dir, "objects", "ab", "cd", "abcdef"),
+		filepath.Join(dir, "quarantine", "abcd00"),
+		filepath.Join(dir, "quarantine", "foo"),
+	}, storedFiles(dir))
+
+	// Nothing changes when we're already clean.
+	assert.Nil(store.recover(data))
+	metas, _ = data.listImageMeta(0, -1)
+	assert.Len(metas, 3)
+	assert.Len(storedFiles(dir), 3)
+
+	// Flag is cleared once the object is back.
+	writer, _ = store.stageObject("missing")
+	writer.Write([]byte("booya"))
+	writer.Close()
+	store.commitObject("missing", "123456")
+	assert.Nil(store.recover(data))
+	meta, _ := data.fetchImageMeta("missing")
+	assert.False(meta.Broken)
+
+	// Metadata is left alone if most of the objects are missing (say, the wrong
+	// directory has been mounted).
+	store = &FileStore{
+		pathPrefix: t.TempDir(),
+	}
+	assert.Nil(store.recover(data))
+	for _, id := range []string{"ok", "missing"} {
+		meta, _ = data.fetchImageMeta(id)
+		assert.False(meta.Broken)
+	}
+
+	// Objects from the old layout (named by image ID) are moved to their content
+	// address, and duplicates of those are quarantined.
+	store = &FileStore{
+		pathPrefix: t.TempDir(),
+	}
+	for id, content := range map[string]string{"ok": "booya", "missing": "booya", "truncated": "boo"} {
+		assert.Nil(ioutil.WriteFile(filepath.Join(store.pathPrefix, id), []byte(content), 0644))
+	}
+	data.updateImageMeta(ImageMeta{ID: "missing", Hash: "abcdef", Size: 5})
+	assert.Nil(store.recover(data))
+	metas, _ = data.listImageMeta(0, -1)
+	assert.ElementsMatch([]ImageMeta{
+		{ID: "ok", Hash: "abcdef", Size: 5},
+		{ID: "missing", Hash: "abcdef", Size: 5},
+		{ID: "truncated", Hash: "abcd00", Size: 5, Broken: true},
+	}, metas)
+	files := storedFiles(store.pathPrefix)
+	assert.Len(files, 3)
+	assert.Contains(files, filepath.Join(store.pathPrefix, "objects", "ab", "cd", "abcdef"))
+	assert.Contains(files, filepath.Join(store.pathPrefix, "quarantine", "abcd00"))
+	assert.EqualValues(filepath.Join(store.pathPrefix, "quarantine"), filepath.Dir(files[2]))
+
+	// Errors other than missing objects aren't taken as missing either.
+	store = &FileStore{
+		pathPrefix: t.TempDir(),
+	}
+	assert.Nil(os.MkdirAll(filepath.Join(store.pathPrefix, "objects"), os.ModePerm))
+	assert.Nil(ioutil.WriteFile(filepath.Join(store.pathPrefix, "objects", "ab"), nil, 0644))
+	assert.NotNil(store.recover(data))
+	meta, _ = data.fetchImageMeta("ok")
+	assert.False(meta.Broken)
+}
+
+func TestParseRanges(t *testing.T) {
+	assert := assert.New(t)
+
+	ranges, err := parseRanges("bytes=0-4, 10-, -3", 20)
+	assert.Nil(err)
+	assert.EqualValues([]byteRange{{0, 5}, {10, 10}, {17, 3}}, ranges)
+
+	ranges, err = parseRanges("bytes=15-100,50-60", 20)
+	assert.Nil(err)
+	assert.EqualValues([]byteRange{{15, 5}}, ranges)
+
+	_, err = parseRanges("bytes=50-60", 20)
+	assert.EqualValues(errUnsatisfiableRange, err)
+	_, err = parseRanges("bytes=5-1", 20)
+	assert.EqualValues(errMalformedRange, err)
+	_, err = parseRanges("items=0-1", 20)
+	assert.EqualValues(errMalformedRange, err)
+}
+
+// chunkedStore is a store which can't be opened for random access.
+type chunkedStore struct {
+	ObjectStore
+}
+
+func TestImageDownload(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	fileStore := service.objects.objectStore.(*FileStore)
+	go service.objects.processChunks()
+
+	data := []byte(strings.Repeat("booya", 200))
+	writeObject(service, "bar", data)
+	uploaded := time.Date(2019, 10, 14, 6, 21, 46, 0, time.UTC)
+	service.data.metaCache.Add("foo", ImageMeta{
+		ID:        "foo",
+		Hash:      "bar",
+		MediaType: "image/png",
+		Size:      uint(len(data)),
+		Uploaded:  uploaded,
+	})
+
+	fetch := func(headers map[string]string) *httptest.ResponseRecorder {
+		header := http.Header{}
+		for k, v := range headers {
+			header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		code := service.StreamImageFromBackend("foo", nil, header, w)
+		if code == streamNotModified {
+			w.WriteHeader(http.StatusNotModified)
+		} else if code == streamInvalidRange {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		}
+		return w
+	}
+
+	// Files are copied directly, but other stores stream the chunks.
+	for _, store := range []ObjectStore{fileStore, chunkedStore{fileStore}} {
+		service.objects.objectStore = store
+		w := fetch(nil)
+		assert.EqualValues(http.StatusOK, w.Code)
+		assert.EqualValues(data, w.Body.Bytes())
+		assert.EqualValues("1000", w.Header().Get(headerContentLength))
+		assert.EqualValues(`"bar"`, w.Header().Get(headerETag))
+		assert.EqualValues("bytes", w.Header().Get(headerAcceptRanges))
+		assert.EqualValues(uploaded.Format(http.TimeFormat), w.Header().Get(headerLastModified))
+
+		w = fetch(map[string]string{headerIfNoneMatch: `"foo", W/"bar"`})
+		assert.EqualValues(http.StatusNotModified, w.Code)
+		w = fetch(map[string]string{headerIfModifiedSince: uploaded.Format(http.TimeFormat)})
+		assert.EqualValues(http.StatusNotModified, w.Code)
+		w = fetch(map[string]string{
+			headerIfNoneMatch:     `"foo"`,
+			headerIfModifiedSince: uploaded.Format(http.TimeFormat),
+		})
+		assert.EqualValues(http.StatusOK, w.Code)
+
+		w = fetch(map[string]string{headerRange: "bytes=600-"})
+		assert.EqualValues(http.StatusPartialContent, w.Code)
+		assert.EqualValues(data[600:], w.Body.Bytes())
+		assert.EqualValues("bytes 600-999/1000", w.Header().Get(headerContentRange))
+
+		w = fetch(map[string]string{headerRange: "bytes=600-", headerIfRange: `"foo"`})
+		assert.EqualValues(http.StatusOK, w.Code)
+		assert.EqualValues(data, w.Body.Bytes())
+
+		w = fetch(map[string]string{headerRange: "bytes=2000-"})
+		assert.EqualValues(http.StatusRequestedRangeNotSatisfiable, w.Code)
+		assert.EqualValues("bytes */1000", w.Header().Get(headerContentRange))
+
+		w = fetch(map[string]string{headerRange: "bytes=-10,0-4"})
+		assert.EqualValues(http.StatusPartialContent, w.Code)
+		assert.EqualValues(strconv.Itoa(w.Body.Len()), w.Header().Get(headerContentLength))
+		_, params, _ := mime.ParseMediaType(w.Header().Get(headerContentType))
+		reader := multipart.NewReader(w.Body, params["boundary"])
+		part, _ := reader.NextPart()
+		body, _ := ioutil.ReadAll(part)
+		assert.EqualValues("bytes 990-999/1000", part.Header.Get(headerContentRange))
+		assert.EqualValues(data[990:], body)
+		part, _ = reader.NextPart()
+		body, _ = ioutil.ReadAll(part)
+		assert.EqualValues("image/png", part.Header.Get(headerContentType))
+		assert.EqualValues(data[:5], body)
+	}
+}
+
+func TestVariantParams(t *testing.T) {
+	assert := assert.New(t)
+	presets, err := parsePresets("thumb=64x64:cover, preview=800x0,small=100x50:fill:70")
+	assert.Nil(err)
+	assert.EqualValues(VariantParams{64, 64, fitCover, defaultVariantQuality, ""}, presets["thumb"])
+	assert.EqualValues(VariantParams{800, 0, fitContain, defaultVariantQuality, ""}, presets["preview"])
+	assert.EqualValues(VariantParams{100, 50, fitFill, 70, ""}, presets["small"])
+
+	for _, value := range []string{"foo", "=10x10", "a=10", "a=10x0:cover", "a=10x10:squash", "a=10x10:fill:101", "a=1x1:fill:5:x"} {
+		_, err = parsePresets(value)
+		assert.NotNil(err, value)
+	}
+
+	query := func(s string) map[string][]string {
+		values, _ := url.ParseQuery(s)
+		return values
+	}
+
+	params, err := parseVariantParams(query(""), presets)
+	assert.Nil(err)
+	assert.Nil(params)
+	params, err = parseVariantParams(query("w=300"), presets)
+	assert.Nil(err)
+	assert.EqualValues(VariantParams{300, 0, fitContain, defaultVariantQuality, ""}, *params)
+	params, err = parseVariantParams(query("preset=thumb&q=50"), presets)
+	assert.Nil(err)
+	assert.EqualValues(VariantParams{64, 64, fitCover, 50, ""}, *params)
+
+	_, err = parseVariantParams(query("preset=foo"), presets)
+	assert.Equal(errUnknownPreset, err)
+	for _, value := range []string{"w=abc", "w=-1", "w=5000", "w=10&fit=cover", "fit=fill", "w=10&q=101"} {
+		_, err = parseVariantParams(query(value), presets)
+		assert.Equal(errInvalidVariant, err, value)
+	}
+}
+
+func TestCreateVariant(t *testing.T) {
+	assert := assert.New(t)
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	for _, c := range []struct {
+		params VariantParams
+		width  int
+		height int
+	}{
+		{VariantParams{100, 100, fitContain, 85, ""}, 100, 50},
+		{VariantParams{0, 50, fitContain, 85, ""}, 100, 50},
+		{VariantParams{800, 800, fitContain, 85, ""}, 400, 200},
+		{VariantParams{100, 100, fitCover, 85, ""}, 100, 100},
+		{VariantParams{30, 60, fitFill, 85, ""}, 30, 60},
+	} {
+		mediaType, data, err := createVariant(src, "png", c.params)
+		assert.Nil(err)
+		assert.EqualValues("image/png", mediaType)
+		config, err := png.DecodeConfig(bytes.NewReader(data))
+		assert.Nil(err)
+		assert.EqualValues(c.width, config.Width, c.params)
+		assert.EqualValues(c.height, config.Height, c.params)
+	}
+
+	mediaType, data, err := createVariant(src, "jpeg", VariantParams{10, 10, fitCover, 50, ""})
+	assert.Nil(err)
+	assert.EqualValues("image/jpeg", mediaType)
+	_, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	assert.Nil(err)
+}
+
+func TestVariantCache(t *testing.T) {
+	assert := assert.New(t)
+	cache := NewVariantCache(100)
+	assert.Empty(cache.add(ImageMeta{ID: "a", Size: 40}))
+	assert.Empty(cache.add(ImageMeta{ID: "b", Size: 40}))
+	assert.NotNil(cache.get("a"))
+	assert.EqualValues([]ImageMeta{{ID: "b", Size: 40}}, cache.add(ImageMeta{ID: "c", Size: 40}))
+	assert.Nil(cache.get("b"))
+	evicted := cache.add(ImageMeta{ID: "d", Size: 200})
+	assert.Len(evicted, 2)
+	assert.EqualValues("a", evicted[0].ID)
+	assert.EqualValues("c", evicted[1].ID)
+	assert.NotNil(cache.get("d"))
+	assert.EqualValues(200, cache.size)
+}
+
+func TestBrokenImage(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4)))
+	writeObject(service, "bar", buf.Bytes()[:10])
+	service.data.addImageData(ImageMeta{ID: "foo", Hash: "bar", MediaType: "image/png", Size: uint(buf.Len()), Broken: true})
+
+	r := mux.NewRouter()
+	r.HandleFunc("/images/{id}", service.fetchImage).Methods("GET")
+	for _, path := range []string{"/images/foo", "/images/foo?preset=thumb"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.EqualValues(http.StatusGone, w.Code)
+		assert.Contains(w.Body.String(), errBrokenImage.Error())
+	}
+	assert.EqualValues(0, service.objects.variants.order.Len())
+
+	// Analysis of broken images fails right away (without retrying).
+	_, err := service.objects.analyzeImage("foo", nil)
+	assert.EqualValues(errBrokenImage, err)
+	service.objects.queueImageForAnalysis(ImageMeta{ID: "foo"})
+	job, _ := service.GetAnalysisJob("foo")
+	assert.False(service.objects.runAnalysisJob(*job))
+	job, _ = service.GetAnalysisJob("foo")
+	assert.EqualValues(jobFailed, job.State)
+	assert.EqualValues(1, job.Attempts)
+	meta, _ := service.data.fetchImageMeta("foo")
+	assert.False((&Backfill{}).matches(*meta))
+
+	// Image is served once it's restored.
+	writeObject(service, "bar", buf.Bytes())
+	meta.Broken = false
+	service.data.updateImageData(*meta)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/images/foo", nil))
+	assert.EqualValues(http.StatusOK, w.Code)
+	assert.EqualValues(buf.Bytes(), w.Body.Bytes())
+}
+
+func TestImageVariant(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 32)))
+	writeObject(service, "bar", buf.Bytes())
+	service.data.addImageData(ImageMeta{
+		ID:        "foo",
+		Hash:      "bar",
+		MediaType: "image/png",
+		Size:      uint(buf.Len()),
+	})
+
+	fetch := func(query string) (*httptest.ResponseRecorder, StreamStatus) {
+		values, _ := url.ParseQuery(query)
+		w := httptest.NewRecorder()
+		return w, service.StreamImageFromBackend("foo", values, http.Header{}, w)
+	}
+
+	w, code := fetch("preset=thumb")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues(`"bar-16x16-cover-q80"`, w.Header().Get(headerETag))
+	config, err := png.DecodeConfig(w.Body)
+	assert.Nil(err)
+	assert.EqualValues(16, config.Width)
+	assert.EqualValues(16, config.Height)
+	assert.NotNil(service.objects.variants.get("variant-bar-16x16-cover-q80"))
+
+	// Variant should be served from the store the next time.
+	w, code = fetch("preset=thumb")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues(1, service.objects.variants.order.Len())
+
+	_, code = fetch("w=abc")
+	assert.EqualValues(streamInvalidVariant, code)
+
+	// Concurrent requests for the same variant decode the image only once.
+	store := &countingStore{FileStore: service.objects.objectStore.(*FileStore)}
+	service.objects.objectStore = store
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, code := fetch("w=8&h=8")
+			assert.EqualValues(streamSuccess, code)
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(2, service.objects.variants.order.Len())
+	assert.EqualValues(1, store.readers)
+
+	// Variants are tracked again after restarting (and evicted if they don't fit).
+	objects, err := NewObjectsRepository(service.data, defaultVariantsCapacity, defaultMaxWrites, defaultMaxDecodes, AnalysisConfig{Workers: 1, QueueSize: 1, Policy: queuePolicySpill})
+	assert.Nil(err)
+	assert.NotNil(objects.variants.get("variant-bar-16x16-cover-q80"))
+	assert.NotNil(objects.variants.get("variant-bar-8x8-contain-q85"))
+	objects, err = NewObjectsRepository(service.data, 1, defaultMaxWrites, defaultMaxDecodes, AnalysisConfig{Workers: 1, QueueSize: 1, Policy: queuePolicySpill})
+	assert.Nil(err)
+	assert.Nil(objects.variants.get("variant-bar-16x16-cover-q80"))
+	assert.NotNil(objects.variants.get("variant-bar-8x8-contain-q85"))
+	variants, _ := service.data.dataStore.listVariants()
+	assert.Len(variants, 1)
+	assert.Len(storedFiles(store.pathPrefix), 2)
+
+	// Images are decoded one at a time (with a single slot).
+	service.objects.decodeSlots = make(chan struct{}, 1)
+	for _, query := range []string{"w=4", "w=5", "w=6", "w=7"} {
+		wg.Add(1)
+		go func(query string) {
+			defer wg.Done()
+			_, code := fetch(query)
+			assert.EqualValues(streamSuccess, code)
+		}(query)
+	}
+	wg.Wait()
+	assert.EqualValues(5, store.readers)
+	assert.EqualValues(1, store.maxActive)
+	service.objects.objectStore = store.FileStore
+
+	writeObject(service, "bar", []byte("booya"))
+	_, code = fetch("w=10")
+	assert.EqualValues(streamUnsupportedImage, code)
+
+	// Images with too many pixels aren't decoded at all.
+	buf.Reset()
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	huge := buf.Bytes()
+	binary.BigEndian.PutUint32(huge[16:], 100000)
+	binary.BigEndian.PutUint32(huge[20:], 100000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+	writeObject(service, "bar", huge)
+	_, code = fetch("w=20")
+	assert.EqualValues(streamImageTooLarge, code)
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	assert := assert.New(t)
+	for _, c := range []struct {
+		accept string
+		format string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"image/*", ""},
+		{"image/webp,*/*;q=0.8", ""},
+		{"image/png;q=0, image/*", "jpeg"},
+		{"image/webp", "webp"},
+		{"image/gif, image/jpeg;q=0.9", "gif"},
+		{"image/png;q=0, image/jpeg;q=0.5, image/webp;q=0.7", "webp"},
+		{"text/html, image/*;q=0.1, image/png;q=0", "jpeg"},
+	} {
+		format, err := negotiateFormat(c.accept, "image/png")
+		assert.Nil(err, c.accept)
+		assert.EqualValues(c.format, format, c.accept)
+	}
+
+	_, err := negotiateFormat("text/html, image/png;q=0", "image/png")
+	assert.Equal(errNotAcceptable, err)
+}
+
+func TestWebPEncoding(t *testing.T) {
+	assert := assert.New(t)
+	for _, src := range []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 1, 1)),
+		image.NewGray(image.Rect(0, 0, 37, 11)),
+		image.NewRGBA(image.Rect(10, 10, 300, 200)),
+	} {
+		// Noisy pixels, so that we get deep trees.
+		if img, ok := src.(draw.Image); ok {
+			bounds := img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					v := uint8((x*x + y*7) % 251)
+					img.Set(x, y, color.NRGBA{v, v / 3, 255 - v, 255 - v%7})
+				}
+			}
+		}
+
+		var buf bytes.Buffer
+		assert.Nil(encodeWebP(&buf, src))
+		decoded, err := webp.Decode(&buf)
+		assert.Nil(err)
+		bounds := src.Bounds()
+		assert.EqualValues(bounds.Size(), decoded.Bounds().Size())
+		for y := 0; y < bounds.Dy(); y++ {
+			for x := 0; x < bounds.Dx(); x++ {
+				expected := color.NRGBAModel.Convert(src.At(bounds.Min.X+x, bounds.Min.Y+y))
+				assert.EqualValues(expected, color.NRGBAModel.Convert(decoded.At(x, y)))
+			}
+		}
+	}
+}
+
+func TestImageFormatNegotiation(t *testing.T) {
+	assert := assert.New(t)
+	service := createService(t)
+	go service.objects.processChunks()
+
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 32)))
+	original := buf.Bytes()
+	writeObject(service, "bar", original)
+	service.data.metaCache.Add("foo", ImageMeta{
+		ID:        "foo",
+		Hash:      "bar",
+		MediaType: "image/png",
+		Size:      uint(len(original)),
+	})
+
+	fetch := func(query, accept string) (*httptest.ResponseRecorder, StreamStatus) {
+		values, _ := url.ParseQuery(query)
+		w := httptest.NewRecorder()
+		return w, service.StreamImageFromBackend("foo", values, http.Header{headerAccept: {accept}}, w)
+	}
+
+	w, code := fetch("", "image/png, image/webp")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues(original, w.Body.Bytes())
+	assert.EqualValues(headerAccept, w.Header().Get(headerVary))
+	w, code = fetch("format=png", "")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues(original, w.Body.Bytes())
+
+	w, code = fetch("", "image/webp, image/*;q=0.1, image/png;q=0")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues("image/webp", w.Header().Get(headerContentType))
+	assert.EqualValues(`"bar-0x0-contain-q85-webp"`, w.Header().Get(headerETag))
+	decoded, err := webp.Decode(w.Body)
+	assert.Nil(err)
+	assert.EqualValues(64, decoded.Bounds().Dx())
+
+	w, code = fetch("format=jpeg&preset=thumb", "image/png")
+	assert.EqualValues(streamSuccess, code)
+	assert.EqualValues("image/jpeg", w.Header().Get(headerContentType))
+	config, err := jpeg.DecodeConfig(w.Body)
+	assert.Nil(err)
+	assert.EqualValues(16, config.Width)
+
+	w, code = fetch("format=gif", "")
+	assert.EqualValues(streamSuccess, code)
+	_, err = gif.Decode(w.Body)
+	assert.Nil(err)
+
+	// Original bytes are never touched.
+	stored, _ := ioutil.ReadFile(service.objects.objectStore.(*FileStore).objectPath("bar"))
+	assert.EqualValues(original, stored)
+
+	_, code = fetch("format=bmp", "")
+	assert.EqualValues(streamInvalidVariant, code)
+	_, code = fetch("", "text/html")
+	assert.EqualValues(streamNotAcceptable, code)
+}
+
+// writeObject with the given hash and data directly to the file store.
+func writeObject(service *ImageService, hash string, data []byte) {
+	path := service.objects.objectStore.(*FileStore).objectPath(hash)
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	ioutil.WriteFile(path, data, 0644)
+}
+
+// storedFiles (staged or committed) in the given directory.
+func storedFiles(dir string) []string {
+	files := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	return files
+}
+
+// Magic numbers for a few image formats.
+const (
+	pngMagic  = "\x89PNG\r\n\x1a\n"
+	jpegMagic = "\xff\xd8\xff"
+)
+
+// multipartReader with one part for each of the given media types and contents.
+func multipartReader(parts map[string]string) *multipart.Reader {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for ty, content := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set(headerContentType, ty)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="image"; filename="%s"`, ty))
+		part, _ := writer.CreatePart(header)
+		part.Write([]byte(content))
 	}
+	writer.Close()
+
+	return multipart.NewReader(body, writer.Boundary())
+}
+
+func BenchmarkParallelUploads(b *testing.B) {
+	for _, latency := range []time.Duration{0, time.Millisecond} {
+		for _, clients := range []int{1, 2, 4, 8, 16} {
+			b.Run(fmt.Sprintf("latency-%s/clients-%d", latency, clients), func(b *testing.B) {
+				benchmarkUploads(b, clients, latency)
+			})
+		}
+	}
+}
+
+// slowStore is a file store which takes some time for each write (like remote stores).
+type slowStore struct {
+	*FileStore
+	latency time.Duration
+}
+
+func (store *slowStore) stageObject(id string) (ObjectWriter, error) {
+	writer, err := store.FileStore.stageObject(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowWriter{writer, store.latency}, nil
+}
+
+type slowWriter struct {
+	ObjectWriter
+	latency time.Duration
+}
+
+func (w *slowWriter) Write(chunk []byte) (int, error) {
+	time.Sleep(w.latency)
+	return w.ObjectWriter.Write(chunk)
+}
+
+// benchmarkUploads of 1 MiB images from the given number of clients, using a
+// store with the given latency for each write.
+func benchmarkUploads(b *testing.B, clients int, latency time.Duration) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	service := createService(b)
+	service.objects.objectStore = &slowStore{service.objects.objectStore.(*FileStore), latency}
+
+	resp, _ := service.CreateUploadLink(LinkCreationRequest{Duration: "PT1H"})
+	linkID := strings.TrimPrefix(resp.RelativePath, "/booya/")
+
+	// All clients upload the same image, so all but the first upload are duplicates.
+	content := []byte(pngMagic + strings.Repeat("booya", 1024*1024/5))
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("image", "image.png")
+	part.Write(content)
+	writer.Close()
+
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+
+	uploads := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range uploads {
+				reader := multipart.NewReader(bytes.NewReader(body.Bytes()), writer.Boundary())
+				upload, _ := service.StreamImagesToBackend(linkID, reader)
+				if len(upload.Processed) != 1 {
+					b.Error("upload failed")
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < b.N; i++ {
+		uploads <- struct{}{}
+	}
+
+	close(uploads)
+	wg.Wait()
+}
+
+func BenchmarkImageDownload(b *testing.B) {
+	service := createService(b)
+	fileStore := service.objects.objectStore.(*FileStore)
+	go service.objects.processChunks()
+
+	data := []byte(strings.Repeat("booya", 4*1024*1024/5))
+	writeObject(service, "bar", data)
+	service.data.metaCache.Add("foo", ImageMeta{ID: "foo", Hash: "bar", MediaType: "image/png", Size: uint(len(data))})
+
+	for _, store := range []ObjectStore{fileStore, chunkedStore{fileStore}} {
+		name := "seekable"
+		if _, ok := store.(SeekableStore); !ok {
+			name = "chunked"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			service.objects.objectStore = store
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				service.StreamImageFromBackend("foo", nil, http.Header{}, discardWriter{httptest.NewRecorder()})
+			}
+		})
+	}
+}
+
+// discardWriter is a response writer which discards the body.
+type discardWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
 }
@@ -3,110 +3,494 @@ package main
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
-// DataStore is the persistence layer for adding, mutating and querying data.
+var errNotFound = errors.New("Record does not exist")
+
+// DataStore is the persistence layer for adding, mutating and querying data. Lookups
+// for a single record return `errNotFound` if it doesn't exist, whereas other errors
+// mean that the store has failed (after retrying, if the failure was transient).
 type DataStore interface {
 	// initialize this store.
 	initialize() error
-	// addUploadID with the given expiry timestamp.
-	addUploadID(id string, expiry time.Time) error
-	// getUploadExpiry for the given upload ID.
-	getUploadExpiry(id string) (*time.Time, error)
-	// addImageMeta to this store.
-	addImageMeta(meta ImageMeta) error
+	// addUploadID with the given expiry timestamp and policy.
+	addUploadID(id string, expiry time.Time, policy LinkPolicy) error
+	// getUploadLink for the given upload ID.
+	getUploadLink(id string) (*UploadLink, error)
+	// updateUploadLink existing for some upload ID.
+	updateUploadLink(link UploadLink) error
+	// listUploadLinks matching the given filter.
+	listUploadLinks(filter LinkFilter) (*LinkList, error)
+	// addLinkUpload for some image uploaded through an upload ID.
+	addLinkUpload(upload LinkUpload) error
+	// fetchLinkUploads for the given upload ID.
+	fetchLinkUploads(linkID string) ([]LinkUpload, error)
+	// addImageMeta to this store, unless some image already has the same hash (which is
+	// checked atomically). Returns the ID of the image for that hash, which is the ID of
+	// the existing image for duplicates.
+	addImageMeta(meta ImageMeta) (string, error)
 	// fetchImageMeta for the given image ID.
 	fetchImageMeta(id string) (*ImageMeta, error)
 	// fetchMetaForHash of some image.
 	fetchMetaForHash(hash string) (*ImageMeta, error)
 	// updateImageMeta existing for some image.
 	updateImageMeta(meta ImageMeta) error
+	// listImageMeta ordered by image ID, starting from the given offset.
+	listImageMeta(offset, limit int) ([]ImageMeta, error)
+	// listImagesAfter the given image ID (or from the start, if empty), ordered by image ID.
+	listImagesAfter(id string, limit int) ([]ImageMeta, error)
+	// removeImageMeta for the given image ID.
+	removeImageMeta(id string) error
 	// getServiceStats for the data we have collected so far.
 	getServiceStats() (*ServiceStats, error)
+	// saveAnalysisJob (replacing the existing job for the same image, if any).
+	saveAnalysisJob(job AnalysisJob) error
+	// fetchAnalysisJob for the given image ID.
+	fetchAnalysisJob(imageID string) (*AnalysisJob, error)
+	// listAnalysisJobs matching the given filter, ordered by their next attempt.
+	listAnalysisJobs(filter JobFilter) ([]AnalysisJob, error)
+	// countAnalysisJobs in each state.
+	countAnalysisJobs() (map[string]uint, error)
+	// saveBackfill (replacing the existing backfill with the same ID, if any).
+	saveBackfill(backfill Backfill) error
+	// fetchBackfill for the given ID.
+	fetchBackfill(id string) (*Backfill, error)
+	// listBackfills ordered by their creation time.
+	listBackfills() ([]Backfill, error)
+	// saveVariant (replacing the existing variant with the same ID, if any).
+	saveVariant(variant ImageVariant) error
+	// removeVariant for the given ID.
+	removeVariant(id string) error
+	// listVariants ordered by their creation time.
+	listVariants() ([]ImageVariant, error)
+}
+
+// MigratableStore is a data store with a versioned schema, which can be migrated
+// (forward or backward) between versions.
+type MigratableStore interface {
+	// migrate the schema to the given version (or the latest version, if negative),
+	// and return the version after migrating.
+	migrate(version int) (int, error)
 }
 
-// ObjectStore is the persistence layer for storing and retrieving objects.
+// ObjectStore is the persistence layer for storing and retrieving objects. Objects
+// are staged under some ID while they're being written, and they're committed under
+// their content hash, so that committed objects are never partial or duplicated.
+// Stores must be safe for concurrent use (objects are written by their own writers).
 type ObjectStore interface {
-	// storeChunk for the given image ID.
-	storeChunk(id string, chunk []byte, isFinal bool)
-	// retrieveChunks for the given image ID and send it through the given channel.
-	retrieveChunks(id string, stream chan<- Chunk)
-	// discardObject corresponding to the given image ID.
-	discardObject(id string)
-	// getImageReader corresponding to the given image ID.
-	getImageReader(id string) (io.Reader, error)
-	// cleanupImageReader for the given ID and reader obtained using `getImageReader`
-	cleanupImageReader(id string, reader io.Reader) error
+	// stageObject under the given ID and return a writer for it.
+	stageObject(id string) (ObjectWriter, error)
+	// commitObject staged under the given ID (after its writer has been closed) to the
+	// given hash. Returns whether an object already exists for that hash, in which case
+	// the staged object is discarded.
+	commitObject(id, hash string) (bool, error)
+	// retrieveChunks for the given hash and send it through the given channel. Chunks
+	// start at the given offset and span the given length (negative for the entire object).
+	retrieveChunks(hash string, offset, length int64, stream chan<- Chunk)
+	// discardObject staged under the given ID.
+	discardObject(id string) error
+	// removeObject committed under the given hash.
+	removeObject(hash string) error
+	// getImageReader corresponding to the given hash.
+	getImageReader(hash string) (io.Reader, error)
+	// cleanupImageReader for the given hash and reader obtained using `getImageReader`
+	cleanupImageReader(hash string, reader io.Reader) error
 }
 
-// NoOpStore which does nothing.
-type NoOpStore struct{}
+// ObjectWriter writes an object staged in some store. Closing the writer finishes
+// the object, so that it can be committed. Writers must not be used from multiple
+// goroutines, but different writers can be used concurrently.
+type ObjectWriter interface {
+	io.WriteCloser
+	// abort writing and discard whatever has been staged so far. This must be
+	// called if writing or closing fails.
+	abort() error
+}
 
-func (NoOpStore) initialize() error                             { return nil }
-func (NoOpStore) addUploadID(id string, expiry time.Time) error { return nil }
-func (NoOpStore) addImageMeta(meta ImageMeta) error             { return nil }
-func (NoOpStore) updateImageMeta(meta ImageMeta) error          { return nil }
-func (NoOpStore) getUploadExpiry(id string) (*time.Time, error) {
-	return nil, errors.New("no-op")
+// ObjectReader reads a committed object with random access.
+type ObjectReader interface {
+	io.ReadSeeker
+	io.Closer
 }
-func (NoOpStore) fetchMetaForHash(hash string) (*ImageMeta, error) {
-	return nil, errors.New("no-op")
+
+// SeekableStore is an object store which can open committed objects for random
+// access, so that they can be copied straight to the response (which uses `sendfile`
+// on Linux for files). Other stores stream chunks using `retrieveChunks` instead.
+type SeekableStore interface {
+	// openObject committed under the given hash.
+	openObject(hash string) (ObjectReader, error)
 }
-func (NoOpStore) fetchImageMeta(id string) (*ImageMeta, error) {
-	return nil, errors.New("no-op")
+
+var errStoreFull = errors.New("Object store has run out of space")
+
+// isStoreFull checks whether the given error (from some object store) was
+// caused by running out of space.
+func isStoreFull(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+
+	return err == errStoreFull || err == syscall.ENOSPC || err == syscall.EDQUOT
 }
-func (NoOpStore) getServiceStats() (*ServiceStats, error) {
-	return nil, errors.New("no-op")
+
+// contentAddress of the object with the given hash. Objects are sharded into two
+// levels of directories (by the first two pairs of hex digits), so that we don't
+// end up with a huge number of entries in a single directory.
+func contentAddress(hash string) string {
+	// Hashes are much longer, but we don't wanna panic on whatever we get.
+	if len(hash) < 4 {
+		return hash
+	}
+
+	return hash[:2] + "/" + hash[2:4] + "/" + hash
 }
 
 // MARK: File store.
 
-// FileStore is used for persisting objects in the system disk.
-// Note that this must not be accessed from multiple goroutines.
+const (
+	fileStagingDir    = "staging"
+	fileObjectsDir    = "objects"
+	fileQuarantineDir = "quarantine"
+	// Number of metadata rows checked at once during recovery.
+	recoveryBatchSize = 500
+	// Recovery leaves the metadata alone if more than this fraction of the objects
+	// are missing, since the store is more likely to be misconfigured (say, the volume
+	// isn't mounted) than broken.
+	recoveryMaxMissing = 0.5
+)
+
+// FileStore is used for persisting objects in the system disk. Objects are staged
+// in `staging`, synced to disk and atomically committed into `objects`, so that a
+// crash never leaves a partial object behind (see `recover` for what it does leave).
 type FileStore struct {
 	// Prefix path for the objects.
 	pathPrefix string
-	openFds    map[string]*os.File
 }
 
-// MARK: `DataStore` interface methods.
+// stagingPath of the object with the given ID.
+func (store *FileStore) stagingPath(id string) string {
+	return filepath.Join(store.pathPrefix, fileStagingDir, id)
+}
+
+// objectPath of the object with the given hash.
+func (store *FileStore) objectPath(hash string) string {
+	return filepath.Join(store.pathPrefix, fileObjectsDir, filepath.FromSlash(contentAddress(hash)))
+}
+
+// quarantinePath for the file with the given name.
+func (store *FileStore) quarantinePath(name string) string {
+	return filepath.Join(store.pathPrefix, fileQuarantineDir, name)
+}
+
+// quarantine the file in the given path by moving it into `quarantine` (with the
+// given name), so that it can be inspected later.
+func (store *FileStore) quarantine(path, name string) error {
+	err := os.MkdirAll(filepath.Join(store.pathPrefix, fileQuarantineDir), os.ModePerm)
+	if err == nil {
+		err = os.Rename(path, store.quarantinePath(name))
+	}
+
+	return err
+}
+
+// legacyPath of the object for the image with the given ID, where older versions
+// stored it (before objects were content-addressed).
+func (store *FileStore) legacyPath(id string) string {
+	return filepath.Join(store.pathPrefix, id)
+}
+
+// migrateLegacyObject of the given image (if any) to its content address. Objects of
+// images with the same hash are stored only once, so the others are quarantined.
+func (store *FileStore) migrateLegacyObject(meta ImageMeta) error {
+	legacy := store.legacyPath(meta.ID)
+	info, err := os.Stat(legacy)
+	if os.IsNotExist(err) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	path := store.objectPath(meta.Hash)
+	_, err = os.Stat(path)
+	if err == nil {
+		log.Printf("Quarantining duplicate object from old layout (ID: %s, hash: %s)\n", meta.ID, meta.Hash)
+		return store.quarantine(legacy, meta.ID)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("Moving object from old layout (ID: %s, hash: %s)\n", meta.ID, meta.Hash)
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err == nil {
+		err = os.Rename(legacy, path)
+	}
+
+	return err
+}
+
+// recover from a crash (or an unclean shutdown) using the metadata in the given
+// data store. This must be called before using the store. Objects from the old
+// layout (named by image ID) are moved to their content address first. Staged objects
+// belong to uploads which never finished (or never got committed), objects which no
+// image (or variant) refers to belong to uploads whose metadata couldn't be stored,
+// and images whose object is missing or doesn't match the size in their metadata
+// can't be served. Leftover files are quarantined, and such images are flagged as
+// broken (the metadata is kept, so that the image can be restored, say, by uploading
+// it again).
+func (store *FileStore) recover(data DataStore) error {
+	staged, err := ioutil.ReadDir(filepath.Join(store.pathPrefix, fileStagingDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, info := range staged {
+		log.Printf("Quarantining incomplete object (ID: %s, size: %d)\n", info.Name(), info.Size())
+		err = store.quarantine(store.stagingPath(info.Name()), info.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Check all the images first, so that we know how many objects are missing.
+	var missing, truncated, restored []ImageMeta
+	total, listed := 0, true
+	referenced := make(map[string]bool)
+	for offset := 0; ; offset += recoveryBatchSize {
+		metas, err := data.listImageMeta(offset, recoveryBatchSize)
+		if err != nil {
+			log.Printf("Cannot list image metadata for recovery: %s\n", err.Error())
+			listed = false
+			break
+		}
+
+		total += len(metas)
+		for _, meta := range metas {
+			referenced[meta.Hash] = true
+			err = store.migrateLegacyObject(meta)
+			if err != nil {
+				return err
+			}
+
+			info, err := os.Stat(store.objectPath(meta.Hash))
+			if os.IsNotExist(err) {
+				missing = append(missing, meta)
+			} else if err != nil {
+				// We can't tell whether the object is fine, so it's better to stop here.
+				return err
+			} else if info.Size() != int64(meta.Size) {
+				truncated = append(truncated, meta)
+			} else if meta.Broken {
+				restored = append(restored, meta)
+			}
+		}
+
+		if len(metas) < recoveryBatchSize {
+			break
+		}
+	}
+
+	if len(missing) > 0 && float64(len(missing)) > recoveryMaxMissing*float64(total) {
+		log.Printf("WARNING: Objects are missing for %d out of %d images in %s - is this the right path? "+
+			"Skipping recovery of the images, so that their metadata is left alone.\n", len(missing), total, store.pathPrefix)
+		return nil
+	}
+
+	// Unreferenced objects are swept only if we know about all the images.
+	if listed {
+		err = store.sweepUnreferenced(data, referenced)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, meta := range truncated {
+		log.Printf("Quarantining object with wrong size (ID: %s, hash: %s)\n", meta.ID, meta.Hash)
+		err = store.quarantine(store.objectPath(meta.Hash), meta.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, meta := range append(missing, truncated...) {
+		if meta.Broken {
+			continue
+		}
+
+		log.Printf("Flagging image as broken (ID: %s, hash: %s)\n", meta.ID, meta.Hash)
+		meta.Broken = true
+		err = data.updateImageMeta(meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, meta := range restored {
+		log.Printf("Object is back for broken image (ID: %s, hash: %s)\n", meta.ID, meta.Hash)
+		meta.Broken = false
+		err = data.updateImageMeta(meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sweepUnreferenced objects by quarantining the ones whose hash isn't in the given
+// set (of images) or in the variants of the given data store. Like missing objects,
+// nothing is swept if most of the objects aren't referenced.
+func (store *FileStore) sweepUnreferenced(data DataStore, referenced map[string]bool) error {
+	variants, err := data.listVariants()
+	if err != nil {
+		log.Printf("Cannot list variants for recovery: %s\n", err.Error())
+		return nil
+	}
+
+	for _, variant := range variants {
+		referenced[variant.Hash] = true
+	}
+
+	var unreferenced []string
+	total := 0
+	err = filepath.Walk(filepath.Join(store.pathPrefix, fileObjectsDir), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		total++
+		if !referenced[info.Name()] {
+			unreferenced = append(unreferenced, info.Name())
+		}
 
-func (store *FileStore) storeChunk(id string, chunk []byte, isFinal bool) {
-	// FIXME: When we encounter disk errors, we should probably return
-	// 500 status code?
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-	var err error
-	fd, exists := store.openFds[id]
-	if !exists {
-		log.Printf("Creating new file for image ID: %s\n", id)
-		fd, err = os.Create(filepath.Join(store.pathPrefix, id))
+	if len(unreferenced) > 0 && float64(len(unreferenced)) > recoveryMaxMissing*float64(total) {
+		log.Printf("WARNING: %d out of %d objects in %s aren't referenced by any image - is this the right database? "+
+			"Skipping the sweep, so that the objects are left alone.\n", len(unreferenced), total, store.pathPrefix)
+		return nil
+	}
+
+	for _, hash := range unreferenced {
+		log.Printf("Quarantining unreferenced object (hash: %s)\n", hash)
+		err = store.quarantine(store.objectPath(hash), hash)
 		if err != nil {
-			log.Printf("Error creating file for image (ID: %s): %s\n", id, err.Error())
-			return
+			return err
 		}
+	}
 
-		store.openFds[id] = fd
+	return nil
+}
+
+// MARK: `DataStore` interface methods.
+
+func (store *FileStore) stageObject(id string) (ObjectWriter, error) {
+	log.Printf("Creating new file for image ID: %s\n", id)
+	err := os.MkdirAll(filepath.Join(store.pathPrefix, fileStagingDir), os.ModePerm)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = fd.Write(chunk)
+	path := store.stagingPath(id)
+	fd, err := os.Create(path)
 	if err != nil {
-		log.Printf("Error writing chunk to file (image ID: %s): %s\n", id, err.Error())
+		return nil, err
 	}
 
-	if isFinal || err != nil {
-		fd.Close()
-		delete(store.openFds, id)
+	return &fileWriter{fd, path}, nil
+}
+
+func (store *FileStore) commitObject(id, hash string) (bool, error) {
+	staged, path := store.stagingPath(id), store.objectPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		log.Printf("Object already exists for hash %s (image ID: %s)\n", hash, id)
+		return true, os.Remove(staged)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return false, err
 	}
+
+	// Renaming is atomic, so readers never see a partial object. If some other
+	// upload has committed the same content in the meantime, then this replaces
+	// that object with identical bytes, which is fine.
+	err = os.Rename(staged, path)
+	if err != nil {
+		return false, err
+	}
+
+	// Sync the directory, so that the rename itself survives a crash.
+	return false, syncDir(filepath.Dir(path))
+}
+
+// fileWriter writes an object staged in some file.
+type fileWriter struct {
+	fd   *os.File
+	path string
+}
+
+func (w *fileWriter) Write(chunk []byte) (int, error) {
+	return w.fd.Write(chunk)
+}
+
+func (w *fileWriter) Close() error {
+	// Make sure that the bytes are on disk before the object can be committed.
+	err := w.fd.Sync()
+	closeErr := w.fd.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (w *fileWriter) abort() error {
+	// Writer may have been closed already.
+	w.fd.Close()
+	err := os.Remove(w.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// syncDir flushes the entries of the given directory to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+	return dir.Sync()
 }
 
-func (store *FileStore) retrieveChunks(id string, stream chan<- Chunk) {
-	fd, err := os.Open(filepath.Join(store.pathPrefix, id))
+func (store *FileStore) retrieveChunks(hash string, offset, length int64, stream chan<- Chunk) {
+	fd, err := os.Open(store.objectPath(hash))
 	defer fd.Close()
 
+	if err == nil && offset > 0 {
+		_, err = fd.Seek(offset, io.SeekStart)
+	}
+
 	if err != nil {
 		stream <- Chunk{
 			bytes:   []byte{},
@@ -117,9 +501,14 @@ func (store *FileStore) retrieveChunks(id string, stream chan<- Chunk) {
 		return
 	}
 
+	var reader io.Reader = fd
+	if length >= 0 {
+		reader = io.LimitReader(fd, length)
+	}
+
 	buf := make([]byte, defaultBufSize)
 	for {
-		n, err := fd.Read(buf)
+		n, err := reader.Read(buf)
 		slice := make([]byte, len(buf[:n]))
 		copy(slice, buf[:n])
 
@@ -144,15 +533,33 @@ func (store *FileStore) retrieveChunks(id string, stream chan<- Chunk) {
 	}
 }
 
-func (store *FileStore) discardObject(id string) {
-	os.Remove(filepath.Join(store.pathPrefix, id))
+func (store *FileStore) discardObject(id string) error {
+	err := os.Remove(store.stagingPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (store *FileStore) removeObject(hash string) error {
+	return os.Remove(store.objectPath(hash))
+}
+
+func (store *FileStore) openObject(hash string) (ObjectReader, error) {
+	fd, err := os.Open(store.objectPath(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	return fd, nil
 }
 
-func (store *FileStore) getImageReader(id string) (io.Reader, error) {
-	return os.Open(filepath.Join(store.pathPrefix, id))
+func (store *FileStore) getImageReader(hash string) (io.Reader, error) {
+	return os.Open(store.objectPath(hash))
 }
 
-func (store *FileStore) cleanupImageReader(id string, reader io.Reader) error {
+func (store *FileStore) cleanupImageReader(hash string, reader io.Reader) error {
 	fd, ok := reader.(*os.File)
 	if ok {
 		fd.Close()
@@ -0,0 +1,31 @@
+;; Plugin for testing the WebAssembly analyzers (`png.wasm` is this module, compiled).
+;; It reports whether the image is a PNG, by checking its first byte. Content which
+;; starts with "l" makes it loop forever (for testing the timeout).
+(module
+  (memory (export "memory") 1)
+  ;; Start of the free memory.
+  (global $next (mut i32) (i32.const 1024))
+  (data (i32.const 0) "{\"png\":true}")
+  (data (i32.const 16) "{\"png\":false}")
+
+  ;; alloc returns a buffer of the given size (growing the memory, if needed).
+  (func (export "alloc") (param $size i32) (result i32)
+    (local $ptr i32)
+    (local.set $ptr (global.get $next))
+    (global.set $next (i32.add (global.get $next) (local.get $size)))
+    (if (i32.gt_u (global.get $next) (i32.mul (memory.size) (i32.const 65536)))
+      (then
+        (if (i32.eq
+              (memory.grow (i32.sub (i32.add (i32.shr_u (global.get $next) (i32.const 16)) (i32.const 1)) (memory.size)))
+              (i32.const -1))
+          (then unreachable))))
+    (local.get $ptr))
+
+  ;; analyze the image in the given buffer. Returns the pointer to the JSON result (in
+  ;; the upper 32 bits) and its length (in the lower 32 bits).
+  (func (export "analyze") (param $ptr i32) (param $len i32) (result i64)
+    (if (i32.eq (i32.load8_u (local.get $ptr)) (i32.const 0x6c))
+      (then (loop $forever (br $forever))))
+    (if (result i64) (i32.eq (i32.load8_u (local.get $ptr)) (i32.const 0x89))
+      (then (i64.const 12))
+      (else (i64.or (i64.shl (i64.const 16) (i64.const 32)) (i64.const 13))))))
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Resumable uploads using the tus protocol (https://tus.io/protocols/resumable-upload.html).
+// We support the core protocol along with the creation and termination extensions.
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination"
+
+	tusMetaFilename = "filename"
+	tusMetaFiletype = "filetype"
+
+	headerTusResumable   = "Tus-Resumable"
+	headerTusVersion     = "Tus-Version"
+	headerTusExtension   = "Tus-Extension"
+	headerTusMaxSize     = "Tus-Max-Size"
+	headerUploadLength   = "Upload-Length"
+	headerUploadOffset   = "Upload-Offset"
+	headerUploadMetadata = "Upload-Metadata"
+	headerLocation       = "Location"
+	headerCacheControl   = "Cache-Control"
+	headerImageID        = "X-Image-ID"
+
+	tusOffsetMediaType = "application/offset+octet-stream"
+)
+
+var (
+	errNotAnImage           = errors.New("Upload must be an image (set 'filetype' in metadata)")
+	errInvalidMetadata      = errors.New("Invalid upload metadata")
+	errUnknownUpload        = errors.New("Upload does not exist")
+	errUploadBusy           = errors.New("Upload is being appended by another request")
+	errUploadOffsetMismatch = errors.New("Upload offset does not match")
+)
+
+// TusUpload tracks the state of an ongoing resumable upload. The upload ID is
+// also used as the image ID in the object store.
+type TusUpload struct {
+	ID        string
+	LinkID    string
+	Filename  string
+	MediaType string
+	Length    uint
+	Offset    uint
+	// First few bytes of the upload, which are sniffed (once we have enough
+	// of them) to check that this is really an image.
+	head    []byte
+	sniffed bool
+	// Marshalled state of the SHA-256 hasher, so that we don't have to
+	// read the whole object again after it's been uploaded.
+	hashState []byte
+	// Writer for the staged object, which is kept open across requests (only
+	// the request that has locked this upload can use it).
+	writer *objectWriter
+	// Whether a request is currently appending to this upload.
+	busy bool
+	// Time of creation or the last append, for removing idle uploads.
+	updated time.Time
+}
+
+// parseTusMetadata from the `Upload-Metadata` header, which has comma-separated
+// key-value pairs, where the key and the base64-encoded value are separated by space.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		fields := strings.Fields(pair)
+		if len(fields) > 2 {
+			return nil, errInvalidMetadata
+		}
+
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, errInvalidMetadata
+			}
+
+			value = string(decoded)
+		}
+
+		metadata[fields[0]] = value
+	}
+
+	return metadata, nil
+}
+
+// CreateTusUpload validates the given upload ID and creates a resumable upload of
+// the given length and metadata (`filename` and `filetype`). The `filetype` is only
+// used for early validation - the actual type is sniffed from the content later.
+func (service *ImageService) CreateTusUpload(linkID string, length uint, metadata map[string]string) (*TusUpload, error) {
+	mediaType := normalizeMediaType(metadata[tusMetaFiletype])
+	if !strings.HasPrefix(mediaType, imageMediaType) {
+		return nil, errNotAnImage
+	} else if length > service.tusMaxSize {
+		return nil, errFileTooLarge
+	}
+
+	link, err := service.checkUploadLink(linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	if service.objects.analysisOverloaded() {
+		return nil, errServiceOverloaded
+	}
+
+	err = link.Policy.checkPart(mediaType, link)
+	if err == nil {
+		err = link.Policy.checkSize(length, link)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	// The declared length is reserved right away (and released if the upload doesn't
+	// make it), so that parallel uploads can't go over the limits of the link.
+	_, err = service.reserveLinkUsage(linkID, 1, length)
+	if err != nil {
+		return nil, err
+	}
+
+	upload := TusUpload{
+		ID:        randomAlphanumeric(imageIDLength),
+		LinkID:    linkID,
+		Filename:  metadata[tusMetaFilename],
+		MediaType: mediaType,
+		Length:    length,
+		hashState: state,
+		updated:   time.Now().UTC(),
+	}
+
+	service.data.addTusUpload(upload)
+	log.Printf("Created resumable upload for %s (image ID: %s)\n", upload.Filename, upload.ID)
+
+	return &upload, nil
+}
+
+// GetTusUpload for the given upload link and upload ID (if it exists).
+func (service *ImageService) GetTusUpload(linkID, uploadID string) *TusUpload {
+	upload := service.data.fetchTusUpload(uploadID)
+	if upload == nil || upload.LinkID != linkID {
+		return nil
+	}
+
+	return upload
+}
+
+// lockTusUpload for the given upload link and upload ID, so that no other request
+// can modify it until it's released.
+func (service *ImageService) lockTusUpload(linkID, uploadID string) (*TusUpload, error) {
+	if service.GetTusUpload(linkID, uploadID) == nil {
+		return nil, errUnknownUpload
+	}
+
+	upload := service.data.lockTusUpload(uploadID)
+	if upload == nil {
+		return nil, errUnknownUpload
+	} else if upload.busy {
+		return nil, errUploadBusy
+	}
+
+	return upload, nil
+}
+
+// AppendTusUpload with the bytes from the given reader at the given offset. Returns
+// the updated upload, and if the upload has been completed, the processed image.
+func (service *ImageService) AppendTusUpload(linkID, uploadID string, offset uint, reader io.Reader) (*TusUpload, *ProcessedImage, error) {
+	link, err := service.data.fetchUploadLink(linkID)
+	if err != nil {
+		return nil, nil, errDataUnavailable
+	} else if link == nil || !link.Expiry.After(time.Now().UTC()) {
+		return nil, nil, errUnknownLink
+	}
+
+	upload, err := service.lockTusUpload(linkID, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Always release the upload with whatever we've stored (unless it's been removed).
+	removed := false
+	defer func() {
+		if !removed {
+			upload.updated = time.Now().UTC()
+			service.data.releaseTusUpload(*upload)
+		}
+	}()
+
+	if offset != upload.Offset {
+		return upload, nil, errUploadOffsetMismatch
+	}
+
+	hasher := sha256.New()
+	err = hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.hashState)
+	if err != nil {
+		return upload, nil, err
+	}
+
+	if upload.writer == nil {
+		upload.writer, err = service.objects.stageObject(upload.ID)
+		if err != nil {
+			log.Printf("Error staging upload (image ID: %s): %s\n", upload.ID, err.Error())
+			return upload, nil, storageError(err)
+		}
+	}
+
+	// Anything beyond the declared length is ignored.
+	limited := io.LimitReader(reader, int64(upload.Length-upload.Offset))
+	bufPtr := uploadBufs.Get().(*[]byte)
+	defer uploadBufs.Put(bufPtr)
+	buf := *bufPtr
+	for {
+		n, err := limited.Read(buf)
+		if n > 0 {
+			hasher.Write(buf[:n])
+			_, storeErr := upload.writer.Write(buf[:n])
+			if storeErr != nil {
+				// We can't resume from a partial object.
+				log.Printf("Error storing upload (image ID: %s): %s\n", upload.ID, storeErr.Error())
+				removed = true
+				service.discardTusUpload(upload)
+				return nil, nil, storageError(storeErr)
+			}
+
+			upload.Offset += uint(n)
+			if len(upload.head) < sniffLength {
+				upload.head = append(upload.head, buf[:n]...)
+			}
+		}
+
+		if err != nil {
+			// Client may have dropped the connection. It can resume
+			// from the offset we've stored so far.
+			if err != io.EOF {
+				log.Printf("Error reading upload (image ID: %s): %s\n", upload.ID, err.Error())
+			}
+
+			break
+		}
+	}
+
+	if !upload.sniffed && (len(upload.head) >= sniffLength || upload.Offset == upload.Length) {
+		mediaType, err := sniffImage(upload.head)
+		if err == nil && !link.Policy.allowsType(mediaType) {
+			// Usage has already been reserved, so we only check the type.
+			err = errMediaTypeNotAllowed
+		}
+
+		if err != nil {
+			log.Printf("Rejected resumable upload (image ID: %s): %s\n", upload.ID, err.Error())
+			removed = true
+			service.discardTusUpload(upload)
+			return nil, nil, err
+		}
+
+		upload.MediaType = mediaType
+		upload.sniffed = true
+		upload.head = nil
+	}
+
+	upload.hashState, _ = hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	if upload.Offset < upload.Length {
+		return upload, nil, nil
+	}
+
+	removed = true
+	err = upload.writer.Close()
+	if err != nil {
+		log.Printf("Error storing upload (image ID: %s): %s\n", upload.ID, err.Error())
+		service.discardTusUpload(upload)
+		return nil, nil, storageError(err)
+	}
+
+	service.data.removeTusUpload(upload.ID)
+
+	log.Printf("Processed %s (image ID: %s)\n", upload.Filename, upload.ID)
+
+	processed, err := service.commitImage(linkID, upload.ID, ImageMeta{
+		Hash:      fmt.Sprintf("%x", hasher.Sum(nil)),
+		MediaType: upload.MediaType,
+		Size:      upload.Length,
+		Filename:  upload.Filename,
+	})
+
+	if err != nil {
+		service.data.releaseLinkUsage(linkID, 1, upload.Length)
+		return nil, nil, err
+	}
+
+	return upload, &processed, nil
+}
+
+// TerminateTusUpload by discarding whatever has been stored so far.
+func (service *ImageService) TerminateTusUpload(linkID, uploadID string) error {
+	upload, err := service.lockTusUpload(linkID, uploadID)
+	if err != nil {
+		return err
+	}
+
+	service.discardTusUpload(upload)
+	log.Printf("Terminated resumable upload (image ID: %s)\n", upload.ID)
+
+	return nil
+}
+
+// discardTusUpload along with whatever has been stored so far, and release the
+// usage reserved for it.
+func (service *ImageService) discardTusUpload(upload *TusUpload) {
+	service.data.removeTusUpload(upload.ID)
+	service.data.releaseLinkUsage(upload.LinkID, 1, upload.Length)
+	var err error
+	if upload.writer != nil {
+		err = upload.writer.abort()
+	} else {
+		err = service.objects.discardObject(upload.ID)
+	}
+
+	if err != nil {
+		log.Printf("Error discarding upload (image ID: %s): %s\n", upload.ID, err.Error())
+	}
+}
+
+// expireTusUploads periodically, so that abandoned uploads don't hold on to their
+// writers (and the usage reserved in their links) forever.
+func (service *ImageService) expireTusUploads() {
+	ticker := time.NewTicker(tusExpiryInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		service.removeIdleTusUploads(now.UTC())
+	}
+}
+
+// removeIdleTusUploads which haven't been appended for a while, or whose links have
+// expired by the given time. Uploads which are being appended right now are left alone.
+func (service *ImageService) removeIdleTusUploads(now time.Time) {
+	for _, upload := range service.data.listTusUploads() {
+		// If the store is down, then we only check whether the upload is idle.
+		link, _ := service.data.fetchUploadLink(upload.LinkID)
+		linkExpired := link != nil && !link.Expiry.After(now)
+		if upload.busy || (!linkExpired && now.Sub(upload.updated) < service.tusIdleTimeout) {
+			continue
+		}
+
+		locked := service.data.lockTusUpload(upload.ID)
+		if locked == nil || locked.busy || (!linkExpired && now.Sub(locked.updated) < service.tusIdleTimeout) {
+			// It's been removed or appended in the meantime.
+			if locked != nil && !locked.busy {
+				service.data.releaseTusUpload(*locked)
+			}
+
+			continue
+		}
+
+		service.discardTusUpload(locked)
+		log.Printf("Removed idle resumable upload (image ID: %s)\n", locked.ID)
+	}
+}
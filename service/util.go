@@ -1,23 +1,268 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
-	"math/rand"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
 )
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-// randomAlphanumeric generates a pseudo-random alphanumeric sequence
-// of the given length.
+var (
+	errMalformedRange     = errors.New("Malformed range")
+	errUnsatisfiableRange = errors.New("Range not satisfiable")
+	errNotImageContent    = errors.New("Content is not a supported image")
+)
+
+// uploadBufs has buffers for streaming uploads to the store, so that concurrent
+// uploads don't keep allocating them.
+var uploadBufs = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, uploadBufSize)
+		return &buf
+	},
+}
+
+// readHead of some content, i.e., the first few bytes which are enough for
+// sniffing the format (or less, if the content is shorter).
+func readHead(reader io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(reader, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return head[:n], err
+}
+
+// sniffImage using the magic numbers in the given head of some content.
+// Returns the media type of the image.
+func sniffImage(head []byte) (string, error) {
+	kind, err := filetype.Image(head)
+	if err != nil || kind == types.Unknown {
+		return "", errNotImageContent
+	}
+
+	return kind.MIME.Value, nil
+}
+
+// byteRange in some object.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange header value for this range in an object of the given size.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// randomAlphanumeric generates a random alphanumeric sequence of the given length.
+// This uses `crypto/rand`, because the sequences are used for IDs which must not be
+// guessed (say, upload links).
 func randomAlphanumeric(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Int63()%int64(len(letterBytes))]
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		_, err := rand.Read(buf)
+		if err != nil {
+			// There's no way to generate IDs without the system's randomness.
+			panic(err)
+		}
+
+		// Bytes beyond the largest multiple of the alphabet are skipped, so that all
+		// the letters are equally likely.
+		for _, c := range buf {
+			if int(c) < 256/len(letterBytes)*len(letterBytes) && len(b) < n {
+				b = append(b, letterBytes[int(c)%len(letterBytes)])
+			}
+		}
 	}
 	return string(b)
 }
 
+// containsString checks whether the given slice has the given value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeMediaType by removing parameters (if any) and converting to lowercase.
+func normalizeMediaType(mediaType string) string {
+	idx := strings.Index(mediaType, ";")
+	if idx >= 0 {
+		mediaType = mediaType[:idx]
+	}
+
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// parseRanges from the given `Range` header value for an object of the given size.
+// Unsatisfiable ranges are skipped, and if all of them are unsatisfiable, then
+// `errUnsatisfiableRange` is returned. Malformed headers should be ignored.
+func parseRanges(header string, size int64) ([]byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errMalformedRange
+	}
+
+	var ranges []byteRange
+	specs := strings.Split(header[len(prefix):], ",")
+	if len(specs) > maxByteRanges {
+		return nil, errMalformedRange
+	}
+
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		idx := strings.Index(spec, "-")
+		if idx < 0 {
+			return nil, errMalformedRange
+		}
+
+		first, last := strings.TrimSpace(spec[:idx]), strings.TrimSpace(spec[idx+1:])
+		if first == "" {
+			// Suffix range for the last N bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errMalformedRange
+			}
+
+			if n > size {
+				n = size
+			}
+
+			if n > 0 {
+				ranges = append(ranges, byteRange{size - n, n})
+			}
+
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errMalformedRange
+		}
+
+		end := size - 1
+		if last != "" {
+			end, err = strconv.ParseInt(last, 10, 64)
+			if err != nil || end < start {
+				return nil, errMalformedRange
+			}
+
+			if end >= size {
+				end = size - 1
+			}
+		}
+
+		if start < size {
+			ranges = append(ranges, byteRange{start, end - start + 1})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+
+	return ranges, nil
+}
+
+// multipartRangesLength is the length of a `multipart/byteranges` body for the
+// given ranges, media type, object size and boundary.
+func multipartRangesLength(ranges []byteRange, mediaType string, size int64, boundary string) int64 {
+	var counter countingWriter
+	writer := multipart.NewWriter(&counter)
+	writer.SetBoundary(boundary)
+	for _, r := range ranges {
+		writer.CreatePart(rangePartHeader(r, mediaType, size))
+		counter += countingWriter(r.length)
+	}
+	writer.Close()
+
+	return int64(counter)
+}
+
+// rangePartHeader for some part in a `multipart/byteranges` body.
+func rangePartHeader(r byteRange, mediaType string, size int64) textproto.MIMEHeader {
+	header := textproto.MIMEHeader{}
+	header.Set(headerContentType, mediaType)
+	header.Set(headerContentRange, r.contentRange(size))
+	return header
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// etagMatches checks whether the given ETag matches any of the ETags in the
+// given `If-None-Match` header value (using weak comparison).
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, value := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(value), "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isNotModified checks the conditional headers in the given request against the given
+// ETag and modification time. `If-Modified-Since` is ignored if `If-None-Match` exists.
+func isNotModified(h http.Header, etag string, modified time.Time) bool {
+	if header := h.Get(headerIfNoneMatch); header != "" {
+		return etagMatches(header, etag)
+	}
+
+	since, err := http.ParseTime(h.Get(headerIfModifiedSince))
+	return err == nil && !modified.After(since)
+}
+
+// rangeApplies checks the `If-Range` header (if any) in the given request against
+// the given ETag and modification time. Ranges are ignored if this is false.
+func rangeApplies(h http.Header, etag string, modified time.Time) bool {
+	header := h.Get(headerIfRange)
+	if header == "" {
+		return true
+	}
+
+	if strings.HasPrefix(header, "\"") {
+		// Strong comparison, so weak ETags never match.
+		return header == etag
+	}
+
+	date, err := http.ParseTime(header)
+	return err == nil && modified.Equal(date)
+}
+
 // acceptJSON from the incoming request and respond with error if we're unable to
 // decode the response.
 func acceptJSON(w http.ResponseWriter, r *http.Request, value interface{}) error {
@@ -32,13 +277,20 @@ func acceptJSON(w http.ResponseWriter, r *http.Request, value interface{}) error
 
 // respondJSON in this response using the given value.
 func respondJSON(w http.ResponseWriter, value interface{}) error {
-	w.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(w)
-	err := encoder.Encode(value)
+	return respondJSONWithStatus(w, value, http.StatusOK)
+}
+
+// respondJSONWithStatus encodes the given value in the response with the given status code.
+func respondJSONWithStatus(w http.ResponseWriter, value interface{}, code int) error {
+	data, err := json.Marshal(value)
 	if err != nil {
 		respondError(w, "Error writing JSON data.", http.StatusInternalServerError)
+		return err
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(append(data, '\n'))
 	return err
 }
 
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	// Decoders for the formats we can resize.
+	_ "image/gif"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Ways of fitting an image into the requested dimensions.
+const (
+	// Scale down (preserving aspect ratio) so that the image fits within the dimensions.
+	fitContain = "contain"
+	// Scale (preserving aspect ratio) so that the image covers the dimensions and crop the rest.
+	fitCover = "cover"
+	// Stretch the image to the exact dimensions.
+	fitFill = "fill"
+)
+
+var (
+	errInvalidVariant   = errors.New("Invalid width, height, fit, quality or format for image")
+	errUnknownPreset    = errors.New("Unknown preset for image")
+	errUnsupportedImage = errors.New("Image cannot be decoded for creating variants")
+	errImageTooLarge    = errors.New("Image is too large for creating variants")
+)
+
+// VariantParams for generating resized, cropped and/or transcoded variants of an image.
+type VariantParams struct {
+	Width   int
+	Height  int
+	Fit     string
+	Quality int
+	// Format to encode the variant in (if it's different from the original).
+	Format string
+}
+
+// suffix which distinguishes this variant from the others of the same image.
+func (p VariantParams) suffix() string {
+	suffix := fmt.Sprintf("%dx%d-%s-q%d", p.Width, p.Height, p.Fit, p.Quality)
+	if p.Format != "" {
+		suffix += "-" + p.Format
+	}
+
+	return suffix
+}
+
+// key for the variant of the image with the given hash. This is also
+// used as the ID of the variant in the object store.
+func (p VariantParams) key(hash string) string {
+	return fmt.Sprintf("variant-%s-%s", hash, p.suffix())
+}
+
+// validate these params and fill the defaults.
+func (p *VariantParams) validate() error {
+	if p.Fit == "" {
+		p.Fit = fitContain
+	}
+
+	if p.Quality == 0 {
+		p.Quality = defaultVariantQuality
+	}
+
+	// Variants can only be transcoded without resizing.
+	if p.Width < 0 || p.Height < 0 || (p.Width == 0 && p.Height == 0 && p.Format == "") ||
+		p.Width > maxVariantDimension || p.Height > maxVariantDimension ||
+		p.Quality < 1 || p.Quality > 100 {
+		return errInvalidVariant
+	}
+
+	if p.Fit != fitContain && p.Fit != fitCover && p.Fit != fitFill {
+		return errInvalidVariant
+	}
+
+	if p.Format != "" && !isOutputFormat(p.Format) {
+		return errInvalidVariant
+	}
+
+	// We need both dimensions for cropping or stretching.
+	if p.Fit != fitContain && (p.Width == 0 || p.Height == 0) {
+		return errInvalidVariant
+	}
+
+	return nil
+}
+
+// parseVariantParams from the given query values (`w`, `h`, `fit`, `q`, `format` and `preset`).
+// Returns nil if no variant has been requested.
+func parseVariantParams(query map[string][]string, presets map[string]VariantParams) (*VariantParams, error) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+
+		return ""
+	}
+
+	var params VariantParams
+	if name := get("preset"); name != "" {
+		preset, exists := presets[name]
+		if !exists {
+			return nil, errUnknownPreset
+		}
+
+		params = preset
+	}
+
+	var err error
+	for key, value := range map[string]*int{"w": &params.Width, "h": &params.Height, "q": &params.Quality} {
+		if get(key) != "" && err == nil {
+			*value, err = strconv.Atoi(get(key))
+		}
+	}
+
+	if get("fit") != "" {
+		params.Fit = get("fit")
+	}
+
+	if get("format") != "" {
+		params.Format = get("format")
+	}
+
+	if err != nil {
+		return nil, errInvalidVariant
+	}
+
+	if params == (VariantParams{}) {
+		return nil, nil
+	}
+
+	err = params.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &params, nil
+}
+
+// parsePresets from the given comma-separated list of `name=WxH[:fit[:quality]]`.
+func parsePresets(value string) (map[string]VariantParams, error) {
+	presets := make(map[string]VariantParams)
+	for _, preset := range strings.Split(value, ",") {
+		preset = strings.TrimSpace(preset)
+		if preset == "" {
+			continue
+		}
+
+		idx := strings.Index(preset, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid preset: %s", preset)
+		}
+
+		var params VariantParams
+		fields := strings.Split(preset[idx+1:], ":")
+		_, err := fmt.Sscanf(fields[0], "%dx%d", &params.Width, &params.Height)
+		if err == nil && len(fields) > 1 {
+			params.Fit = fields[1]
+		}
+
+		if err == nil && len(fields) > 2 {
+			params.Quality, err = strconv.Atoi(fields[2])
+		}
+
+		if err == nil {
+			err = params.validate()
+		}
+
+		if err != nil || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid preset: %s", preset)
+		}
+
+		presets[preset[:idx]] = params
+	}
+
+	return presets, nil
+}
+
+// createVariant of the given image, encoded in the requested format, or the original
+// format (if we can encode that), or PNG otherwise. Returns the media type along with
+// the bytes.
+func createVariant(src image.Image, format string, params VariantParams) (string, []byte, error) {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW == 0 || srcH == 0 {
+		return "", nil, errUnsupportedImage
+	}
+
+	// Region of the source image that we'll be scaling.
+	srcRect := bounds
+	dstW, dstH := params.Width, params.Height
+	scaleW, scaleH := float64(dstW)/float64(srcW), float64(dstH)/float64(srcH)
+
+	switch params.Fit {
+	case fitContain:
+		scale := scaleW
+		if dstW == 0 || (dstH != 0 && scaleH < scaleW) {
+			scale = scaleH
+		}
+
+		// Don't upscale images which already fit.
+		if scale > 1 {
+			scale = 1
+		}
+
+		dstW, dstH = roundDimension(float64(srcW)*scale), roundDimension(float64(srcH)*scale)
+
+	case fitCover:
+		// Crop the source to the aspect ratio of the destination around the center.
+		cropW, cropH := srcW, srcH
+		if scaleW > scaleH {
+			cropH = roundDimension(float64(dstH) / scaleW)
+		} else {
+			cropW = roundDimension(float64(dstW) / scaleH)
+		}
+
+		x0 := bounds.Min.X + (srcW-cropW)/2
+		y0 := bounds.Min.Y + (srcH-cropH)/2
+		srcRect = image.Rect(x0, y0, x0+cropW, y0+cropH)
+	}
+
+	dst := src
+	if params.Width != 0 || params.Height != 0 {
+		scaled := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), src, srcRect, draw.Src, nil)
+		dst = scaled
+	}
+
+	if params.Format != "" {
+		format = params.Format
+	}
+
+	var buf bytes.Buffer
+	mediaType, err := encodeImage(&buf, dst, format, params.Quality)
+	return mediaType, buf.Bytes(), err
+}
+
+// roundDimension to the nearest pixel (at least one).
+func roundDimension(value float64) int {
+	if value < 1 {
+		return 1
+	}
+
+	return int(value + 0.5)
+}
+
+// VariantCache tracks the variants stored in the object store, evicting the least
+// recently used ones when they exceed the byte capacity. This is safe for concurrent use.
+//
+// **NOTE:** Variants are also tracked in the data store, so that the cache is rebuilt
+// on restart (in the order in which they were created, since we don't persist their usage).
+type VariantCache struct {
+	lock     sync.Mutex
+	capacity uint
+	size     uint
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+// NewVariantCache with the given capacity in bytes.
+func NewVariantCache(capacity uint) *VariantCache {
+	return &VariantCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get the variant for the given ID (if it exists) and mark it as recently used.
+func (c *VariantCache) get(id string) *ImageMeta {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, exists := c.entries[id]
+	if !exists {
+		return nil
+	}
+
+	c.order.MoveToFront(elem)
+	meta := elem.Value.(ImageMeta)
+	return &meta
+}
+
+// add the given variant and return the variants that should be evicted.
+func (c *VariantCache) add(meta ImageMeta) []ImageMeta {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, exists := c.entries[meta.ID]; exists {
+		c.size -= elem.Value.(ImageMeta).Size
+		c.order.Remove(elem)
+	}
+
+	c.entries[meta.ID] = c.order.PushFront(meta)
+	c.size += meta.Size
+
+	var evicted []ImageMeta
+	for c.size > c.capacity && c.order.Len() > 1 {
+		elem := c.order.Back()
+		old := elem.Value.(ImageMeta)
+		c.order.Remove(elem)
+		delete(c.entries, old.ID)
+		c.size -= old.Size
+		evicted = append(evicted, old)
+	}
+
+	return evicted
+}
+
+// fetchVariant of the given image, creating and storing it if it doesn't exist already.
+// Concurrent requests for the same variant wait for a single request to create it.
+func (service *ImageService) fetchVariant(meta *ImageMeta, params VariantParams) (*ImageMeta, error) {
+	id := params.key(meta.Hash)
+	variant := service.objects.fetchVariant(id)
+	if variant != nil {
+		return variant, nil
+	}
+
+	result, err, _ := service.objects.variantFlights.Do(id, func() (interface{}, error) {
+		return service.generateVariant(meta, id, params)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each request gets its own copy of the shared result.
+	variant = new(ImageMeta)
+	*variant = *result.(*ImageMeta)
+	return variant, nil
+}
+
+// generateVariant with the given ID for the given image, and store it. At most
+// `-max-decodes` variants are created at once (the decoded image is kept in memory
+// until the variant has been encoded).
+func (service *ImageService) generateVariant(meta *ImageMeta, id string, params VariantParams) (*ImageMeta, error) {
+	service.objects.decodeSlots <- struct{}{}
+	defer func() { <-service.objects.decodeSlots }()
+
+	// Some other request may have created it while we were waiting.
+	variant := service.objects.fetchVariant(id)
+	if variant != nil {
+		return variant, nil
+	}
+
+	src, format, err := service.objects.decodeImage(meta.Hash)
+	if err == errImageTooLarge {
+		return nil, err
+	} else if err != nil {
+		log.Printf("Cannot decode image for variant (ID: %s): %s\n", meta.ID, err.Error())
+		return nil, errUnsupportedImage
+	}
+
+	mediaType, data, err := createVariant(src, format, params)
+	if err != nil {
+		return nil, err
+	}
+
+	variant = &ImageMeta{
+		ID:        id,
+		Hash:      meta.Hash + "-" + params.suffix(),
+		MediaType: mediaType,
+		Size:      uint(len(data)),
+		Uploaded:  meta.Uploaded,
+	}
+
+	log.Printf("Storing variant %s (size: %d)\n", id, variant.Size)
+	service.objects.storeVariant(*variant, data)
+	return variant, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// Minimal lossless WebP (VP8L) encoder (https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification).
+// We only use entropy coding (no transforms, backward references or color cache),
+// which compresses worse than libwebp, but doesn't need any C dependencies.
+
+const (
+	vp8lSignature           = 0x2f
+	vp8lMaxDimension        = 1 << 14
+	vp8lMaxCodeLength       = 15
+	vp8lMaxLengthCodeLength = 7
+	// Green alphabet also has 24 length prefix codes (which we don't use).
+	vp8lGreenAlphabet    = 256 + 24
+	vp8lDistanceAlphabet = 40
+)
+
+var errWebPTooLarge = errors.New("Image is too large for WebP")
+
+// Order in which the lengths of the code length code are written.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// prefixCode is a canonical Huffman code for some alphabet.
+type prefixCode struct {
+	lengths []uint8
+	// codes with their bits reversed, since the bitstream is LSB-first.
+	codes []uint32
+	// Codes with a single symbol don't emit any bits.
+	single bool
+}
+
+// newPrefixCode from the given symbol counts, with codes no longer than the given length.
+func newPrefixCode(counts []uint32, maxLength int) prefixCode {
+	code := prefixCode{codes: make([]uint32, len(counts))}
+	used := 0
+	for _, count := range counts {
+		if count > 0 {
+			used++
+		}
+	}
+
+	if used <= 1 {
+		code.lengths = make([]uint8, len(counts))
+		code.single = true
+		for symbol, count := range counts {
+			if count > 0 {
+				code.lengths[symbol] = 1
+			}
+		}
+
+		return code
+	}
+
+	// Flatten the counts until the tree is shallow enough.
+	adjusted := make([]uint32, len(counts))
+	for minCount := uint32(1); ; minCount *= 2 {
+		for symbol, count := range counts {
+			adjusted[symbol] = count
+			if count > 0 && count < minCount {
+				adjusted[symbol] = minCount
+			}
+		}
+
+		code.lengths = huffmanLengths(adjusted)
+		valid := true
+		for _, length := range code.lengths {
+			valid = valid && int(length) <= maxLength
+		}
+
+		if valid {
+			break
+		}
+	}
+
+	// Assign canonical codes (same as DEFLATE).
+	var lengthCounts [vp8lMaxCodeLength + 2]uint32
+	for _, length := range code.lengths {
+		lengthCounts[length]++
+	}
+
+	lengthCounts[0] = 0
+	var next [vp8lMaxCodeLength + 2]uint32
+	for length, value := 1, uint32(0); length < len(next); length++ {
+		value = (value + lengthCounts[length-1]) << 1
+		next[length] = value
+	}
+
+	for symbol, length := range code.lengths {
+		if length > 0 {
+			code.codes[symbol] = reverseBits(next[length], uint(length))
+			next[length]++
+		}
+	}
+
+	return code
+}
+
+// huffmanNode is a node in the tree used for computing the code lengths.
+type huffmanNode struct {
+	count       uint32
+	symbol      int
+	left, right *huffmanNode
+}
+
+// huffmanHeap is a min-heap of nodes by count.
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int            { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool  { return h[i].count < h[j].count }
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
+
+// huffmanLengths of the (unlimited) Huffman code for the given counts. Needs at least two used symbols.
+func huffmanLengths(counts []uint32) []uint8 {
+	nodes := &huffmanHeap{}
+	for symbol, count := range counts {
+		if count > 0 {
+			*nodes = append(*nodes, &huffmanNode{count: count, symbol: symbol})
+		}
+	}
+
+	heap.Init(nodes)
+	for nodes.Len() > 1 {
+		left := heap.Pop(nodes).(*huffmanNode)
+		right := heap.Pop(nodes).(*huffmanNode)
+		heap.Push(nodes, &huffmanNode{count: left.count + right.count, left: left, right: right})
+	}
+
+	lengths := make([]uint8, len(counts))
+	var walk func(node *huffmanNode, depth uint8)
+	walk = func(node *huffmanNode, depth uint8) {
+		if node.left == nil {
+			lengths[node.symbol] = depth
+			return
+		}
+
+		walk(node.left, depth+1)
+		walk(node.right, depth+1)
+	}
+
+	walk(heap.Pop(nodes).(*huffmanNode), 0)
+	return lengths
+}
+
+// reverseBits of the given code with the given length.
+func reverseBits(code uint32, length uint) uint32 {
+	var reversed uint32
+	for i := uint(0); i < length; i++ {
+		reversed = reversed<<1 | (code>>i)&1
+	}
+
+	return reversed
+}
+
+// bitWriter writes bits in LSB-first order.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (b *bitWriter) write(value uint32, n uint) {
+	b.bits |= uint64(value) << b.nBits
+	b.nBits += n
+	for b.nBits >= 8 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits >>= 8
+		b.nBits -= 8
+	}
+}
+
+func (b *bitWriter) writeSymbol(code prefixCode, symbol int) {
+	if !code.single {
+		b.write(code.codes[symbol], uint(code.lengths[symbol]))
+	}
+}
+
+func (b *bitWriter) flush() []byte {
+	if b.nBits > 0 {
+		b.write(0, 8-b.nBits)
+	}
+
+	return b.buf
+}
+
+// writePrefixCode to the bitstream, so that the decoder can rebuild it.
+func (b *bitWriter) writePrefixCode(code prefixCode) {
+	if code.single {
+		// Simple code with one symbol (which is never written).
+		symbol := 0
+		for s, length := range code.lengths {
+			if length > 0 {
+				symbol = s
+			}
+		}
+
+		b.write(1, 1)
+		b.write(0, 1)
+		if symbol < 2 {
+			b.write(0, 1)
+			b.write(uint32(symbol), 1)
+		} else {
+			b.write(1, 1)
+			b.write(uint32(symbol), 8)
+		}
+
+		return
+	}
+
+	// Normal code, where the code lengths are themselves prefix-coded. We
+	// don't bother with the repeat codes (16-18) for the lengths.
+	counts := make([]uint32, len(vp8lCodeLengthOrder))
+	for _, length := range code.lengths {
+		counts[length]++
+	}
+
+	lengthCode := newPrefixCode(counts, vp8lMaxLengthCodeLength)
+	numCodes := 4
+	for i, symbol := range vp8lCodeLengthOrder {
+		if lengthCode.lengths[symbol] > 0 && i+1 > numCodes {
+			numCodes = i + 1
+		}
+	}
+
+	b.write(0, 1)
+	b.write(uint32(numCodes-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:numCodes] {
+		b.write(uint32(lengthCode.lengths[symbol]), 3)
+	}
+
+	// Code lengths are given for the whole alphabet.
+	b.write(0, 1)
+	for _, length := range code.lengths {
+		b.writeSymbol(lengthCode, int(length))
+	}
+}
+
+// encodeWebP encodes the given image as a lossless WebP image.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > vp8lMaxDimension || height > vp8lMaxDimension {
+		return errWebPTooLarge
+	}
+
+	pixels, ok := img.(*image.NRGBA)
+	if !ok || len(pixels.Pix) != 4*width*height {
+		pixels = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(pixels, pixels.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	green := make([]uint32, vp8lGreenAlphabet)
+	red, blue, alpha := make([]uint32, 256), make([]uint32, 256), make([]uint32, 256)
+	hasAlpha := false
+	for i := 0; i < len(pixels.Pix); i += 4 {
+		red[pixels.Pix[i]]++
+		green[pixels.Pix[i+1]]++
+		blue[pixels.Pix[i+2]]++
+		alpha[pixels.Pix[i+3]]++
+		hasAlpha = hasAlpha || pixels.Pix[i+3] != 0xff
+	}
+
+	codes := []prefixCode{
+		newPrefixCode(green, vp8lMaxCodeLength),
+		newPrefixCode(red, vp8lMaxCodeLength),
+		newPrefixCode(blue, vp8lMaxCodeLength),
+		newPrefixCode(alpha, vp8lMaxCodeLength),
+		// No backward references, so there aren't any distances.
+		newPrefixCode(make([]uint32, vp8lDistanceAlphabet), vp8lMaxCodeLength),
+	}
+
+	b := &bitWriter{buf: []byte{vp8lSignature}}
+	b.write(uint32(width-1), 14)
+	b.write(uint32(height-1), 14)
+	if hasAlpha {
+		b.write(1, 1)
+	} else {
+		b.write(0, 1)
+	}
+
+	// Version, followed by flags for transforms, color cache and meta prefix codes.
+	b.write(0, 3)
+	b.write(0, 1)
+	b.write(0, 1)
+	b.write(0, 1)
+	for _, code := range codes {
+		b.writePrefixCode(code)
+	}
+
+	for i := 0; i < len(pixels.Pix); i += 4 {
+		b.writeSymbol(codes[0], int(pixels.Pix[i+1]))
+		b.writeSymbol(codes[1], int(pixels.Pix[i]))
+		b.writeSymbol(codes[2], int(pixels.Pix[i+2]))
+		b.writeSymbol(codes[3], int(pixels.Pix[i+3]))
+	}
+
+	data := b.flush()
+	padding := len(data) % 2
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+padding))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+
+	_, err := w.Write(header)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+
+	if err == nil && padding > 0 {
+		_, err = w.Write([]byte{0})
+	}
+
+	return err
+}